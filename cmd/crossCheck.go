@@ -0,0 +1,150 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/gethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+)
+
+// crossCheckCmd represents the crossCheck command
+var crossCheckCmd = &cobra.Command{
+	Use:     "crossCheck",
+	Aliases: []string{"cross-check"},
+	Short:   "Check a published snapshot against leveldb and a live node",
+	Long: `Reads the header at a height from leveldb, checks its state root matches the header of a live node over RPC,
+and that the root node published for the header in postgres has the CID of that root. Then a random sample of the
+published state leaves are decoded and compared with the accounts returned by the node's eth_getProof. Leaf keys
+are mapped to addresses with the preimages in leveldb, so accounts without a recorded preimage are skipped.
+Every mismatch is logged, and the command fails if there are any.
+
+Usage
+
+./ipld-eth-state-snapshot crossCheck --config={path to toml config file} --block-height={height} --rpc={url} [--sample={accounts}]`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.LVL_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.LVL_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.ANCIENT_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.CROSS_CHECK_RPC_TOML, cmd.PersistentFlags().Lookup(snapshot.CROSS_CHECK_RPC_CLI))
+		viper.BindPFlag(snapshot.CROSS_CHECK_SAMPLE_TOML, cmd.PersistentFlags().Lookup(snapshot.CROSS_CHECK_SAMPLE_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		crossCheck()
+	},
+}
+
+func crossCheck() {
+	viper.BindEnv(snapshot.CROSS_CHECK_RPC_TOML, snapshot.CROSS_CHECK_RPC)
+	viper.BindEnv(snapshot.CROSS_CHECK_SAMPLE_TOML, snapshot.CROSS_CHECK_SAMPLE)
+
+	config, err := snapshot.NewConfig(snapshot.PgSnapshot)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if height < 0 {
+		logWithCommand.Fatal("a block height must be provided")
+	}
+	rpcURL := viper.GetString(snapshot.CROSS_CHECK_RPC_TOML)
+	if rpcURL == "" {
+		logWithCommand.Fatal("the RPC endpoint of a live node must be provided")
+	}
+	sample := viper.GetInt(snapshot.CROSS_CHECK_SAMPLE_TOML)
+
+	edb, err := snapshot.NewLevelDB(config.Eth)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer edb.Close()
+	hash := rawdb.ReadCanonicalHash(edb, uint64(height))
+	header := rawdb.ReadHeader(edb, hash, uint64(height))
+	if header == nil {
+		logWithCommand.Fatalf("unable to read canonical header at height %d", height)
+	}
+	report := &snapshot.CrossCheckReport{Height: uint64(height), StateRoot: header.Root}
+
+	ctx := context.Background()
+	client, err := rpc.DialContext(ctx, rpcURL)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer client.Close()
+	live, err := ethclient.NewClient(client).HeaderByNumber(ctx, big.NewInt(height))
+	if err != nil {
+		logWithCommand.Fatalf("failed to get header %d from the live node: %v", height, err)
+	}
+	report.CheckStateRoot(live.Root)
+
+	driver, err := postgres.NewPGXDriver(ctx, config.DB.ConnConfig, config.Eth.NodeInfo)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	db := postgres.NewPostgresDB(driver)
+	defer db.Close()
+
+	headerID := header.Hash().String()
+	rootCID, err := pg.StateRootCID(ctx, db, headerID)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	if err = report.CheckRoot(rootCID); err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	leaves, err := pg.SampleStateLeaves(ctx, db, headerID, sample)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	preimage := func(key common.Hash) []byte { return rawdb.ReadPreimage(edb, key) }
+	err = report.CheckAccounts(ctx, leaves, pg.NewDBBlockSource(db), gethclient.New(client), preimage)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("checked state root and %d accounts of header %s (%d skipped without a preimage): %d mismatches",
+		report.Checked, headerID, report.Skipped, len(report.Mismatches))
+	if report.Checked == 0 && report.Skipped > 0 {
+		logWithCommand.Warn("no sampled account had a preimage, they may not have been recorded (see geth's --cache.preimages)")
+	}
+	if len(report.Mismatches) > 0 {
+		logWithCommand.Fatal("cross-check failed")
+	}
+	logWithCommand.Infof("snapshot at height %d matches the live node", height)
+}
+
+func init() {
+	rootCmd.AddCommand(crossCheckCmd)
+
+	crossCheckCmd.PersistentFlags().String(snapshot.LVL_DB_PATH_CLI, "", "path to primary datastore")
+	crossCheckCmd.PersistentFlags().String(snapshot.ANCIENT_DB_PATH_CLI, "", "path to ancient datastore")
+	crossCheckCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, -1, "block height of the snapshot to check")
+	crossCheckCmd.PersistentFlags().String(snapshot.CROSS_CHECK_RPC_CLI, "", "RPC endpoint of a live node serving eth_getProof at the height")
+	crossCheckCmd.PersistentFlags().Int(snapshot.CROSS_CHECK_SAMPLE_CLI, 100, "number of randomly sampled accounts to compare")
+}
@@ -0,0 +1,149 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// dumpCodeCmd represents the dumpCode command
+var dumpCodeCmd = &cobra.Command{
+	Use:     "dumpCode",
+	Aliases: []string{"dump-code"},
+	Short:   "List the distinct contract code hashes and sizes in the state",
+	Long: `Walks the state trie at a height, or reads only the watched addresses, and writes each distinct
+code hash and its size, optionally with the bytecode, as CSV or newline-delimited JSON.
+
+Usage
+
+./ipld-eth-state-snapshot dumpCode --config={path to toml config file} [--addresses={address,...}] [--with-bytecode] [--code-dir={dir}]`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.LVL_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.LVL_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.ANCIENT_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.EXPORT_ADDRESSES_TOML, cmd.PersistentFlags().Lookup(snapshot.EXPORT_ADDRESSES_CLI))
+		viper.BindPFlag(snapshot.EXPORT_FORMAT_TOML, cmd.PersistentFlags().Lookup(snapshot.EXPORT_FORMAT_CLI))
+		viper.BindPFlag(snapshot.EXPORT_OUTPUT_FILE_TOML, cmd.PersistentFlags().Lookup(snapshot.EXPORT_OUTPUT_FILE_CLI))
+		viper.BindPFlag(snapshot.EXPORT_WITH_BYTECODE_TOML, cmd.PersistentFlags().Lookup(snapshot.EXPORT_WITH_BYTECODE_CLI))
+		viper.BindPFlag(snapshot.EXPORT_CODE_DIR_TOML, cmd.PersistentFlags().Lookup(snapshot.EXPORT_CODE_DIR_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		dumpCode()
+	},
+}
+
+func dumpCode() {
+	viper.BindEnv(snapshot.EXPORT_ADDRESSES_TOML, snapshot.EXPORT_ADDRESSES)
+	viper.BindEnv(snapshot.EXPORT_FORMAT_TOML, snapshot.EXPORT_FORMAT)
+	viper.BindEnv(snapshot.EXPORT_OUTPUT_FILE_TOML, snapshot.EXPORT_OUTPUT_FILE)
+	viper.BindEnv(snapshot.EXPORT_WITH_BYTECODE_TOML, snapshot.EXPORT_WITH_BYTECODE)
+	viper.BindEnv(snapshot.EXPORT_CODE_DIR_TOML, snapshot.EXPORT_CODE_DIR)
+
+	var addresses []common.Address
+	for _, addr := range viper.GetStringSlice(snapshot.EXPORT_ADDRESSES_TOML) {
+		if !common.IsHexAddress(addr) {
+			logWithCommand.Fatalf("invalid address: %s", addr)
+		}
+		addresses = append(addresses, common.HexToAddress(addr))
+	}
+	format, err := snapshot.ParseExportFormat(viper.GetString(snapshot.EXPORT_FORMAT_TOML))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	config := &snapshot.EthConfig{}
+	viper.BindEnv(snapshot.ANCIENT_DB_PATH_TOML, snapshot.ANCIENT_DB_PATH)
+	viper.BindEnv(snapshot.LVL_DB_PATH_TOML, snapshot.LVL_DB_PATH)
+	config.AncientDBPath = viper.GetString(snapshot.ANCIENT_DB_PATH_TOML)
+	config.LevelDBPath = viper.GetString(snapshot.LVL_DB_PATH_TOML)
+	if err := config.InitEmptyHashes(); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("opening levelDB and ancient data at %s and %s",
+		config.LevelDBPath, config.AncientDBPath)
+	edb, err := snapshot.NewLevelDB(config)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer edb.Close()
+
+	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if height < 0 {
+		number := rawdb.ReadHeaderNumber(edb, rawdb.ReadHeadHeaderHash(edb))
+		if number == nil {
+			logWithCommand.Fatal("unable to read head header height")
+		}
+		height = int64(*number)
+	}
+
+	var out io.Writer = os.Stdout
+	if path := viper.GetString(snapshot.EXPORT_OUTPUT_FILE_TOML); path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		defer file.Close()
+		out = file
+	}
+	writer, err := snapshot.NewCodeDumpWriter(out, format,
+		viper.GetBool(snapshot.EXPORT_WITH_BYTECODE_TOML), viper.GetString(snapshot.EXPORT_CODE_DIR_TOML))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	snapshotService, err := snapshot.NewSnapshotService(edb, nil, "")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	snapshotService.SetEmptyHashes(config.EmptyCodeHash, config.EmptyRoot)
+	var count, size int
+	err = snapshotService.DumpCode(uint64(height), addresses, func(code snapshot.ContractCode) error {
+		count++
+		size += len(code.Code)
+		return writer.Write(code)
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("dumped %d distinct codes (%d bytes) at height %d", count, size, height)
+}
+
+func init() {
+	rootCmd.AddCommand(dumpCodeCmd)
+
+	dumpCodeCmd.PersistentFlags().String(snapshot.LVL_DB_PATH_CLI, "", "path to primary datastore")
+	dumpCodeCmd.PersistentFlags().String(snapshot.ANCIENT_DB_PATH_CLI, "", "path to ancient datastore")
+	dumpCodeCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, -1, "block height to dump code at (-1 for the head)")
+	dumpCodeCmd.PersistentFlags().StringSlice(snapshot.EXPORT_ADDRESSES_CLI, nil, "watched addresses to dump the code of (default: walk the whole state)")
+	dumpCodeCmd.PersistentFlags().String(snapshot.EXPORT_FORMAT_CLI, string(snapshot.ExportCSV), "output format ('csv' or 'json')")
+	dumpCodeCmd.PersistentFlags().String(snapshot.EXPORT_OUTPUT_FILE_CLI, "", "file to write to (default: stdout)")
+	dumpCodeCmd.PersistentFlags().Bool(snapshot.EXPORT_WITH_BYTECODE_CLI, false, "also write the hex encoded bytecode")
+	dumpCodeCmd.PersistentFlags().String(snapshot.EXPORT_CODE_DIR_CLI, "", "directory to write each bytecode to, in a file named by its hash")
+}
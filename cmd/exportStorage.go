@@ -0,0 +1,147 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// exportStorageCmd represents the exportStorage command
+var exportStorageCmd = &cobra.Command{
+	Use:     "exportStorage",
+	Aliases: []string{"export-storage"},
+	Short:   "Export the storage of watched addresses as slot/value pairs",
+	Long: `Walks the storage trie of each watched address at a height and writes its decoded slots,
+rather than trie nodes, as CSV or newline-delimited JSON.
+
+Usage
+
+./ipld-eth-state-snapshot exportStorage --config={path to toml config file} --addresses={address,...}`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.LVL_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.LVL_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.ANCIENT_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.EXPORT_ADDRESSES_TOML, cmd.PersistentFlags().Lookup(snapshot.EXPORT_ADDRESSES_CLI))
+		viper.BindPFlag(snapshot.EXPORT_FORMAT_TOML, cmd.PersistentFlags().Lookup(snapshot.EXPORT_FORMAT_CLI))
+		viper.BindPFlag(snapshot.EXPORT_RAW_SLOTS_TOML, cmd.PersistentFlags().Lookup(snapshot.EXPORT_RAW_SLOTS_CLI))
+		viper.BindPFlag(snapshot.EXPORT_OUTPUT_FILE_TOML, cmd.PersistentFlags().Lookup(snapshot.EXPORT_OUTPUT_FILE_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		exportStorage()
+	},
+}
+
+func exportStorage() {
+	viper.BindEnv(snapshot.EXPORT_ADDRESSES_TOML, snapshot.EXPORT_ADDRESSES)
+	viper.BindEnv(snapshot.EXPORT_FORMAT_TOML, snapshot.EXPORT_FORMAT)
+	viper.BindEnv(snapshot.EXPORT_RAW_SLOTS_TOML, snapshot.EXPORT_RAW_SLOTS)
+	viper.BindEnv(snapshot.EXPORT_OUTPUT_FILE_TOML, snapshot.EXPORT_OUTPUT_FILE)
+
+	var addresses []common.Address
+	for _, addr := range viper.GetStringSlice(snapshot.EXPORT_ADDRESSES_TOML) {
+		if !common.IsHexAddress(addr) {
+			logWithCommand.Fatalf("invalid address: %s", addr)
+		}
+		addresses = append(addresses, common.HexToAddress(addr))
+	}
+	if len(addresses) == 0 {
+		logWithCommand.Fatal("no addresses to export")
+	}
+	format, err := snapshot.ParseExportFormat(viper.GetString(snapshot.EXPORT_FORMAT_TOML))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	config := &snapshot.EthConfig{}
+	viper.BindEnv(snapshot.ANCIENT_DB_PATH_TOML, snapshot.ANCIENT_DB_PATH)
+	viper.BindEnv(snapshot.LVL_DB_PATH_TOML, snapshot.LVL_DB_PATH)
+	config.AncientDBPath = viper.GetString(snapshot.ANCIENT_DB_PATH_TOML)
+	config.LevelDBPath = viper.GetString(snapshot.LVL_DB_PATH_TOML)
+	if err := config.InitEmptyHashes(); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("opening levelDB and ancient data at %s and %s",
+		config.LevelDBPath, config.AncientDBPath)
+	edb, err := snapshot.NewLevelDB(config)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer edb.Close()
+
+	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if height < 0 {
+		number := rawdb.ReadHeaderNumber(edb, rawdb.ReadHeadHeaderHash(edb))
+		if number == nil {
+			logWithCommand.Fatal("unable to read head header height")
+		}
+		height = int64(*number)
+	}
+
+	var out io.Writer = os.Stdout
+	if path := viper.GetString(snapshot.EXPORT_OUTPUT_FILE_TOML); path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		defer file.Close()
+		out = file
+	}
+	writer, err := snapshot.NewStorageExportWriter(out, format, viper.GetBool(snapshot.EXPORT_RAW_SLOTS_TOML))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	snapshotService, err := snapshot.NewSnapshotService(edb, nil, "")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	snapshotService.SetEmptyHashes(config.EmptyCodeHash, config.EmptyRoot)
+	var count int
+	err = snapshotService.ExportStorage(uint64(height), addresses, func(slot snapshot.StorageSlot) error {
+		count++
+		return writer.Write(slot)
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("exported %d storage slots of %d accounts at height %d", count, len(addresses), height)
+}
+
+func init() {
+	rootCmd.AddCommand(exportStorageCmd)
+
+	exportStorageCmd.PersistentFlags().String(snapshot.LVL_DB_PATH_CLI, "", "path to primary datastore")
+	exportStorageCmd.PersistentFlags().String(snapshot.ANCIENT_DB_PATH_CLI, "", "path to ancient datastore")
+	exportStorageCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, -1, "block height to export storage at (-1 for the head)")
+	exportStorageCmd.PersistentFlags().StringSlice(snapshot.EXPORT_ADDRESSES_CLI, nil, "watched addresses to export the storage of")
+	exportStorageCmd.PersistentFlags().String(snapshot.EXPORT_FORMAT_CLI, string(snapshot.ExportCSV), "output format ('csv' or 'json')")
+	exportStorageCmd.PersistentFlags().Bool(snapshot.EXPORT_RAW_SLOTS_CLI, false, "write slot preimages instead of hashed slot keys (requires preimages in leveldb)")
+	exportStorageCmd.PersistentFlags().String(snapshot.EXPORT_OUTPUT_FILE_CLI, "", "file to write to (default: stdout)")
+}
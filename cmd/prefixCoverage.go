@@ -0,0 +1,133 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"os"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+)
+
+// prefixCoverageCmd represents the prefixCoverage command
+var prefixCoverageCmd = &cobra.Command{
+	Use:     "prefixCoverage",
+	Aliases: []string{"prefix-coverage"},
+	Short:   "Summarize which state path prefixes have nodes in a published snapshot",
+	Long: `Counts the state nodes published for the headers at a height under each path prefix of the given
+depth (1 to 3 nibbles), and prints the counts as a grid. Prefixes with no nodes where some are expected are
+flagged, as they indicate an incomplete shard or filter. If leveldb is configured, the expected prefixes are
+read from the state trie; otherwise, empty prefixes are flagged when most prefixes have nodes.
+
+Usage
+
+./ipld-eth-state-snapshot prefixCoverage --config={path to toml config file} --block-height={height} [--depth={nibbles}] [--leveldb-path={path}]`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.LVL_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.LVL_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.ANCIENT_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.COVERAGE_DEPTH_TOML, cmd.PersistentFlags().Lookup(snapshot.COVERAGE_DEPTH_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		prefixCoverage()
+	},
+}
+
+func prefixCoverage() {
+	viper.BindEnv(snapshot.COVERAGE_DEPTH_TOML, snapshot.COVERAGE_DEPTH)
+
+	config, err := snapshot.NewConfig(snapshot.PgSnapshot)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if height < 0 {
+		logWithCommand.Fatal("a block height must be provided")
+	}
+	depth := viper.GetInt(snapshot.COVERAGE_DEPTH_TOML)
+	if depth < 1 || depth > snapshot.MaxCoverageDepth {
+		logWithCommand.Fatalf("depth must be between 1 and %d", snapshot.MaxCoverageDepth)
+	}
+
+	// the expected prefixes are only known for the canonical header in leveldb
+	var canonicalID string
+	var expected map[string]bool
+	if config.Eth.LevelDBPath != "" {
+		edb, err := snapshot.NewLevelDB(config.Eth)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		defer edb.Close()
+		service, err := snapshot.NewSnapshotService(edb, nil, "")
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		service.SetEmptyHashes(config.Eth.EmptyCodeHash, config.Eth.EmptyRoot)
+		if canonicalID, expected, err = service.StatePrefixes(uint64(height), depth); err != nil {
+			logWithCommand.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	driver, err := postgres.NewPGXDriver(ctx, config.DB.ConnConfig, config.Eth.NodeInfo)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	db := postgres.NewPostgresDB(driver)
+	defer db.Close()
+
+	headerIDs, err := pg.HeaderIDsAt(ctx, db, uint64(height))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	if len(headerIDs) == 0 {
+		logWithCommand.Fatalf("no header is indexed at height %d", height)
+	}
+	for _, headerID := range headerIDs {
+		counts, err := pg.StatePrefixCounts(ctx, db, headerID, depth)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		coverage := snapshot.PrefixCoverage{Depth: depth, Counts: counts}
+		if headerID == canonicalID {
+			coverage.Expected = expected
+		}
+		logWithCommand.Infof("state nodes of header %s by path prefix:", headerID)
+		if err = coverage.WriteGrid(os.Stdout); err != nil {
+			logWithCommand.Fatal(err)
+		}
+		if gaps := coverage.Gaps(); len(gaps) > 0 {
+			logWithCommand.Warnf("header %s has no state nodes under prefixes %v", headerID, gaps)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(prefixCoverageCmd)
+
+	prefixCoverageCmd.PersistentFlags().String(snapshot.LVL_DB_PATH_CLI, "", "path to primary datastore, to read the expected prefixes from (optional)")
+	prefixCoverageCmd.PersistentFlags().String(snapshot.ANCIENT_DB_PATH_CLI, "", "path to ancient datastore")
+	prefixCoverageCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, -1, "block height of the snapshot to summarize")
+	prefixCoverageCmd.PersistentFlags().Int(snapshot.COVERAGE_DEPTH_CLI, 2, "number of nibbles of the path prefixes")
+}
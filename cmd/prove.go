@@ -0,0 +1,143 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// proveCmd represents the prove command
+var proveCmd = &cobra.Command{
+	Use:   "prove",
+	Short: "Export a Merkle proof of an account, and optionally of its storage slots",
+	Long: `Writes the trie nodes on the path from the state root to an account, and from its storage root to
+each given slot, along with the state root and the account's fields, in the layout of eth_getProof.
+The proof is written as JSON or RLP.
+
+Usage
+
+./ipld-eth-state-snapshot prove --config={path to toml config file} --address={address} --slots={slot,...} --block-height={height}`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.LVL_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.LVL_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.ANCIENT_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.PROVE_ADDRESS_TOML, cmd.PersistentFlags().Lookup(snapshot.PROVE_ADDRESS_CLI))
+		viper.BindPFlag(snapshot.PROVE_SLOTS_TOML, cmd.PersistentFlags().Lookup(snapshot.PROVE_SLOTS_CLI))
+		viper.BindPFlag(snapshot.PROVE_FORMAT_TOML, cmd.PersistentFlags().Lookup(snapshot.PROVE_FORMAT_CLI))
+		viper.BindPFlag(snapshot.PROVE_OUTPUT_FILE_TOML, cmd.PersistentFlags().Lookup(snapshot.PROVE_OUTPUT_FILE_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		prove()
+	},
+}
+
+func prove() {
+	viper.BindEnv(snapshot.PROVE_ADDRESS_TOML, snapshot.PROVE_ADDRESS)
+	viper.BindEnv(snapshot.PROVE_SLOTS_TOML, snapshot.PROVE_SLOTS)
+	viper.BindEnv(snapshot.PROVE_FORMAT_TOML, snapshot.PROVE_FORMAT)
+	viper.BindEnv(snapshot.PROVE_OUTPUT_FILE_TOML, snapshot.PROVE_OUTPUT_FILE)
+
+	addr := viper.GetString(snapshot.PROVE_ADDRESS_TOML)
+	if !common.IsHexAddress(addr) {
+		logWithCommand.Fatalf("invalid address: %s", addr)
+	}
+	var slots []common.Hash
+	for _, slot := range viper.GetStringSlice(snapshot.PROVE_SLOTS_TOML) {
+		b, err := hexutil.Decode(slot)
+		if err != nil || len(b) > common.HashLength {
+			logWithCommand.Fatalf("invalid storage slot: %s", slot)
+		}
+		slots = append(slots, common.BytesToHash(b))
+	}
+	format, err := snapshot.ParseProofFormat(viper.GetString(snapshot.PROVE_FORMAT_TOML))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	config := &snapshot.EthConfig{}
+	viper.BindEnv(snapshot.ANCIENT_DB_PATH_TOML, snapshot.ANCIENT_DB_PATH)
+	viper.BindEnv(snapshot.LVL_DB_PATH_TOML, snapshot.LVL_DB_PATH)
+	config.AncientDBPath = viper.GetString(snapshot.ANCIENT_DB_PATH_TOML)
+	config.LevelDBPath = viper.GetString(snapshot.LVL_DB_PATH_TOML)
+	if err := config.InitEmptyHashes(); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("opening levelDB and ancient data at %s and %s",
+		config.LevelDBPath, config.AncientDBPath)
+	edb, err := snapshot.NewLevelDB(config)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer edb.Close()
+
+	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if height < 0 {
+		number := rawdb.ReadHeaderNumber(edb, rawdb.ReadHeadHeaderHash(edb))
+		if number == nil {
+			logWithCommand.Fatal("unable to read head header height")
+		}
+		height = int64(*number)
+	}
+
+	snapshotService, err := snapshot.NewSnapshotService(edb, nil, "")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	snapshotService.SetEmptyHashes(config.EmptyCodeHash, config.EmptyRoot)
+	proof, err := snapshotService.Prove(uint64(height), common.HexToAddress(addr), slots)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if path := viper.GetString(snapshot.PROVE_OUTPUT_FILE_TOML); path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		defer file.Close()
+		out = file
+	}
+	if err = snapshot.WriteProof(out, proof, format); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("proved account %s and %d storage slots against state root %s at height %d",
+		proof.Address.Hex(), len(slots), proof.StateRoot.Hex(), height)
+}
+
+func init() {
+	rootCmd.AddCommand(proveCmd)
+
+	proveCmd.PersistentFlags().String(snapshot.LVL_DB_PATH_CLI, "", "path to primary datastore")
+	proveCmd.PersistentFlags().String(snapshot.ANCIENT_DB_PATH_CLI, "", "path to ancient datastore")
+	proveCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, -1, "block height to prove at (-1 for the head)")
+	proveCmd.PersistentFlags().String(snapshot.PROVE_ADDRESS_CLI, "", "address of the account to prove")
+	proveCmd.PersistentFlags().StringSlice(snapshot.PROVE_SLOTS_CLI, nil, "storage slots of the account to prove (hex)")
+	proveCmd.PersistentFlags().String(snapshot.PROVE_FORMAT_CLI, string(snapshot.ProofJSON), "output format ('json' or 'rlp')")
+	proveCmd.PersistentFlags().String(snapshot.PROVE_OUTPUT_FILE_CLI, "", "file to write to (default: stdout)")
+}
@@ -0,0 +1,110 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// publishHeaderCmd represents the publishHeader command
+var publishHeaderCmd = &cobra.Command{
+	Use:     "publishHeader",
+	Aliases: []string{"publish-header"},
+	Short:   "Re-publish only the header of an existing state snapshot",
+	Long: `Reads the canonical header at a height from leveldb and upserts its header_cids row,
+without walking the state trie. Used to repair the header of a snapshot whose state is already published.
+
+Usage
+
+./ipld-eth-state-snapshot publishHeader --config={path to toml config file} --block-height={height}`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.LVL_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.LVL_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.ANCIENT_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
+		viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		publishHeader()
+	},
+}
+
+func publishHeader() {
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	config, err := snapshot.NewConfig(mode)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	// the point is to replace the existing header row
+	config.DB.ConflictMode = snapt.ConflictUpsert
+	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if height < 0 {
+		logWithCommand.Fatal("a block height must be provided")
+	}
+	logWithCommand.Infof("opening levelDB and ancient data at %s and %s",
+		config.Eth.LevelDBPath, config.Eth.AncientDBPath)
+	edb, err := snapshot.NewLevelDB(config.Eth)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer edb.Close()
+
+	pub, err := snapshot.NewPublisher(mode, config)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	snapshotService, err := snapshot.NewSnapshotService(edb, pub, "")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	snapshotService.SetEmptyHashes(config.Eth.EmptyCodeHash, config.Eth.EmptyRoot)
+	header, err := snapshotService.PublishHeader(uint64(height))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+
+	// check that the existing state nodes are linked to the republished header
+	if counter, ok := pub.(snapt.StateNodeCounter); ok {
+		headerID := header.Hash().String()
+		count, err := counter.CountStateNodes(headerID)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		if count == 0 {
+			logWithCommand.Warnf("no state nodes reference header %s", headerID)
+		} else {
+			logWithCommand.Infof("%d state nodes reference header %s", count, headerID)
+		}
+	}
+	logWithCommand.Infof("header at height %d is published", height)
+}
+
+func init() {
+	rootCmd.AddCommand(publishHeaderCmd)
+
+	publishHeaderCmd.PersistentFlags().String(snapshot.LVL_DB_PATH_CLI, "", "path to primary datastore")
+	publishHeaderCmd.PersistentFlags().String(snapshot.ANCIENT_DB_PATH_CLI, "", "path to ancient datastore")
+	publishHeaderCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, -1, "block height of the header to publish")
+	publishHeaderCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode for the header ('file' or 'postgres')")
+	publishHeaderCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory for writing ouput to while operating in 'file' mode")
+}
@@ -0,0 +1,162 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+	"io"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+)
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Copy the blocks listed in a snapshot manifest into another blockstore",
+	Long: `Reads the state and storage nodes listed in a manifest written by stateSnapshot, fetches each node's block
+from a source database or IPFS node, checks it hashes to its CID, and publishes it with its state_cids or
+storage_cids row for a header to the configured output. Used to migrate a snapshot between backends.
+
+The header row is republished from leveldb at --block-height if --leveldb-path is set; otherwise the header
+is given by --header-id and its row must already exist in the target (e.g. written with publishHeader).
+
+Usage
+
+./ipld-eth-state-snapshot replay --config={path to toml config file} --manifest={manifest file} --source-db={postgres URI} --block-height={height}`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.LVL_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.LVL_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.ANCIENT_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
+		viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
+		viper.BindPFlag(snapshot.REPLAY_MANIFEST_TOML, cmd.PersistentFlags().Lookup(snapshot.REPLAY_MANIFEST_CLI))
+		viper.BindPFlag(snapshot.REPLAY_SOURCE_DB_TOML, cmd.PersistentFlags().Lookup(snapshot.REPLAY_SOURCE_DB_CLI))
+		viper.BindPFlag(snapshot.REPLAY_IPFS_API_TOML, cmd.PersistentFlags().Lookup(snapshot.REPLAY_IPFS_API_CLI))
+		viper.BindPFlag(snapshot.REPLAY_HEADER_ID_TOML, cmd.PersistentFlags().Lookup(snapshot.REPLAY_HEADER_ID_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		replay()
+	},
+}
+
+func replay() {
+	viper.BindEnv(snapshot.REPLAY_MANIFEST_TOML, snapshot.REPLAY_MANIFEST)
+	viper.BindEnv(snapshot.REPLAY_SOURCE_DB_TOML, snapshot.REPLAY_SOURCE_DB)
+	viper.BindEnv(snapshot.REPLAY_IPFS_API_TOML, snapshot.REPLAY_IPFS_API)
+	viper.BindEnv(snapshot.REPLAY_HEADER_ID_TOML, snapshot.REPLAY_HEADER_ID)
+
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	if mode == snapshot.KVSnapshot {
+		// the store keys storage nodes by their account's leaf key, which the manifest doesn't record
+		logWithCommand.Fatal("a manifest can't be replayed into a key-value store")
+	}
+	config, err := snapshot.NewConfig(mode)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	if config.Schema.StorageStateKeys {
+		logWithCommand.Warn("the manifest doesn't record the accounts' leaf keys, storage state keys are not written")
+		config.Schema.StorageStateKeys = false
+	}
+	manifest := viper.GetString(snapshot.REPLAY_MANIFEST_TOML)
+	if manifest == "" {
+		logWithCommand.Fatal("a manifest must be provided")
+	}
+
+	ctx := context.Background()
+	var src pg.BlockSource
+	if api := viper.GetString(snapshot.REPLAY_IPFS_API_TOML); api != "" {
+		logWithCommand.Infof("fetching blocks from IPFS node at %s", api)
+		src = pg.NewIPFSBlockSource(api)
+	} else if dsn := viper.GetString(snapshot.REPLAY_SOURCE_DB_TOML); dsn != "" {
+		conn, err := snapshot.ParseDSN(dsn, config.DB.ConnConfig)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		logWithCommand.Infof("fetching blocks from database %s:%d/%s", conn.Hostname, conn.Port, conn.DatabaseName)
+		driver, err := postgres.NewPGXDriver(ctx, conn, config.Eth.NodeInfo)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		db := postgres.NewPostgresDB(driver)
+		defer db.Close()
+		src = pg.NewDBBlockSource(db)
+	} else {
+		logWithCommand.Fatal("a source database or IPFS node must be provided")
+	}
+
+	pub, err := snapshot.NewPublisher(mode, config)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	if closer, ok := pub.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	headerID := viper.GetString(snapshot.REPLAY_HEADER_ID_TOML)
+	if config.Eth.LevelDBPath != "" {
+		height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+		if height < 0 {
+			logWithCommand.Fatal("a block height must be provided to publish the header")
+		}
+		edb, err := snapshot.NewLevelDB(config.Eth)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		defer edb.Close()
+		service, err := snapshot.NewSnapshotService(edb, pub, "")
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		service.SetEmptyHashes(config.Eth.EmptyCodeHash, config.Eth.EmptyRoot)
+		header, err := service.PublishHeader(uint64(height))
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		headerID = header.Hash().String()
+	} else if headerID == "" {
+		logWithCommand.Fatal("a header ID, or leveldb and a block height to read it from, must be provided")
+	}
+
+	stats, err := snapshot.ReplayManifest(ctx, manifest, src, pub, headerID)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("replayed %d state and %d storage nodes of header %s",
+		stats.StateNodes, stats.StorageNodes, headerID)
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.PersistentFlags().String(snapshot.LVL_DB_PATH_CLI, "", "path to primary datastore, to publish the header from (optional)")
+	replayCmd.PersistentFlags().String(snapshot.ANCIENT_DB_PATH_CLI, "", "path to ancient datastore")
+	replayCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, -1, "block height of the header to publish from leveldb")
+	replayCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode to replay into ('file' or 'postgres')")
+	replayCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory for writing ouput to while operating in 'file' mode")
+	replayCmd.PersistentFlags().String(snapshot.REPLAY_MANIFEST_CLI, "", "manifest of the nodes to replay")
+	replayCmd.PersistentFlags().String(snapshot.REPLAY_SOURCE_DB_CLI, "", "postgres URI of the database to copy blocks from")
+	replayCmd.PersistentFlags().String(snapshot.REPLAY_IPFS_API_CLI, "", "HTTP API of an IPFS node to copy blocks from, instead of a database")
+	replayCmd.PersistentFlags().String(snapshot.REPLAY_HEADER_ID_CLI, "", "hash of the header to link the rows to, if not published from leveldb")
+}
@@ -27,6 +27,9 @@ import (
 
 	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/prom"
 	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/sharded"
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
 )
 
 var (
@@ -66,6 +69,8 @@ func initFuncs(cmd *cobra.Command, args []string) {
 	if err := logLevel(); err != nil {
 		log.Fatal("Could not set log level: ", err)
 	}
+	viper.BindEnv(snapshot.LOG_MACHINE_TOML, snapshot.LOG_MACHINE)
+	snapt.SetMachineLogs(viper.GetBool(snapshot.LOG_MACHINE_TOML))
 
 	if viper.GetBool(snapshot.PROM_METRICS_TOML) {
 		log.Info("initializing prometheus metrics")
@@ -109,7 +114,14 @@ func init() {
 	rootCmd.PersistentFlags().String(snapshot.DATABASE_HOSTNAME_CLI, "localhost", "database hostname")
 	rootCmd.PersistentFlags().String(snapshot.DATABASE_USER_CLI, "", "database user")
 	rootCmd.PersistentFlags().String(snapshot.DATABASE_PASSWORD_CLI, "", "database password")
+	rootCmd.PersistentFlags().String(snapshot.DATABASE_CONFLICT_MODE_CLI, string(snapt.ConflictUpsert), "handling of rows which already exist ('upsert', 'skip' or 'strict')")
+	rootCmd.PersistentFlags().String(snapshot.DATABASE_BLOCK_COMPRESSION_CLI, string(pg.CodecNone), "codec to compress IPLD blocks with ('none' or 'snappy')")
+	rootCmd.PersistentFlags().String(snapshot.SNAPSHOT_NODE_ID_CLI, "", "node ID to write to the nodes and header_cids rows, overriding ethereum.nodeID")
+	rootCmd.PersistentFlags().StringSlice(snapshot.DATABASE_SHARDS_CLI, nil, "postgres:// URIs of databases to shard output across, instead of the single database")
+	rootCmd.PersistentFlags().String(snapshot.DATABASE_SHARD_FUNCTION_CLI, string(sharded.ShardByPrefix), "how nodes are assigned to shards ('prefix' or 'hash')")
+	rootCmd.PersistentFlags().String(snapshot.DATABASE_SHARD_HEADERS_CLI, string(sharded.HeadersToAll), "which shards the header is written to ('all' or 'meta')")
 	rootCmd.PersistentFlags().String(snapshot.LOGRUS_LEVEL_CLI, log.InfoLevel.String(), "log level (trace, debug, info, warn, error, fatal, panic)")
+	rootCmd.PersistentFlags().Bool(snapshot.LOG_MACHINE_CLI, false, "log progress counters and summaries as single lines of key=value pairs")
 
 	rootCmd.PersistentFlags().Bool(snapshot.PROM_METRICS_CLI, false, "enable prometheus metrics")
 	rootCmd.PersistentFlags().Bool(snapshot.PROM_HTTP_CLI, false, "enable prometheus http service")
@@ -123,7 +135,14 @@ func init() {
 	viper.BindPFlag(snapshot.DATABASE_HOSTNAME_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_HOSTNAME_CLI))
 	viper.BindPFlag(snapshot.DATABASE_USER_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_USER_CLI))
 	viper.BindPFlag(snapshot.DATABASE_PASSWORD_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_PASSWORD_CLI))
+	viper.BindPFlag(snapshot.DATABASE_CONFLICT_MODE_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_CONFLICT_MODE_CLI))
+	viper.BindPFlag(snapshot.DATABASE_BLOCK_COMPRESSION_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_BLOCK_COMPRESSION_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_NODE_ID_TOML, rootCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_NODE_ID_CLI))
+	viper.BindPFlag(snapshot.DATABASE_SHARDS_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_SHARDS_CLI))
+	viper.BindPFlag(snapshot.DATABASE_SHARD_FUNCTION_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_SHARD_FUNCTION_CLI))
+	viper.BindPFlag(snapshot.DATABASE_SHARD_HEADERS_TOML, rootCmd.PersistentFlags().Lookup(snapshot.DATABASE_SHARD_HEADERS_CLI))
 	viper.BindPFlag(snapshot.LOGRUS_LEVEL_TOML, rootCmd.PersistentFlags().Lookup(snapshot.LOGRUS_LEVEL_CLI))
+	viper.BindPFlag(snapshot.LOG_MACHINE_TOML, rootCmd.PersistentFlags().Lookup(snapshot.LOG_MACHINE_CLI))
 
 	viper.BindPFlag(snapshot.PROM_METRICS_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_METRICS_CLI))
 	viper.BindPFlag(snapshot.PROM_HTTP_TOML, rootCmd.PersistentFlags().Lookup(snapshot.PROM_HTTP_CLI))
@@ -16,7 +16,11 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -25,6 +29,10 @@ import (
 	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
 )
 
+// timeBudgetExitCode is the exit status of a snapshot stopped by its time budget, which can be resumed
+// from the recovery file
+const timeBudgetExitCode = 3
+
 // stateSnapshotCmd represents the stateSnapshot command
 var stateSnapshotCmd = &cobra.Command{
 	Use:   "stateSnapshot",
@@ -46,6 +54,9 @@ func stateSnapshot() {
 	if err != nil {
 		logWithCommand.Fatalf("unable to initialize config: %v", err)
 	}
+	if err := config.Validate(mode); err != nil {
+		logWithCommand.Fatalf("invalid config: %v", err)
+	}
 	logWithCommand.Infof("opening levelDB and ancient data at %s and %s",
 		config.Eth.LevelDBPath, config.Eth.AncientDBPath)
 	edb, err := snapshot.NewLevelDB(config.Eth)
@@ -59,46 +70,207 @@ func stateSnapshot() {
 		logWithCommand.Infof("no recovery file set, using default: %s", recoveryFile)
 	}
 
+	if err := snapshot.CheckSpace(mode, config); err != nil {
+		logWithCommand.Fatal(err)
+	}
+
 	pub, err := snapshot.NewPublisher(mode, config)
 	if err != nil {
 		logWithCommand.Fatal(err)
 	}
+	// the key-value store must be closed to be reopened by readers
+	if closer, ok := pub.(io.Closer); ok {
+		defer closer.Close()
+	}
 
 	snapshotService, err := snapshot.NewSnapshotService(edb, pub, recoveryFile)
 	if err != nil {
 		logWithCommand.Fatal(err)
 	}
-	workers := viper.GetUint(snapshot.SNAPSHOT_WORKERS_TOML)
-
-	if height < 0 {
-		if err := snapshotService.CreateLatestSnapshot(workers); err != nil {
+	snapshotService.SetEmptyHashes(config.Eth.EmptyCodeHash, config.Eth.EmptyRoot)
+	var workers uint
+	if workersStr := viper.GetString(snapshot.SNAPSHOT_WORKERS_TOML); workersStr == snapshot.AutoWorkers {
+		if workers, err = snapshot.AutotuneWorkers(mode, config); err != nil {
 			logWithCommand.Fatal(err)
 		}
-	} else {
-		params := snapshot.SnapshotParams{Workers: workers, Height: uint64(height)}
-		if err := snapshotService.CreateSnapshot(params); err != nil {
+	} else if workers, err = parseWorkers(workersStr); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	params, err := snapshotParams()
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	params.Workers = workers
+	if changedFile := viper.GetString(snapshot.SNAPSHOT_CHANGED_ACCOUNTS_TOML); changedFile != "" {
+		if params.ChangedAccounts, err = snapshot.ReadChangedAccounts(changedFile); err != nil {
 			logWithCommand.Fatal(err)
 		}
 	}
+	if height < 0 {
+		err = snapshotService.CreateLatestSnapshot(params)
+	} else {
+		params.Height = uint64(height)
+		err = snapshotService.CreateSnapshot(params)
+	}
+	if errors.Is(err, snapshot.ErrTimeBudgetReached) {
+		logWithCommand.Warnf("time budget reached, the snapshot can be resumed from recovery file %s", recoveryFile)
+		if closer, ok := pub.(io.Closer); ok {
+			closer.Close()
+		}
+		os.Exit(timeBudgetExitCode)
+	}
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
 	logWithCommand.Infof("state snapshot at height %d is complete", height)
 }
 
+// parseWorkers parses an explicit worker count, which must be a power of two for the state trie to be split
+// between the workers
+func parseWorkers(workersStr string) (uint, error) {
+	n, err := strconv.ParseUint(workersStr, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("invalid worker count: %s", workersStr)
+	}
+	if err = snapshot.CheckSplitCount("worker count", uint(n)); err != nil {
+		return 0, err
+	}
+	return uint(n), nil
+}
+
+// snapshotParams parses the snapshot options other than the worker count and changed accounts, which
+// are read by the run
+func snapshotParams() (snapshot.SnapshotParams, error) {
+	params := snapshot.SnapshotParams{
+		MaxMemory:        viper.GetUint64(snapshot.SNAPSHOT_MAX_MEMORY_TOML) * 1024 * 1024,
+		DecodedOutputDir: viper.GetString(snapshot.SNAPSHOT_DECODED_OUTPUT_DIR_TOML),
+
+		StorageSubtrieSplit:   viper.GetUint(snapshot.SNAPSHOT_STORAGE_SUBTRIE_SPLIT_TOML),
+		StorageSplitThreshold: viper.GetUint(snapshot.SNAPSHOT_STORAGE_SPLIT_THRESHOLD_TOML),
+		AutoRestart:           viper.GetUint(snapshot.SNAPSHOT_AUTO_RESTART_TOML),
+		Preimages:             viper.GetBool(snapshot.SNAPSHOT_PREIMAGES_TOML),
+		CommitPerAccount:      viper.GetBool(snapshot.SNAPSHOT_COMMIT_PER_ACCOUNT_TOML),
+		MaxBatchAge:           viper.GetDuration(snapshot.SNAPSHOT_MAX_BATCH_AGE_TOML),
+		RecoveryPerWorker:     viper.GetBool(snapshot.SNAPSHOT_RECOVERY_PER_WORKER_TOML),
+		FailOnEmptyRange:      viper.GetBool(snapshot.SNAPSHOT_FAIL_ON_EMPTY_RANGE_TOML),
+		DetectDuplicates:      viper.GetBool(snapshot.SNAPSHOT_DETECT_DUPLICATES_TOML),
+		WebhookURL:            viper.GetString(snapshot.SNAPSHOT_WEBHOOK_URL_TOML),
+		TimeBudget:            viper.GetDuration(snapshot.SNAPSHOT_TIME_BUDGET_TOML),
+		StorageRootCache:      viper.GetUint(snapshot.SNAPSHOT_STORAGE_ROOT_CACHE_TOML),
+	}
+	var err error
+	if err = snapshot.CheckSplitCount("storage subtrie split", params.StorageSubtrieSplit); err != nil {
+		return params, err
+	}
+	if params.CodeDedup, err = snapshot.ParseCodeDedupMode(viper.GetString(snapshot.SNAPSHOT_CODE_DEDUP_TOML)); err != nil {
+		return params, err
+	}
+	if params.StorageOrder, err = snapshot.ParseStorageOrder(viper.GetString(snapshot.SNAPSHOT_STORAGE_ORDER_TOML)); err != nil {
+		return params, err
+	}
+	if params.WebhookEvents, err = snapshot.ParseWebhookEvents(viper.GetStringSlice(snapshot.SNAPSHOT_WEBHOOK_EVENTS_TOML)); err != nil {
+		return params, err
+	}
+	for _, account := range viper.GetStringSlice(snapshot.SNAPSHOT_SHARDED_STORAGE_TOML) {
+		key, err := snapshot.ParseAccountKey(account)
+		if err != nil {
+			return params, fmt.Errorf("invalid sharded storage account: %w", err)
+		}
+		params.ShardedStorage = append(params.ShardedStorage, key)
+	}
+	return params, nil
+}
+
 func init() {
 	rootCmd.AddCommand(stateSnapshotCmd)
 
 	stateSnapshotCmd.PersistentFlags().String(snapshot.LVL_DB_PATH_CLI, "", "path to primary datastore")
 	stateSnapshotCmd.PersistentFlags().String(snapshot.ANCIENT_DB_PATH_CLI, "", "path to ancient datastore")
+	stateSnapshotCmd.PersistentFlags().Int(snapshot.ANCIENT_DB_CACHE_SIZE_CLI, 0, "number of ancient datastore items to cache (0 to disable)")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.ETH_EMPTY_CODE_HASH_CLI, "", "hash of empty code, if it differs from Ethereum's")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.ETH_EMPTY_ROOT_CLI, "", "root hash of the empty trie, if it differs from Ethereum's")
 	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, "", "block height to extract state at")
-	stateSnapshotCmd.PersistentFlags().Int(snapshot.SNAPSHOT_WORKERS_CLI, 1, "number of concurrent workers to use")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_WORKERS_CLI, "1", "number of concurrent workers to use, a power of two, or 'auto' to estimate it from the CPUs and database latency")
 	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_RECOVERY_FILE_CLI, "", "file to recover from a previous iteration")
-	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode for snapshot ('file' or 'postgres')")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode for snapshot ('file', 'postgres', 'kv' or 'clickhouse')")
 	stateSnapshotCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory for writing ouput to while operating in 'file' mode")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.KV_OUTPUT_DIR_CLI, "", "directory of the key-value store to write to while operating in 'kv' mode")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.CLICKHOUSE_OUTPUT_DIR_CLI, "", "directory to write JSONEachRow files to while operating in 'clickhouse' mode")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.CLICKHOUSE_URL_CLI, "", "ClickHouse HTTP interface to insert rows through while operating in 'clickhouse' mode")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.CLICKHOUSE_DATABASE_CLI, "", "ClickHouse database of the tables (default: eth)")
+	stateSnapshotCmd.PersistentFlags().Uint(snapshot.CLICKHOUSE_BATCH_ROWS_CLI, 0, "number of rows each worker buffers before inserting them into ClickHouse (0 for the default)")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_MANIFEST_FILE_CLI, "", "file to record the published nodes to")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_PRIOR_MANIFEST_CLI, "", "manifest of a prior snapshot whose blocks are already published")
+	stateSnapshotCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_SINCE_SNAPSHOT_CLI, -1, "height of a snapshot in the target database to share unchanged blocks with (postgres mode)")
+	stateSnapshotCmd.PersistentFlags().Uint64(snapshot.SNAPSHOT_MAX_MEMORY_CLI, 0, "soft cap on heap usage in MiB, throttling workers when exceeded (0 for no cap)")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_DECODED_OUTPUT_DIR_CLI, "", "directory to also write decoded accounts and storage slots to as JSON")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_STATS_FILE_CLI, "", "file to periodically write the current stats to as JSON")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_STORAGE_ORDER_CLI, string(snapshot.StorageInterleaved), "ordering of state leaves and their storage: 'interleaved' or 'after-leaf' (leaf committed first)")
+	stateSnapshotCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_STORAGE_SUBTRIE_SPLIT_CLI, 0, "number of concurrent walkers to split large storage tries between, a power of two (0 to walk them serially)")
+	stateSnapshotCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_STORAGE_SPLIT_THRESHOLD_CLI, snapshot.DefaultStorageSplitThreshold, "number of nodes in the top three levels of a storage trie at which its walk is split")
+	stateSnapshotCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_STORAGE_ROOT_CACHE_CLI, 0, "number of storage trie nodes to cache by root, so accounts sharing a storage root aren't walked again (0 for no cache)")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_CODE_DEDUP_CLI, "none", "how to skip code already published: 'none', 'global' (shared cache) or 'local' (per-worker cache)")
+	stateSnapshotCmd.PersistentFlags().Uint(snapshot.SNAPSHOT_AUTO_RESTART_CLI, 0, "number of times to resume from the recovery file after a non-fatal error")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_CHANGED_ACCOUNTS_CLI, "", "file listing the changed accounts to publish, instead of the whole state")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_PREIMAGES_CLI, false, "publish the preimages of leaf keys (addresses and slots) recorded in the database")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_COMMIT_PER_ACCOUNT_CLI, false, "commit the batch after the storage of each account")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_RECOVERY_PER_WORKER_CLI, false, "write a recovery file per worker, suffixed .w<n>, rather than a single file")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_FAIL_ON_EMPTY_RANGE_CLI, false, "fail if the split of the state trie leaves a worker no nodes, rather than warning")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_DETECT_DUPLICATES_CLI, false, "count and log nodes published more than once, at the cost of memory")
+	stateSnapshotCmd.PersistentFlags().StringSlice(snapshot.SNAPSHOT_SHARDED_STORAGE_CLI, nil, "accounts whose storage is published by storageShard runs, and is skipped")
+	stateSnapshotCmd.PersistentFlags().String(snapshot.SNAPSHOT_WEBHOOK_URL_CLI, "", "URL to POST snapshot events to as JSON")
+	stateSnapshotCmd.PersistentFlags().StringSlice(snapshot.SNAPSHOT_WEBHOOK_EVENTS_CLI, nil, "webhook events to post ('start', 'complete', 'failure'; default: all)")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.DATABASE_REQUIRE_SPACE_CLI, false, "fail if the database lacks space for the snapshot, rather than warning")
+	stateSnapshotCmd.PersistentFlags().Float64(snapshot.DATABASE_SPACE_MARGIN_CLI, snapshot.DefaultSpaceMargin, "headroom required over the estimated snapshot size, as a fraction of it")
+	stateSnapshotCmd.PersistentFlags().Uint64(snapshot.DATABASE_MAX_SIZE_CLI, 0, "space available to the database in MB, for the space check (0 if unknown)")
+	stateSnapshotCmd.PersistentFlags().Uint64(snapshot.DATABASE_EXPECTED_SIZE_CLI, 0, "expected size of the snapshot in MB, for the space check (0 to estimate it from the database)")
+	stateSnapshotCmd.PersistentFlags().Duration(snapshot.SNAPSHOT_MAX_BATCH_AGE_CLI, 0, "maximum time a batch is left uncommitted, whatever its size (e.g. 30s; 0 to commit by size only)")
+	stateSnapshotCmd.PersistentFlags().Duration(snapshot.SNAPSHOT_TIME_BUDGET_CLI, 0, "wall-clock time after which the snapshot is stopped and the recovery file written, exiting with status 3 (e.g. 6h; 0 for no limit)")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_STORAGE_STATE_KEYS_CLI, false, "also record the leaf key of the owning account on storage rows (state_leaf_key)")
+	stateSnapshotCmd.PersistentFlags().Bool(snapshot.SNAPSHOT_NODE_TYPE_NAMES_CLI, false, "also record the name of the node type on node rows (node_type_name)")
 
 	viper.BindPFlag(snapshot.LVL_DB_PATH_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.LVL_DB_PATH_CLI))
 	viper.BindPFlag(snapshot.ANCIENT_DB_PATH_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_PATH_CLI))
+	viper.BindPFlag(snapshot.ANCIENT_DB_CACHE_SIZE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_CACHE_SIZE_CLI))
+	viper.BindPFlag(snapshot.ETH_EMPTY_CODE_HASH_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.ETH_EMPTY_CODE_HASH_CLI))
+	viper.BindPFlag(snapshot.ETH_EMPTY_ROOT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.ETH_EMPTY_ROOT_CLI))
 	viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
 	viper.BindPFlag(snapshot.SNAPSHOT_WORKERS_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_WORKERS_CLI))
 	viper.BindPFlag(snapshot.SNAPSHOT_RECOVERY_FILE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_RECOVERY_FILE_CLI))
 	viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
 	viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
+	viper.BindPFlag(snapshot.KV_OUTPUT_DIR_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.KV_OUTPUT_DIR_CLI))
+	viper.BindPFlag(snapshot.CLICKHOUSE_OUTPUT_DIR_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.CLICKHOUSE_OUTPUT_DIR_CLI))
+	viper.BindPFlag(snapshot.CLICKHOUSE_URL_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.CLICKHOUSE_URL_CLI))
+	viper.BindPFlag(snapshot.CLICKHOUSE_DATABASE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.CLICKHOUSE_DATABASE_CLI))
+	viper.BindPFlag(snapshot.CLICKHOUSE_BATCH_ROWS_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.CLICKHOUSE_BATCH_ROWS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_MANIFEST_FILE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MANIFEST_FILE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_PRIOR_MANIFEST_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_PRIOR_MANIFEST_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_SINCE_SNAPSHOT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_SINCE_SNAPSHOT_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_MAX_MEMORY_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MAX_MEMORY_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_DECODED_OUTPUT_DIR_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_DECODED_OUTPUT_DIR_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_STATS_FILE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STATS_FILE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_STORAGE_ORDER_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STORAGE_ORDER_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_STORAGE_SUBTRIE_SPLIT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STORAGE_SUBTRIE_SPLIT_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_STORAGE_SPLIT_THRESHOLD_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STORAGE_SPLIT_THRESHOLD_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_STORAGE_ROOT_CACHE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STORAGE_ROOT_CACHE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_CODE_DEDUP_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_CODE_DEDUP_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_AUTO_RESTART_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_AUTO_RESTART_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_CHANGED_ACCOUNTS_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_CHANGED_ACCOUNTS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_PREIMAGES_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_PREIMAGES_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_COMMIT_PER_ACCOUNT_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_COMMIT_PER_ACCOUNT_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_MAX_BATCH_AGE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MAX_BATCH_AGE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_TIME_BUDGET_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_TIME_BUDGET_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_FAIL_ON_EMPTY_RANGE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_FAIL_ON_EMPTY_RANGE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_DETECT_DUPLICATES_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_DETECT_DUPLICATES_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_SHARDED_STORAGE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_SHARDED_STORAGE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_WEBHOOK_URL_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_WEBHOOK_URL_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_WEBHOOK_EVENTS_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_WEBHOOK_EVENTS_CLI))
+	viper.BindPFlag(snapshot.DATABASE_REQUIRE_SPACE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.DATABASE_REQUIRE_SPACE_CLI))
+	viper.BindPFlag(snapshot.DATABASE_SPACE_MARGIN_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.DATABASE_SPACE_MARGIN_CLI))
+	viper.BindPFlag(snapshot.DATABASE_MAX_SIZE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.DATABASE_MAX_SIZE_CLI))
+	viper.BindPFlag(snapshot.DATABASE_EXPECTED_SIZE_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.DATABASE_EXPECTED_SIZE_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_RECOVERY_PER_WORKER_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_RECOVERY_PER_WORKER_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_STORAGE_STATE_KEYS_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_STORAGE_STATE_KEYS_CLI))
+	viper.BindPFlag(snapshot.SNAPSHOT_NODE_TYPE_NAMES_TOML, stateSnapshotCmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_NODE_TYPE_NAMES_CLI))
 }
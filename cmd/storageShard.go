@@ -0,0 +1,125 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"io"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// storageShardCmd represents the storageShard command
+var storageShardCmd = &cobra.Command{
+	Use:     "storageShard",
+	Aliases: []string{"storage-shard"},
+	Short:   "Publish the part of a contract's storage trie under some path prefixes",
+	Long: `Walks only the nodes of an account's storage trie under the given path prefixes, and those above them,
+and publishes them with the header and the state nodes on the path to the account. Running it on several hosts
+with disjoint prefixes which together cover the trie splits the storage of one large contract between them.
+The stateSnapshot run can skip the account's storage with --sharded-storage.
+
+Prefixes are hex nibbles, e.g. "3" or "3a"; see the README for choosing them.
+
+Usage
+
+./ipld-eth-state-snapshot storageShard --config={path to toml config file} --block-height={height} --account={address or account hash} --prefixes={prefix,...}`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.LVL_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.LVL_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.ANCIENT_DB_PATH_TOML, cmd.PersistentFlags().Lookup(snapshot.ANCIENT_DB_PATH_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
+		viper.BindPFlag(snapshot.FILE_OUTPUT_DIR_TOML, cmd.PersistentFlags().Lookup(snapshot.FILE_OUTPUT_DIR_CLI))
+		viper.BindPFlag(snapshot.STORAGE_SHARD_ACCOUNT_TOML, cmd.PersistentFlags().Lookup(snapshot.STORAGE_SHARD_ACCOUNT_CLI))
+		viper.BindPFlag(snapshot.STORAGE_SHARD_PREFIXES_TOML, cmd.PersistentFlags().Lookup(snapshot.STORAGE_SHARD_PREFIXES_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		storageShard()
+	},
+}
+
+func storageShard() {
+	viper.BindEnv(snapshot.STORAGE_SHARD_ACCOUNT_TOML, snapshot.STORAGE_SHARD_ACCOUNT)
+	viper.BindEnv(snapshot.STORAGE_SHARD_PREFIXES_TOML, snapshot.STORAGE_SHARD_PREFIXES)
+
+	account, err := snapshot.ParseAccountKey(viper.GetString(snapshot.STORAGE_SHARD_ACCOUNT_TOML))
+	if err != nil {
+		logWithCommand.Fatalf("invalid account: %v", err)
+	}
+	var prefixes [][]byte
+	for _, str := range viper.GetStringSlice(snapshot.STORAGE_SHARD_PREFIXES_TOML) {
+		for _, s := range strings.Split(str, ",") {
+			prefix, err := snapshot.ParseStoragePrefix(strings.TrimSpace(s))
+			if err != nil {
+				logWithCommand.Fatal(err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		logWithCommand.Fatal("no storage prefixes to publish")
+	}
+	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if height < 0 {
+		logWithCommand.Fatal("a block height must be provided")
+	}
+
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	config, err := snapshot.NewConfig(mode)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	edb, err := snapshot.NewLevelDB(config.Eth)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer edb.Close()
+	pub, err := snapshot.NewPublisher(mode, config)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	if closer, ok := pub.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	service, err := snapshot.NewSnapshotService(edb, pub, "")
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	service.SetEmptyHashes(config.Eth.EmptyCodeHash, config.Eth.EmptyRoot)
+	if err := service.CreateStorageShard(uint64(height), account, prefixes); err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("storage shard of account %s at height %d is complete", account.Hex(), height)
+}
+
+func init() {
+	rootCmd.AddCommand(storageShardCmd)
+
+	storageShardCmd.PersistentFlags().String(snapshot.LVL_DB_PATH_CLI, "", "path to primary datastore")
+	storageShardCmd.PersistentFlags().String(snapshot.ANCIENT_DB_PATH_CLI, "", "path to ancient datastore")
+	storageShardCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, -1, "block height to publish the storage at")
+	storageShardCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode ('file' or 'postgres')")
+	storageShardCmd.PersistentFlags().String(snapshot.FILE_OUTPUT_DIR_CLI, "", "directory for writing ouput to while operating in 'file' mode")
+	storageShardCmd.PersistentFlags().String(snapshot.STORAGE_SHARD_ACCOUNT_CLI, "", "address or account hash (state trie key) of the account")
+	storageShardCmd.PersistentFlags().StringSlice(snapshot.STORAGE_SHARD_PREFIXES_CLI, nil, "storage trie path prefixes to publish, as hex nibbles")
+}
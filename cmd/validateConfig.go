@@ -0,0 +1,100 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+)
+
+// validateConfigCmd represents the validateConfig command
+var validateConfigCmd = &cobra.Command{
+	Use:     "validateConfig",
+	Aliases: []string{"validate-config"},
+	Short:   "Check the config of a stateSnapshot run without running it",
+	Long: `Loads the config as stateSnapshot would, and checks it and the requirements of the output mode,
+reporting every problem found. It exits non-zero if there are any. Nothing is opened or connected to, so
+problems which only show at runtime, such as an unreachable database, are not caught.
+
+Usage
+
+./ipld-eth-state-snapshot validateConfig --config={path to toml config file}`,
+	// skip the log file and prometheus server set up by the root command
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := logLevel(); err != nil {
+			logrus.Fatal("Could not set log level: ", err)
+		}
+	},
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.SNAPSHOT_MODE_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_MODE_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		validateConfig()
+	},
+}
+
+func validateConfig() {
+	problems := validateSnapshotConfig()
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			logWithCommand.Error(problem)
+		}
+		logWithCommand.Fatalf("config is invalid: %d problems found", len(problems))
+	}
+	logWithCommand.Info("config is valid")
+}
+
+// validateSnapshotConfig returns the problems with the config of a stateSnapshot run
+func validateSnapshotConfig() []string {
+	var problems []string
+	mode := snapshot.SnapshotMode(viper.GetString(snapshot.SNAPSHOT_MODE_TOML))
+	config, err := snapshot.NewConfig(mode)
+	if err != nil {
+		// Init stops at the first problem, so the rest of the config can't be checked
+		return append(problems, fmt.Sprintf("unable to initialize config: %v", err))
+	}
+	if err := config.Validate(mode); err != nil {
+		var errs snapshot.ConfigErrors
+		if !errors.As(err, &errs) {
+			return append(problems, err.Error())
+		}
+		problems = append(problems, errs...)
+	}
+
+	if workersStr := viper.GetString(snapshot.SNAPSHOT_WORKERS_TOML); workersStr != "" && workersStr != snapshot.AutoWorkers {
+		if _, err := parseWorkers(workersStr); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if _, err := snapshotParams(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+func init() {
+	rootCmd.AddCommand(validateConfigCmd)
+
+	validateConfigCmd.PersistentFlags().String(snapshot.SNAPSHOT_MODE_CLI, "postgres", "output mode to check the config for ('file', 'postgres', 'kv' or 'clickhouse')")
+}
@@ -0,0 +1,119 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+)
+
+// verifyIPLDCmd represents the verifyIPLD command
+var verifyIPLDCmd = &cobra.Command{
+	Use:     "verifyIPLD",
+	Aliases: []string{"verify-ipld"},
+	Short:   "Verify the IPLD blocks of a published snapshot are retrievable by CID",
+	Long: `Reads the header, state and storage rows published for the headers at a height, fetches the block
+each row's CID refers to from the database blocks table or an IPFS node, and checks the block hashes to the CID.
+Rows whose blocks can't be found (dangling rows) or don't match their CID are reported.
+
+Usage
+
+./ipld-eth-state-snapshot verifyIPLD --config={path to toml config file} --block-height={height} [--sample={rows}] [--ipfs-api={url}]`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML, cmd.PersistentFlags().Lookup(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI))
+		viper.BindPFlag(snapshot.VERIFY_SAMPLE_TOML, cmd.PersistentFlags().Lookup(snapshot.VERIFY_SAMPLE_CLI))
+		viper.BindPFlag(snapshot.VERIFY_IPFS_API_TOML, cmd.PersistentFlags().Lookup(snapshot.VERIFY_IPFS_API_CLI))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = *logrus.WithField("SubCommand", subCommand)
+		verifyIPLD()
+	},
+}
+
+func verifyIPLD() {
+	viper.BindEnv(snapshot.VERIFY_SAMPLE_TOML, snapshot.VERIFY_SAMPLE)
+	viper.BindEnv(snapshot.VERIFY_IPFS_API_TOML, snapshot.VERIFY_IPFS_API)
+
+	config, err := snapshot.NewConfig(snapshot.PgSnapshot)
+	if err != nil {
+		logWithCommand.Fatalf("unable to initialize config: %v", err)
+	}
+	height := viper.GetInt64(snapshot.SNAPSHOT_BLOCK_HEIGHT_TOML)
+	if height < 0 {
+		logWithCommand.Fatal("a block height must be provided")
+	}
+	sample := viper.GetInt(snapshot.VERIFY_SAMPLE_TOML)
+
+	ctx := context.Background()
+	driver, err := postgres.NewPGXDriver(ctx, config.DB.ConnConfig, config.Eth.NodeInfo)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	db := postgres.NewPostgresDB(driver)
+	defer db.Close()
+
+	var src pg.BlockSource
+	if api := viper.GetString(snapshot.VERIFY_IPFS_API_TOML); api != "" {
+		logWithCommand.Infof("fetching blocks from IPFS node at %s", api)
+		src = pg.NewIPFSBlockSource(api)
+	} else {
+		src = pg.NewDBBlockSource(db)
+	}
+
+	headerIDs, err := pg.HeaderIDsAt(ctx, db, uint64(height))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	if len(headerIDs) == 0 {
+		logWithCommand.Fatalf("no header is indexed at height %d", height)
+	}
+	ok := true
+	for _, headerID := range headerIDs {
+		res, err := pg.VerifyIPLD(ctx, db, src, headerID, sample)
+		if err != nil {
+			logWithCommand.Fatal(err)
+		}
+		for _, c := range res.Dangling {
+			logWithCommand.Errorf("dangling row for header %s: no block for CID %s", headerID, c)
+		}
+		for _, c := range res.Corrupt {
+			logWithCommand.Errorf("block for CID %s (header %s) does not match its CID", c, headerID)
+		}
+		logWithCommand.Infof("checked %d rows of header %s: %d dangling, %d corrupt",
+			res.Checked, headerID, len(res.Dangling), len(res.Corrupt))
+		ok = ok && res.OK()
+	}
+	if !ok {
+		logWithCommand.Fatal("IPLD verification failed")
+	}
+	logWithCommand.Infof("IPLD blocks at height %d are verified", height)
+}
+
+func init() {
+	rootCmd.AddCommand(verifyIPLDCmd)
+
+	verifyIPLDCmd.PersistentFlags().Int64(snapshot.SNAPSHOT_BLOCK_HEIGHT_CLI, -1, "block height of the snapshot to verify")
+	verifyIPLDCmd.PersistentFlags().Int(snapshot.VERIFY_SAMPLE_CLI, 0, "number of randomly sampled rows to check per header; 0 checks all rows")
+	verifyIPLDCmd.PersistentFlags().String(snapshot.VERIFY_IPFS_API_CLI, "", "HTTP API of an IPFS node to fetch blocks from, instead of the database blocks table")
+}
@@ -0,0 +1,8 @@
+-- +goose Up
+CREATE TABLE eth.key_preimages (
+  key                   VARCHAR(66) PRIMARY KEY,
+  preimage              BYTEA NOT NULL
+);
+
+-- +goose Down
+DROP TABLE eth.key_preimages;
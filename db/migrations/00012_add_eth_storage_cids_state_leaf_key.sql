@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE eth.storage_cids ADD COLUMN state_leaf_key VARCHAR(66);
+CREATE INDEX storage_state_leaf_key_index ON eth.storage_cids USING btree (state_leaf_key);
+
+-- +goose Down
+DROP INDEX eth.storage_state_leaf_key_index;
+ALTER TABLE eth.storage_cids DROP COLUMN state_leaf_key;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE public.blocks ADD COLUMN codec TEXT;
+
+-- +goose Down
+ALTER TABLE public.blocks DROP COLUMN codec;
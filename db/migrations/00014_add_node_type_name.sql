@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE eth.state_cids ADD COLUMN node_type_name TEXT;
+ALTER TABLE eth.storage_cids ADD COLUMN node_type_name TEXT;
+
+-- +goose Down
+ALTER TABLE eth.storage_cids DROP COLUMN node_type_name;
+ALTER TABLE eth.state_cids DROP COLUMN node_type_name;
@@ -34,6 +34,13 @@ var (
 	stateNodeCount   prometheus.Counter
 	storageNodeCount prometheus.Counter
 	codeNodeCount    prometheus.Counter
+
+	skippedBlockCount  prometheus.Counter
+	duplicateCodeCount prometheus.Counter
+	duplicateNodeCount prometheus.Counter
+
+	preimageFoundCount   prometheus.Counter
+	preimageMissingCount prometheus.Counter
 )
 
 func Init() {
@@ -59,6 +66,41 @@ func Init() {
 		Name:      "code_node_count",
 		Help:      "Number of code nodes processed",
 	})
+
+	skippedBlockCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "skipped_block_count",
+		Help:      "Number of IPLD blocks not written because they are in the prior manifest",
+	})
+
+	duplicateCodeCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "duplicate_code_count",
+		Help:      "Number of code entries published by more than one worker with worker-local code dedup",
+	})
+
+	duplicateNodeCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "duplicate_node_count",
+		Help:      "Number of trie nodes published more than once for a header, with duplicate detection",
+	})
+
+	preimageFoundCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "preimage_found_count",
+		Help:      "Number of leaf key preimages found",
+	})
+
+	preimageMissingCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      "preimage_missing_count",
+		Help:      "Number of leaf key preimages not recorded in the database",
+	})
 }
 
 // RegisterDBCollector create metric collector for given connection
@@ -88,3 +130,38 @@ func IncCodeNodeCount() {
 		codeNodeCount.Inc()
 	}
 }
+
+// IncSkippedBlockCount increments the number of IPLD blocks skipped as already published
+func IncSkippedBlockCount() {
+	if metrics {
+		skippedBlockCount.Inc()
+	}
+}
+
+// AddDuplicateCodeCount adds to the number of code entries published by more than one worker
+func AddDuplicateCodeCount(n uint64) {
+	if metrics {
+		duplicateCodeCount.Add(float64(n))
+	}
+}
+
+// IncDuplicateNodeCount increments the number of trie nodes published more than once
+func IncDuplicateNodeCount() {
+	if metrics {
+		duplicateNodeCount.Inc()
+	}
+}
+
+// IncPreimageFoundCount increments the number of leaf key preimages found
+func IncPreimageFoundCount() {
+	if metrics {
+		preimageFoundCount.Inc()
+	}
+}
+
+// IncPreimageMissingCount increments the number of leaf key preimages not found
+func IncPreimageMissingCount() {
+	if metrics {
+		preimageMissingCount.Inc()
+	}
+}
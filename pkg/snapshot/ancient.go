@@ -0,0 +1,59 @@
+package snapshot
+
+import (
+	"github.com/ethereum/go-ethereum/ethdb"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+type ancientKey struct {
+	kind   string
+	number uint64
+}
+
+// cachedAncientDB wraps a database with a read-through cache for freezer items, so that lookups on
+// a freezer on slow (e.g. network) storage are not repeated
+type cachedAncientDB struct {
+	ethdb.Database
+	cache *lru.Cache
+}
+
+// cachedAncientReader applies the cache within ReadAncients operations
+type cachedAncientReader struct {
+	ethdb.AncientReaderOp
+	cache *lru.Cache
+}
+
+func newCachedAncientDB(db ethdb.Database, size int) (*cachedAncientDB, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedAncientDB{db, cache}, nil
+}
+
+func (db *cachedAncientDB) Ancient(kind string, number uint64) ([]byte, error) {
+	return cachedAncient(db.Database, db.cache, kind, number)
+}
+
+func (db *cachedAncientDB) ReadAncients(fn func(ethdb.AncientReaderOp) error) error {
+	return db.Database.ReadAncients(func(op ethdb.AncientReaderOp) error {
+		return fn(&cachedAncientReader{op, db.cache})
+	})
+}
+
+func (r *cachedAncientReader) Ancient(kind string, number uint64) ([]byte, error) {
+	return cachedAncient(r.AncientReaderOp, r.cache, kind, number)
+}
+
+func cachedAncient(db ethdb.AncientReaderOp, cache *lru.Cache, kind string, number uint64) ([]byte, error) {
+	key := ancientKey{kind, number}
+	if data, ok := cache.Get(key); ok {
+		return data.([]byte), nil
+	}
+	data, err := db.Ancient(kind, number)
+	if err != nil {
+		return nil, err
+	}
+	cache.Add(key, data)
+	return data, nil
+}
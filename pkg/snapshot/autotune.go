@@ -0,0 +1,84 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+)
+
+// AutoWorkers is the workers setting which picks the worker count with AutotuneWorkers
+const AutoWorkers = "auto"
+
+const (
+	// write latency above which a database is treated as remote, and more workers are used to overlap round trips
+	remoteDBLatency = 2 * time.Millisecond
+	// upper bound on the estimated worker count
+	maxAutoWorkers = 64
+	// connections left for the header and other queries outside the workers
+	reservedConns = 1
+)
+
+// EstimateWorkers picks a worker count from the number of CPUs, the write latency of the database
+// (0 if there is none) and its connection limit (0 if unlimited), returning it with the rationale.
+// The count is a power of two, as the state trie is split between the workers.
+func EstimateWorkers(cpus int, latency time.Duration, maxConns int) (uint, string) {
+	workers := cpus
+	reason := fmt.Sprintf("one worker per CPU (%d)", cpus)
+	if latency > remoteDBLatency {
+		workers = cpus * 2
+		reason = fmt.Sprintf("two workers per CPU (%d), as the database write latency (%s) is over %s",
+			cpus, latency, remoteDBLatency)
+	}
+	if workers > maxAutoWorkers {
+		workers = maxAutoWorkers
+		reason += fmt.Sprintf(", capped at %d", maxAutoWorkers)
+	}
+	// each worker holds a connection for its transaction
+	if maxConns > 0 && workers > maxConns-reservedConns {
+		workers = maxConns - reservedConns
+		reason += fmt.Sprintf(", capped to fit the database connection limit (%d)", maxConns)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	// the state trie can only be split between a power of two workers
+	if rounded := floorPowerOfTwo(uint(workers)); rounded != uint(workers) {
+		reason += fmt.Sprintf(", rounded down from %d to a power of two", workers)
+		workers = int(rounded)
+	}
+	return uint(workers), reason
+}
+
+// AutotuneWorkers estimates the worker count for a snapshot, probing the write latency of the database
+// in postgres mode
+func AutotuneWorkers(mode SnapshotMode, config *Config) (uint, error) {
+	var latency time.Duration
+	var maxConns int
+	if mode == PgSnapshot {
+		conn := config.DB.ConnConfig
+		if len(config.DB.Shards) > 0 {
+			// the shards are written concurrently, so the first is taken as representative
+			conn = config.DB.Shards[0]
+		}
+		ctx := context.Background()
+		driver, err := postgres.NewPGXDriver(ctx, conn, config.Eth.NodeInfo)
+		if err != nil {
+			return 0, err
+		}
+		db := postgres.NewPostgresDB(driver)
+		defer db.Close()
+		if latency, err = pg.ProbeWriteLatency(ctx, db, 5); err != nil {
+			return 0, fmt.Errorf("failed to probe database latency: %w", err)
+		}
+		maxConns = conn.MaxConns
+	}
+	workers, reason := EstimateWorkers(runtime.NumCPU(), latency, maxConns)
+	log.Infof("using %d workers: %s", workers, reason)
+	return workers, nil
+}
@@ -0,0 +1,68 @@
+package snapshot
+
+import (
+	"sync/atomic"
+	"time"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// batchWatchdog bounds how long published rows stay uncommitted. Each interval of the max batch age,
+// it advances a generation, and a worker which sees a generation it has not committed in commits its
+// batch, whether or not the batch has reached the size threshold. Rows are therefore committed within
+// about twice the max age of being published, as long as the worker keeps publishing.
+// A nil *batchWatchdog never requests a commit.
+type batchWatchdog struct {
+	generation uint64
+	quit       chan struct{}
+}
+
+func newBatchWatchdog(maxAge time.Duration) *batchWatchdog {
+	if maxAge <= 0 {
+		return nil
+	}
+	w := &batchWatchdog{quit: make(chan struct{})}
+	go w.watch(maxAge)
+	return w
+}
+
+func (w *batchWatchdog) watch(maxAge time.Duration) {
+	t := time.NewTicker(maxAge)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			atomic.AddUint64(&w.generation, 1)
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// current returns the current generation
+func (w *batchWatchdog) current() uint64 {
+	if w == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&w.generation)
+}
+
+func (w *batchWatchdog) stop() {
+	if w != nil {
+		close(w.quit)
+	}
+}
+
+// commitStale commits the worker's batch if the watchdog has advanced past the generation seen at its
+// last commit, returning the next transaction and the generation it was committed at
+func (s *Service) commitStale(tx Tx, seen uint64) (Tx, uint64, error) {
+	now := s.batchAge.current()
+	if now == seen {
+		return tx, seen, nil
+	}
+	next, err := s.ipfsPublisher.PrepareTxForBatch(tx, 0)
+	if err != nil {
+		return tx, seen, err
+	}
+	return next, now, nil
+}
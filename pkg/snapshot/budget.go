@@ -0,0 +1,73 @@
+package snapshot
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/trie"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// timeBudget bounds the wall-clock time of a snapshot. Once the budget is reached, workers stop at their
+// next node, commit their batches and return ErrTimeBudgetReached, so the snapshot can be resumed from
+// the recovery file. A nil *timeBudget is never reached.
+type timeBudget struct {
+	expired int32
+	timer   *time.Timer
+}
+
+func newTimeBudget(budget time.Duration) *timeBudget {
+	if budget <= 0 {
+		return nil
+	}
+	b := &timeBudget{}
+	b.timer = time.AfterFunc(budget, b.expire)
+	return b
+}
+
+func (b *timeBudget) expire() {
+	if atomic.CompareAndSwapInt32(&b.expired, 0, 1) {
+		log.Warn("time budget reached, stopping workers")
+	}
+}
+
+// reached reports whether the budget has run out
+func (b *timeBudget) reached() bool {
+	return b != nil && atomic.LoadInt32(&b.expired) == 1
+}
+
+func (b *timeBudget) stop() {
+	if b != nil {
+		b.timer.Stop()
+	}
+}
+
+// commitOrStop ends a worker's transaction, committing it rather than rolling it back if the worker was
+// stopped by the time budget, so that the nodes published before the stop are kept
+func commitOrStop(tx Tx, err error) error {
+	if !errors.Is(err, ErrTimeBudgetReached) {
+		return CommitOrRollback(tx, err)
+	}
+	if cerr := CommitOrRollback(tx, nil); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// logBudgetStop logs how far a state worker got before it was stopped by the time budget
+func logBudgetStop(it trie.NodeIterator, published uint64) {
+	tracked := asTracked(it)
+	if tracked == nil {
+		log.Infof("worker stopped at state path %x after publishing %d state nodes", it.Path(), published)
+		return
+	}
+	if tracked.storage != nil {
+		log.Infof("worker %d stopped at state path %x, storage path %x, after publishing %d state nodes",
+			tracked.worker, it.Path(), tracked.storage.Path(), published)
+		return
+	}
+	log.Infof("worker %d stopped at state path %x after publishing %d state nodes", tracked.worker, it.Path(), published)
+}
@@ -0,0 +1,119 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// ReadChangedAccounts reads a list of changed accounts, one per line, each either a 20 byte hex address
+// or the 32 byte hex hash of an address (the account's state trie key). Blank lines and lines starting
+// with '#' are ignored.
+func ReadChangedAccounts(path string) ([]common.Hash, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := []common.Hash{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := ParseAccountKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// ParseAccountKey parses a 20 byte hex address or the 32 byte hex hash of an address, returning the
+// account's state trie key
+func ParseAccountKey(s string) (common.Hash, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	switch len(b) {
+	case common.AddressLength:
+		return crypto.Keccak256Hash(b), nil
+	case common.HashLength:
+		return common.BytesToHash(b), nil
+	}
+	return common.Hash{}, fmt.Errorf("expected an address or account hash, got %s", s)
+}
+
+// changedIterator visits only the nodes on the paths from the root to a set of leaf keys, without
+// descending into the rest of the trie
+type changedIterator struct {
+	trie.NodeIterator
+	// the leaf keys as sorted nibble paths
+	paths [][]byte
+}
+
+// newChangedIterator wraps an iterator to visit the paths returned by changedPaths
+func newChangedIterator(it trie.NodeIterator, paths [][]byte) *changedIterator {
+	return &changedIterator{it, paths}
+}
+
+// changedPaths converts the changed account keys to sorted nibble paths, dropping any path which is
+// a prefix of another (i.e. a duplicate key). Each dropped path is described in the returned anomalies.
+// Keys of other lengths than an account's are rejected when the list is read, by ParseAccountKey.
+func changedPaths(keys []common.Hash) (paths [][]byte, anomalies []string) {
+	sorted := make([][]byte, len(keys))
+	for i, key := range keys {
+		sorted[i] = keyToNibbles(key.Bytes())
+	}
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	for i, path := range sorted {
+		// a path which is a prefix of any other is a prefix of the next in order
+		if i+1 < len(sorted) && bytes.HasPrefix(sorted[i+1], path) {
+			if bytes.Equal(sorted[i+1], path) {
+				anomalies = append(anomalies, fmt.Sprintf("account 0x%s is listed more than once", nibblesToHex(string(path))))
+			} else {
+				anomalies = append(anomalies, fmt.Sprintf("path %s is a prefix of path %s",
+					nibblesToHex(string(path)), nibblesToHex(string(sorted[i+1]))))
+			}
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths, anomalies
+}
+
+func (it *changedIterator) Next(bool) bool {
+	for it.NodeIterator.Next(it.onPath(it.Path())) {
+		if it.onPath(it.Path()) {
+			return true
+		}
+	}
+	return false
+}
+
+// onPath reports whether a node path is a prefix of any of the keys
+func (it *changedIterator) onPath(path []byte) bool {
+	i := sort.Search(len(it.paths), func(i int) bool { return bytes.Compare(it.paths[i], path) >= 0 })
+	return i < len(it.paths) && bytes.HasPrefix(it.paths[i], path)
+}
+
+func keyToNibbles(key []byte) []byte {
+	nibbles := make([]byte, len(key)*2)
+	for i, b := range key {
+		nibbles[i*2] = b / 16
+		nibbles[i*2+1] = b % 16
+	}
+	return nibbles
+}
@@ -0,0 +1,465 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/statediff/indexer/ipld"
+	nodeinfo "github.com/ethereum/go-ethereum/statediff/indexer/node"
+	"github.com/ethereum/go-ethereum/statediff/indexer/shared"
+	"github.com/multiformats/go-multihash"
+	"github.com/sirupsen/logrus"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/prom"
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+var _ snapt.Publisher = (*publisher)(nil)
+var _ snapt.StatsReporter = (*publisher)(nil)
+
+const (
+	logInterval = 1 * time.Minute
+
+	// DefaultBatchRows is the number of rows buffered by a worker before they are inserted. ClickHouse
+	// writes a part per insert, so batches are much larger than the postgres ones.
+	DefaultBatchRows = 200000
+)
+
+// table names, matching schema.sql
+const (
+	blocksTable       = "blocks"
+	headersTable      = "header_cids"
+	stateTable        = "state_cids"
+	storageTable      = "storage_cids"
+	keyPreimagesTable = "key_preimages"
+)
+
+// order in which a batch's tables are inserted, so that readers see the blocks before the rows referencing them
+var tables = []string{blocksTable, keyPreimagesTable, headersTable, stateTable, storageTable}
+
+type blockRow struct {
+	Key  string `json:"key"`
+	Data string `json:"data"`
+}
+
+type headerRow struct {
+	BlockNumber uint64 `json:"block_number"`
+	BlockHash   string `json:"block_hash"`
+	ParentHash  string `json:"parent_hash"`
+	CID         string `json:"cid"`
+	TD          string `json:"td"`
+	NodeID      string `json:"node_id"`
+	Reward      string `json:"reward"`
+	StateRoot   string `json:"state_root"`
+	TxRoot      string `json:"tx_root"`
+	ReceiptRoot string `json:"receipt_root"`
+	UncleRoot   string `json:"uncle_root"`
+	Bloom       string `json:"bloom"`
+	Timestamp   uint64 `json:"timestamp"`
+	MhKey       string `json:"mh_key"`
+	Coinbase    string `json:"coinbase"`
+}
+
+type stateRow struct {
+	HeaderID     string `json:"header_id"`
+	StatePath    string `json:"state_path"`
+	StateLeafKey string `json:"state_leaf_key"`
+	CID          string `json:"cid"`
+	MhKey        string `json:"mh_key"`
+	NodeType     uint8  `json:"node_type"`
+	NodeTypeName string `json:"node_type_name"`
+	Diff         bool   `json:"diff"`
+}
+
+type storageRow struct {
+	HeaderID       string `json:"header_id"`
+	StatePath      string `json:"state_path"`
+	StateLeafKey   string `json:"state_leaf_key"`
+	StoragePath    string `json:"storage_path"`
+	StorageLeafKey string `json:"storage_leaf_key"`
+	CID            string `json:"cid"`
+	MhKey          string `json:"mh_key"`
+	NodeType       uint8  `json:"node_type"`
+	NodeTypeName   string `json:"node_type_name"`
+	Diff           bool   `json:"diff"`
+}
+
+type preimageRow struct {
+	Key      string `json:"key"`
+	Preimage string `json:"preimage"`
+}
+
+// Config is the output of a ClickHouse publisher. At least one of OutputDir and URL must be set.
+type Config struct {
+	// OutputDir is a directory to write a JSONEachRow file per table to
+	OutputDir string
+	// URL is the ClickHouse HTTP interface to insert rows through
+	URL      string
+	Database string
+	User     string
+	Password string
+	// BatchRows is the number of rows a worker buffers before inserting them, DefaultBatchRows if 0
+	BatchRows uint
+}
+
+type publisher struct {
+	sinks     []sink
+	nodeInfo  nodeinfo.Info
+	batchRows uint
+
+	prior     snapt.CIDSet
+	manifest  *snapt.ManifestWriter
+	statsFile string
+
+	startTime           time.Time
+	stateNodeCounter    uint64
+	storageNodeCounter  uint64
+	codeNodeCounter     uint64
+	skippedBlockCounter uint64
+}
+
+// chTx buffers the rows of a batch per table
+type chTx struct {
+	sinks    []sink
+	buffers  map[string]*bytes.Buffer
+	rows     uint
+	manifest *snapt.ManifestBatch
+}
+
+func (tx *chTx) add(table string, row interface{}) error {
+	enc, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	buf, has := tx.buffers[table]
+	if !has {
+		buf = new(bytes.Buffer)
+		tx.buffers[table] = buf
+	}
+	buf.Write(enc)
+	buf.WriteByte('\n')
+	tx.rows++
+	return nil
+}
+
+// Commit inserts the buffered rows into each sink. ClickHouse has no transactions spanning inserts, so
+// a failed commit may leave some of the tables written; a resumed snapshot rewrites them, and the
+// Replacing engines collapse the duplicates.
+func (tx *chTx) Commit() error {
+	for _, table := range tables {
+		buf, has := tx.buffers[table]
+		if !has || buf.Len() == 0 {
+			continue
+		}
+		for _, s := range tx.sinks {
+			if err := s.insert(table, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		buf.Reset()
+	}
+	tx.rows = 0
+	return tx.manifest.Flush()
+}
+
+func (tx *chTx) Rollback() error {
+	for _, buf := range tx.buffers {
+		buf.Reset()
+	}
+	tx.rows = 0
+	return nil
+}
+
+// NewPublisher creates a publisher which writes rows in ClickHouse's JSONEachRow format, matching the
+// tables of schema.sql, to files and/or the ClickHouse HTTP interface
+func NewPublisher(config Config, node nodeinfo.Info) (*publisher, error) {
+	pub := &publisher{
+		nodeInfo:  node,
+		batchRows: config.BatchRows,
+		startTime: time.Now(),
+	}
+	if pub.batchRows == 0 {
+		pub.batchRows = DefaultBatchRows
+	}
+	if config.OutputDir != "" {
+		s, err := newFileSink(config.OutputDir)
+		if err != nil {
+			return nil, err
+		}
+		pub.sinks = append(pub.sinks, s)
+	}
+	if config.URL != "" {
+		s, err := newHTTPSink(config.URL, config.Database, config.User, config.Password)
+		if err != nil {
+			return nil, err
+		}
+		pub.sinks = append(pub.sinks, s)
+	}
+	if len(pub.sinks) == 0 {
+		return nil, fmt.Errorf("no ClickHouse output directory or URL set")
+	}
+	go pub.logNodeCounters()
+	return pub, nil
+}
+
+// SetManifests sets the CIDs published by a prior snapshot, whose blocks are not written again,
+// and the manifest recording the nodes published by this one. Either may be nil.
+func (p *publisher) SetManifests(prior snapt.CIDSet, manifest *snapt.ManifestWriter) {
+	p.prior = prior
+	p.manifest = manifest
+}
+
+// SetStatsFile sets a file to which the current stats are written each time they are logged
+func (p *publisher) SetStatsFile(path string) {
+	p.statsFile = path
+}
+
+// Close logs the final stats and closes the output files
+func (p *publisher) Close() error {
+	p.printNodeCounters("final stats")
+	var ret error
+	for _, s := range p.sinks {
+		if err := s.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+func (p *publisher) BeginTx() (snapt.Tx, error) {
+	return p.newTx(), nil
+}
+
+func (p *publisher) newTx() *chTx {
+	return &chTx{
+		sinks:    p.sinks,
+		buffers:  make(map[string]*bytes.Buffer),
+		manifest: p.manifest.NewBatch(),
+	}
+}
+
+// publishRaw derives a cid from raw bytes and provided codec, and adds the block to the batch
+// unless it is known from the prior manifest
+// returns the CID and blockstore prefixed multihash key
+func (p *publisher) publishRaw(tx *chTx, codec uint64, raw []byte) (string, string, error) {
+	c, err := ipld.RawdataToCid(codec, raw, multihash.KECCAK_256)
+	if err != nil {
+		return "", "", err
+	}
+	cidStr, mhKey := c.String(), shared.MultihashKeyFromCID(c)
+	if p.prior.Has(cidStr) {
+		atomic.AddUint64(&p.skippedBlockCounter, 1)
+		prom.IncSkippedBlockCount()
+		return cidStr, mhKey, nil
+	}
+	return cidStr, mhKey, tx.add(blocksTable, blockRow{Key: mhKey, Data: hex.EncodeToString(raw)})
+}
+
+func leafKeyHex(key common.Hash) string {
+	if snapt.IsNullHash(key) {
+		return ""
+	}
+	return key.Hex()
+}
+
+func (p *publisher) publishPreimage(tx *chTx, node *snapt.Node) error {
+	if node.Preimage == nil {
+		return nil
+	}
+	return tx.add(keyPreimagesTable, preimageRow{Key: node.Key.Hex(), Preimage: hex.EncodeToString(node.Preimage)})
+}
+
+// PublishHeader writes the header block and its header_cids row
+func (p *publisher) PublishHeader(header *types.Header, td, reward *big.Int) error {
+	headerNode, err := ipld.NewEthHeader(header)
+	if err != nil {
+		return err
+	}
+	tx := p.newTx()
+	mhKey := shared.MultihashKeyFromCID(headerNode.Cid())
+	if err = tx.add(blocksTable, blockRow{Key: mhKey, Data: hex.EncodeToString(headerNode.RawData())}); err != nil {
+		return err
+	}
+	err = tx.add(headersTable, headerRow{
+		BlockNumber: header.Number.Uint64(),
+		BlockHash:   header.Hash().Hex(),
+		ParentHash:  header.ParentHash.Hex(),
+		CID:         headerNode.Cid().String(),
+		TD:          td.String(),
+		NodeID:      p.nodeInfo.ID,
+		Reward:      reward.String(),
+		StateRoot:   header.Root.Hex(),
+		TxRoot:      header.TxHash.Hex(),
+		ReceiptRoot: header.ReceiptHash.Hex(),
+		UncleRoot:   header.UncleHash.Hex(),
+		Bloom:       hex.EncodeToString(header.Bloom.Bytes()),
+		Timestamp:   header.Time,
+		MhKey:       mhKey,
+		Coinbase:    header.Coinbase.Hex(),
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PublishStateNode adds the state node block and its state_cids row to the batch
+func (p *publisher) PublishStateNode(node *snapt.Node, headerID string, snapTx snapt.Tx) error {
+	tx := snapTx.(*chTx)
+	stateCID, mhKey, err := p.publishRaw(tx, ipld.MEthStateTrie, node.Value)
+	if err != nil {
+		return err
+	}
+	stateKey := leafKeyHex(node.Key)
+	err = tx.add(stateTable, stateRow{
+		HeaderID:     headerID,
+		StatePath:    hex.EncodeToString(node.Path),
+		StateLeafKey: stateKey,
+		CID:          stateCID,
+		MhKey:        mhKey,
+		NodeType:     uint8(node.NodeType),
+		NodeTypeName: node.NodeType.String(),
+		Diff:         node.Diff,
+	})
+	if err != nil {
+		return err
+	}
+	if err = p.publishPreimage(tx, node); err != nil {
+		return err
+	}
+	tx.manifest.Add(snapt.ManifestEntry{
+		Kind:     snapt.StateManifestKind,
+		CID:      stateCID,
+		MhKey:    mhKey,
+		Path:     node.Path,
+		NodeType: node.NodeType,
+		LeafKey:  stateKey,
+	})
+	atomic.AddUint64(&p.stateNodeCounter, 1)
+	prom.IncStateNodeCount()
+	return nil
+}
+
+// PublishStorageNode adds the storage node block and its storage_cids row, which records the leaf key
+// of the owning account as well as its path, to the batch
+func (p *publisher) PublishStorageNode(node *snapt.Node, headerID string, statePath []byte, snapTx snapt.Tx) error {
+	tx := snapTx.(*chTx)
+	storageCID, mhKey, err := p.publishRaw(tx, ipld.MEthStorageTrie, node.Value)
+	if err != nil {
+		return err
+	}
+	storageKey := leafKeyHex(node.Key)
+	err = tx.add(storageTable, storageRow{
+		HeaderID:       headerID,
+		StatePath:      hex.EncodeToString(statePath),
+		StateLeafKey:   leafKeyHex(node.StateKey),
+		StoragePath:    hex.EncodeToString(node.Path),
+		StorageLeafKey: storageKey,
+		CID:            storageCID,
+		MhKey:          mhKey,
+		NodeType:       uint8(node.NodeType),
+		NodeTypeName:   node.NodeType.String(),
+		Diff:           node.Diff,
+	})
+	if err != nil {
+		return err
+	}
+	if err = p.publishPreimage(tx, node); err != nil {
+		return err
+	}
+	tx.manifest.Add(snapt.ManifestEntry{
+		Kind:      snapt.StorageManifestKind,
+		CID:       storageCID,
+		MhKey:     mhKey,
+		StatePath: statePath,
+		Path:      node.Path,
+		NodeType:  node.NodeType,
+		LeafKey:   storageKey,
+	})
+	atomic.AddUint64(&p.storageNodeCounter, 1)
+	prom.IncStorageNodeCount()
+	return nil
+}
+
+// PublishCode adds the code block, keyed by the multihash of the code hash, to the batch
+func (p *publisher) PublishCode(codeHash common.Hash, codeBytes []byte, snapTx snapt.Tx) error {
+	mhKey, err := shared.MultihashKeyFromKeccak256(codeHash)
+	if err != nil {
+		return fmt.Errorf("error deriving multihash key from codehash: %v", err)
+	}
+	tx := snapTx.(*chTx)
+	if err = tx.add(blocksTable, blockRow{Key: mhKey, Data: hex.EncodeToString(codeBytes)}); err != nil {
+		return fmt.Errorf("error publishing code IPLD: %v", err)
+	}
+	atomic.AddUint64(&p.codeNodeCounter, 1)
+	prom.IncCodeNodeCount()
+	return nil
+}
+
+// PrepareTxForBatch inserts the batch and starts a new one once it has buffered the publisher's batch
+// size in rows. The snapshot's batch size, which is tuned for postgres transactions, only forces a
+// commit when it is 0.
+func (p *publisher) PrepareTxForBatch(snapTx snapt.Tx, maxBatchSize uint) (snapt.Tx, error) {
+	tx := snapTx.(*chTx)
+	if maxBatchSize != 0 && tx.rows < p.batchRows {
+		return tx, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return p.BeginTx()
+}
+
+// logNodeCounters periodically logs the number of node processed.
+func (p *publisher) logNodeCounters() {
+	t := time.NewTicker(logInterval)
+	for range t.C {
+		p.printNodeCounters("progress")
+	}
+}
+
+func (p *publisher) printNodeCounters(msg string) {
+	stats := p.Stats()
+	snapt.LogEvent(msg, stats.LogFields()...)
+	if p.statsFile != "" {
+		if err := snapt.WriteStatsFile(p.statsFile, stats); err != nil {
+			logrus.Errorf("failed to write stats file: %v", err)
+		}
+	}
+}
+
+// Stats returns the current node counts
+func (p *publisher) Stats() snapt.Stats {
+	now := time.Now()
+	return snapt.Stats{
+		StartTime:     p.startTime,
+		UpdatedAt:     now,
+		Runtime:       now.Sub(p.startTime).String(),
+		StateNodes:    atomic.LoadUint64(&p.stateNodeCounter),
+		StorageNodes:  atomic.LoadUint64(&p.storageNodeCounter),
+		CodeNodes:     atomic.LoadUint64(&p.codeNodeCounter),
+		SkippedBlocks: atomic.LoadUint64(&p.skippedBlockCounter),
+	}
+}
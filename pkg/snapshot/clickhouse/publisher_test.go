@@ -0,0 +1,118 @@
+package clickhouse
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	fixt "github.com/vulcanize/ipld-eth-state-snapshot/fixture"
+	"github.com/vulcanize/ipld-eth-state-snapshot/test"
+)
+
+func readRows(t *testing.T, path string, row interface{}, fn func()) int {
+	file, err := os.Open(path)
+	test.NoError(t, err)
+	defer file.Close()
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		test.NoError(t, json.Unmarshal(scanner.Bytes(), row))
+		fn()
+		count++
+	}
+	test.NoError(t, scanner.Err())
+	return count
+}
+
+func TestWriting(t *testing.T) {
+	dir := t.TempDir()
+	pub, err := NewPublisher(Config{OutputDir: dir}, test.DefaultNodeInfo)
+	test.NoError(t, err)
+	test.NoError(t, pub.PublishHeader(&fixt.Block1_Header, big.NewInt(1), big.NewInt(0)))
+
+	headerID := fixt.Block1_Header.Hash().String()
+	tx, err := pub.BeginTx()
+	test.NoError(t, err)
+	test.NoError(t, pub.PublishStateNode(&fixt.Block1_StateNode0, headerID, tx))
+	storageNode := fixt.Block1_StateNode0
+	storageNode.StateKey = common.Hash{1}
+	test.NoError(t, pub.PublishStorageNode(&storageNode, headerID, []byte{1}, tx))
+
+	// rows are buffered until the batch reaches its size
+	tx, err = pub.PrepareTxForBatch(tx, 1)
+	test.NoError(t, err)
+	if _, err := os.Stat(TableFile(dir, stateTable)); !os.IsNotExist(err) {
+		t.Fatal("expected state rows to be buffered")
+	}
+	// a zero batch size forces a commit
+	_, err = pub.PrepareTxForBatch(tx, 0)
+	test.NoError(t, err)
+	test.NoError(t, pub.Close())
+
+	var header headerRow
+	count := readRows(t, TableFile(dir, headersTable), &header, func() {
+		test.ExpectEqual(t, headerID, header.BlockHash)
+		test.ExpectEqual(t, "1", header.TD)
+	})
+	test.ExpectEqual(t, 1, count)
+
+	var state stateRow
+	count = readRows(t, TableFile(dir, stateTable), &state, func() {
+		test.ExpectEqual(t, hex.EncodeToString(fixt.Block1_StateNode0.Path), state.StatePath)
+		test.ExpectEqual(t, "branch", state.NodeTypeName)
+	})
+	test.ExpectEqual(t, 1, count)
+
+	var storage storageRow
+	count = readRows(t, TableFile(dir, storageTable), &storage, func() {
+		test.ExpectEqual(t, "01", storage.StatePath)
+		test.ExpectEqual(t, common.Hash{1}.Hex(), storage.StateLeafKey)
+	})
+	test.ExpectEqual(t, 1, count)
+
+	// the state and storage nodes have the same data, so share a multihash key
+	blocks := map[string]string{}
+	var block blockRow
+	readRows(t, TableFile(dir, blocksTable), &block, func() {
+		blocks[block.Key] = block.Data
+	})
+	test.ExpectEqual(t, hex.EncodeToString(fixt.Block1_StateNode0.Value), blocks[state.MhKey])
+}
+
+func TestHTTPInsert(t *testing.T) {
+	var mu sync.Mutex
+	inserts := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if len(body) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		inserts[r.URL.Query().Get("query")]++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	pub, err := NewPublisher(Config{URL: server.URL, Database: "eth"}, test.DefaultNodeInfo)
+	test.NoError(t, err)
+	tx, err := pub.BeginTx()
+	test.NoError(t, err)
+	test.NoError(t, pub.PublishStateNode(&fixt.Block1_StateNode0, fixt.Block1_Header.Hash().String(), tx))
+	test.NoError(t, tx.Commit())
+
+	test.ExpectEqual(t, map[string]int{
+		"INSERT INTO eth.blocks FORMAT JSONEachRow":     1,
+		"INSERT INTO eth.state_cids FORMAT JSONEachRow": 1,
+	}, inserts)
+}
@@ -0,0 +1,71 @@
+-- MergeTree schema of the tables written in clickhouse mode. Rows are inserted in JSONEachRow format.
+--
+-- Encoding:
+--   hashes and leaf keys are 0x-prefixed hex, or '' for nodes without a leaf key
+--   paths are the hex of their nibbles, one byte per nibble (e.g. the path [0xc, 0x3] is '0c03'), so the nodes under
+--     a path prefix match startsWith(state_path, prefix)
+--   cid is the base32 CIDv1 string, and mh_key the blockstore key of its multihash, as in postgres
+--   block data and preimages are hex without a prefix; unhex(data) gives the raw bytes
+--   td and reward are decimal strings; toUInt256(td) converts them
+--
+-- The Replacing engines collapse rows written more than once, e.g. by a resumed snapshot, at merge time, so queries
+-- needing exact counts before a merge should use FINAL.
+
+CREATE DATABASE IF NOT EXISTS eth;
+
+CREATE TABLE IF NOT EXISTS eth.blocks (
+    key String,
+    data String CODEC(ZSTD(3))
+) ENGINE = ReplacingMergeTree
+ORDER BY key;
+
+CREATE TABLE IF NOT EXISTS eth.header_cids (
+    block_number UInt64,
+    block_hash String,
+    parent_hash String,
+    cid String,
+    td String,
+    node_id LowCardinality(String),
+    reward String,
+    state_root String,
+    tx_root String,
+    receipt_root String,
+    uncle_root String,
+    bloom String,
+    timestamp UInt64,
+    mh_key String,
+    coinbase String
+) ENGINE = ReplacingMergeTree
+ORDER BY (block_number, block_hash);
+
+CREATE TABLE IF NOT EXISTS eth.state_cids (
+    header_id String,
+    state_path String,
+    state_leaf_key String,
+    cid String,
+    mh_key String,
+    node_type UInt8,
+    node_type_name LowCardinality(String),
+    diff Bool
+) ENGINE = ReplacingMergeTree
+ORDER BY (header_id, state_path);
+
+CREATE TABLE IF NOT EXISTS eth.storage_cids (
+    header_id String,
+    state_path String,
+    state_leaf_key String,
+    storage_path String,
+    storage_leaf_key String,
+    cid String,
+    mh_key String,
+    node_type UInt8,
+    node_type_name LowCardinality(String),
+    diff Bool
+) ENGINE = ReplacingMergeTree
+ORDER BY (header_id, state_path, storage_path);
+
+CREATE TABLE IF NOT EXISTS eth.key_preimages (
+    key String,
+    preimage String
+) ENGINE = ReplacingMergeTree
+ORDER BY key;
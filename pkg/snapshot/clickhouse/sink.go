@@ -0,0 +1,136 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package clickhouse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeout of each insert over HTTP; batches are large, so this is generous
+const insertTimeout = 5 * time.Minute
+
+// sink receives batches of a table's rows in JSONEachRow format
+type sink interface {
+	insert(table string, rows []byte) error
+	Close() error
+}
+
+// fileSink appends rows to a file per table, which can be loaded with
+// `clickhouse-client --query "INSERT INTO eth.<table> FORMAT JSONEachRow" < <table>.jsonl`
+type fileSink struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+func newFileSink(dir string) (*fileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create output directory %s: %w", dir, err)
+	}
+	return &fileSink{dir: dir, files: make(map[string]*os.File)}, nil
+}
+
+// TableFile returns the path of the file the rows of a table are written to
+func TableFile(dir, table string) string { return filepath.Join(dir, table+".jsonl") }
+
+func (s *fileSink) insert(table string, rows []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, has := s.files[table]
+	if !has {
+		var err error
+		f, err = os.OpenFile(TableFile(s.dir, table), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.files[table] = f
+	}
+	_, err := f.Write(rows)
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret error
+	for _, f := range s.files {
+		if err := f.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	s.files = nil
+	return ret
+}
+
+// httpSink inserts rows through the ClickHouse HTTP interface, one request per batch
+type httpSink struct {
+	url      string
+	database string
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newHTTPSink(endpoint, database, user, password string) (*httpSink, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ClickHouse URL %q: %w", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid ClickHouse URL %q: expected an http:// or https:// URL", endpoint)
+	}
+	return &httpSink{
+		url:      strings.TrimSuffix(endpoint, "/"),
+		database: database,
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: insertTimeout},
+	}, nil
+}
+
+func (s *httpSink) insert(table string, rows []byte) error {
+	query := url.Values{}
+	query.Set("query", fmt.Sprintf("INSERT INTO %s.%s FORMAT JSONEachRow", s.database, table))
+	req, err := http.NewRequest(http.MethodPost, s.url+"/?"+query.Encode(), bytes.NewReader(rows))
+	if err != nil {
+		return err
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("insert into %s failed: %w", table, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("insert into %s failed: %s: %s", table, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error { return nil }
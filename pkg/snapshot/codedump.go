@@ -0,0 +1,163 @@
+package snapshot
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	log "github.com/sirupsen/logrus"
+)
+
+// ContractCode is the code of one or more accounts
+type ContractCode struct {
+	Hash common.Hash
+	Code []byte
+}
+
+// DumpCode calls fn once with each distinct code of the accounts at a height. If addresses is empty, the
+// whole state trie is walked, otherwise only the given accounts are read.
+func (s *Service) DumpCode(height uint64, addresses []common.Address, fn func(ContractCode) error) error {
+	header, err := s.readHeader(height)
+	if err != nil {
+		return err
+	}
+	tree, err := s.stateDB.OpenTrie(header.Root)
+	if err != nil {
+		return wrapTrieError(err)
+	}
+	seen := map[common.Hash]struct{}{}
+	visit := func(key string, enc []byte) error {
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(enc, &account); err != nil {
+			return fmt.Errorf("error decoding account %s: %w", key, err)
+		}
+		codeHash := common.BytesToHash(account.CodeHash)
+		if codeHash == s.emptyCodeHash {
+			return nil
+		}
+		if _, ok := seen[codeHash]; ok {
+			return nil
+		}
+		seen[codeHash] = struct{}{}
+		code := rawdb.ReadCode(s.ethDB, codeHash)
+		if len(code) == 0 {
+			return fmt.Errorf("%w: code hash %s for account %s", ErrMissingCode, codeHash.Hex(), key)
+		}
+		return fn(ContractCode{Hash: codeHash, Code: code})
+	}
+
+	if len(addresses) > 0 {
+		for _, addr := range addresses {
+			enc, err := tree.TryGet(addr.Bytes())
+			if err != nil {
+				return wrapTrieError(err)
+			}
+			if len(enc) == 0 {
+				log.Warnf("account %s does not exist at height %d", addr.Hex(), height)
+				continue
+			}
+			if err = visit(addr.Hex(), enc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// every node is resolved on the way to the leaves, but only the leaves, the accounts, are read
+	it := tree.NodeIterator(nil)
+	for it.Next(true) {
+		if !it.Leaf() {
+			continue
+		}
+		if err = visit(common.BytesToHash(it.LeafKey()).Hex(), it.LeafBlob()); err != nil {
+			return err
+		}
+	}
+	return wrapTrieError(it.Error())
+}
+
+// CodeDumpWriter writes the hash and size of dumped code as CSV or newline-delimited JSON, optionally with
+// the bytecode, and optionally writes the bytecode of each to a file in a directory
+type CodeDumpWriter struct {
+	format       ExportFormat
+	withBytecode bool
+	codeDir      string
+	csv          *csv.Writer
+	json         *json.Encoder
+}
+
+type dumpedCode struct {
+	CodeHash string `json:"codeHash"`
+	Size     int    `json:"size"`
+	Code     string `json:"code,omitempty"`
+}
+
+// NewCodeDumpWriter creates a writer of dumped code. If withBytecode is set, the hex encoded bytecode is
+// written with its hash and size. If codeDir is set, the raw bytecode is also written to a file in it named by
+// its hash.
+func NewCodeDumpWriter(out io.Writer, format ExportFormat, withBytecode bool, codeDir string) (*CodeDumpWriter, error) {
+	w := &CodeDumpWriter{format: format, withBytecode: withBytecode, codeDir: codeDir}
+	if codeDir != "" {
+		if err := os.MkdirAll(codeDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case ExportCSV:
+		w.csv = csv.NewWriter(out)
+		columns := []string{"code_hash", "size"}
+		if withBytecode {
+			columns = append(columns, "code")
+		}
+		if err := w.csv.Write(columns); err != nil {
+			return nil, err
+		}
+	case ExportJSON:
+		w.json = json.NewEncoder(out)
+	default:
+		return nil, fmt.Errorf("invalid export format: %s", format)
+	}
+	return w, nil
+}
+
+// CodeFile returns the file the bytecode with the given hash is written to in a code directory
+func CodeFile(codeDir string, hash common.Hash) string {
+	return filepath.Join(codeDir, hash.Hex())
+}
+
+func (w *CodeDumpWriter) Write(code ContractCode) error {
+	if w.codeDir != "" {
+		if err := os.WriteFile(CodeFile(w.codeDir, code.Hash), code.Code, 0644); err != nil {
+			return err
+		}
+	}
+	row := dumpedCode{CodeHash: code.Hash.Hex(), Size: len(code.Code)}
+	if w.withBytecode {
+		row.Code = hexutil.Encode(code.Code)
+	}
+	if w.format == ExportJSON {
+		return w.json.Encode(row)
+	}
+	record := []string{row.CodeHash, strconv.Itoa(row.Size)}
+	if w.withBytecode {
+		record = append(record, row.Code)
+	}
+	return w.csv.Write(record)
+}
+
+func (w *CodeDumpWriter) Flush() error {
+	if w.csv == nil {
+		return nil
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
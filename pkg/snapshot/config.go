@@ -17,13 +17,22 @@ package snapshot
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
 	ethNode "github.com/ethereum/go-ethereum/statediff/indexer/node"
 	"github.com/spf13/viper"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/sharded"
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
 )
 
 // SnapshotMode specifies the snapshot data output method
@@ -32,39 +41,120 @@ type SnapshotMode string
 const (
 	PgSnapshot   SnapshotMode = "postgres"
 	FileSnapshot SnapshotMode = "file"
+	KVSnapshot   SnapshotMode = "kv"
+
+	ClickHouseSnapshot SnapshotMode = "clickhouse"
 
-	defaultOutputDir = "./snapshot_output"
+	defaultOutputDir           = "./snapshot_output"
+	defaultKVOutputDir         = "./snapshot_kv"
+	defaultClickHouseOutputDir = "./snapshot_clickhouse"
+	defaultClickHouseDatabase  = "eth"
 )
 
 // Config contains params for both databases the service uses
 type Config struct {
-	Eth  *EthConfig
-	DB   *DBConfig
-	File *FileConfig
+	Eth      *EthConfig
+	DB       *DBConfig
+	File     *FileConfig
+	KV       *KVConfig
+	Manifest *ManifestConfig
+	Stats    *StatsConfig
+	Schema   *SchemaConfig
+
+	ClickHouse *ClickHouseConfig
 }
 
 // EthConfig is config parameters for the chain.
 type EthConfig struct {
 	LevelDBPath   string
 	AncientDBPath string
-	NodeInfo      ethNode.Info
+	// number of freezer items to cache, 0 to disable the cache
+	AncientCacheSize int
+	NodeInfo         ethNode.Info
+	// hash of empty code and root of the empty trie, which differ from Ethereum's on some EVM chains
+	EmptyCodeHash common.Hash
+	EmptyRoot     common.Hash
 }
 
 // DBConfig is config parameters for DB.
 type DBConfig struct {
-	URI        string
-	ConnConfig postgres.Config
+	URI          string
+	ConnConfig   postgres.Config
+	ConflictMode snapt.ConflictMode
+	// BlockCompression is the codec IPLD blocks are compressed with
+	BlockCompression pg.Codec
+	// RequireSpace fails the snapshot if the pre-flight space check finds too little room, rather than warning
+	RequireSpace bool
+	// SpaceMargin is the headroom required over the estimated snapshot size, as a fraction of it
+	SpaceMargin float64
+	// MaxSize is the space available to the database in bytes, 0 if unknown
+	MaxSize uint64
+	// ExpectedSize is the expected size of the snapshot in bytes, 0 to estimate it from the database
+	ExpectedSize uint64
+
+	// Shards are the connection configs of the databases to distribute output across, if set
+	Shards       []postgres.Config
+	ShardFunc    sharded.ShardFunc
+	ShardHeaders sharded.HeaderPlacement
 }
 
 type FileConfig struct {
 	OutputDir string
 }
 
+// KVConfig is config parameters for the key-value store output.
+type KVConfig struct {
+	OutputDir string
+}
+
+// ClickHouseConfig is config parameters for the ClickHouse output.
+type ClickHouseConfig struct {
+	// OutputDir is a directory to write a JSONEachRow file per table to
+	OutputDir string
+	// URL is the ClickHouse HTTP interface to insert rows through
+	URL      string
+	Database string
+	User     string
+	Password string
+	// BatchRows is the number of rows each worker buffers before inserting them
+	BatchRows uint
+}
+
+// ManifestConfig is config parameters for the node manifests.
+type ManifestConfig struct {
+	// OutputFile is the manifest of the nodes published by this snapshot
+	OutputFile string
+	// PriorFile is the manifest of a previous snapshot, whose blocks are not written again
+	PriorFile string
+	// SinceSnapshot is the height of a snapshot in the target database whose blocks are not written
+	// again, or -1 for none
+	SinceSnapshot int64
+}
+
+// StatsConfig is config parameters for the stats file.
+type StatsConfig struct {
+	// OutputFile is rewritten with the current stats each time they are logged
+	OutputFile string
+}
+
+// SchemaConfig is config parameters for optional columns of the output rows.
+type SchemaConfig struct {
+	// StorageStateKeys records the leaf key of the owning account on storage rows
+	StorageStateKeys bool
+	// NodeTypeNames records the name of the node type on node rows, alongside the integer node_type
+	NodeTypeNames bool
+}
+
 func NewConfig(mode SnapshotMode) (*Config, error) {
 	ret := &Config{
 		&EthConfig{},
 		&DBConfig{},
 		&FileConfig{},
+		&KVConfig{},
+		&ManifestConfig{},
+		&StatsConfig{},
+		&SchemaConfig{},
+		&ClickHouseConfig{},
 	}
 	return ret, ret.Init(mode)
 }
@@ -76,6 +166,7 @@ func (c *Config) Init(mode SnapshotMode) error {
 	viper.BindEnv(ETH_GENESIS_BLOCK_TOML, ETH_GENESIS_BLOCK)
 	viper.BindEnv(ETH_NETWORK_ID_TOML, ETH_NETWORK_ID)
 	viper.BindEnv(ETH_CHAIN_ID_TOML, ETH_CHAIN_ID)
+	viper.BindEnv(SNAPSHOT_NODE_ID_TOML, SNAPSHOT_NODE_ID)
 
 	c.Eth.NodeInfo = ethNode.Info{
 		ID:           viper.GetString(ETH_NODE_ID_TOML),
@@ -84,25 +175,75 @@ func (c *Config) Init(mode SnapshotMode) error {
 		NetworkID:    viper.GetString(ETH_NETWORK_ID_TOML),
 		ChainID:      viper.GetUint64(ETH_CHAIN_ID_TOML),
 	}
+	// a per-run node ID distinguishes the rows written by each instance sharing a database
+	if nodeID := viper.GetString(SNAPSHOT_NODE_ID_TOML); nodeID != "" {
+		c.Eth.NodeInfo.ID = nodeID
+	}
+	if c.Eth.NodeInfo.ID == "" {
+		return fmt.Errorf("no node ID set, set %s or %s", ETH_NODE_ID_TOML, SNAPSHOT_NODE_ID_TOML)
+	}
 
 	viper.BindEnv(ANCIENT_DB_PATH_TOML, ANCIENT_DB_PATH)
 	viper.BindEnv(LVL_DB_PATH_TOML, LVL_DB_PATH)
+	viper.BindEnv(ANCIENT_DB_CACHE_SIZE_TOML, ANCIENT_DB_CACHE_SIZE)
 
 	c.Eth.AncientDBPath = viper.GetString(ANCIENT_DB_PATH_TOML)
 	c.Eth.LevelDBPath = viper.GetString(LVL_DB_PATH_TOML)
+	c.Eth.AncientCacheSize = viper.GetInt(ANCIENT_DB_CACHE_SIZE_TOML)
+
+	if err := c.Eth.InitEmptyHashes(); err != nil {
+		return err
+	}
+
+	c.Manifest.Init()
+	c.Stats.Init()
+	c.Schema.Init()
 
 	switch mode {
 	case FileSnapshot:
 		c.File.Init()
+	case KVSnapshot:
+		c.KV.Init()
+	case ClickHouseSnapshot:
+		c.ClickHouse.Init()
 	case PgSnapshot:
-		c.DB.Init()
+		return c.DB.Init()
 	default:
 		return fmt.Errorf("no output mode specified")
 	}
 	return nil
 }
 
-func (c *DBConfig) Init() {
+// InitEmptyHashes reads the hash of empty code and the root of the empty trie, which default to Ethereum's
+func (c *EthConfig) InitEmptyHashes() error {
+	viper.BindEnv(ETH_EMPTY_CODE_HASH_TOML, ETH_EMPTY_CODE_HASH)
+	viper.BindEnv(ETH_EMPTY_ROOT_TOML, ETH_EMPTY_ROOT)
+	var err error
+	if c.EmptyCodeHash, err = parseHash(viper.GetString(ETH_EMPTY_CODE_HASH_TOML), DefaultEmptyCodeHash); err != nil {
+		return fmt.Errorf("invalid %s: %w", ETH_EMPTY_CODE_HASH_TOML, err)
+	}
+	if c.EmptyRoot, err = parseHash(viper.GetString(ETH_EMPTY_ROOT_TOML), DefaultEmptyRoot); err != nil {
+		return fmt.Errorf("invalid %s: %w", ETH_EMPTY_ROOT_TOML, err)
+	}
+	return nil
+}
+
+// parseHash parses a 0x-prefixed 32 byte hex hash, returning def if s is empty
+func parseHash(s string, def common.Hash) (common.Hash, error) {
+	if s == "" {
+		return def, nil
+	}
+	b, err := hexutil.Decode(s)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if len(b) != common.HashLength {
+		return common.Hash{}, fmt.Errorf("expected %d bytes, got %d", common.HashLength, len(b))
+	}
+	return common.BytesToHash(b), nil
+}
+
+func (c *DBConfig) Init() error {
 	viper.BindEnv(DATABASE_NAME_TOML, DATABASE_NAME)
 	viper.BindEnv(DATABASE_HOSTNAME_TOML, DATABASE_HOSTNAME)
 	viper.BindEnv(DATABASE_PORT_TOML, DATABASE_PORT)
@@ -111,6 +252,15 @@ func (c *DBConfig) Init() {
 	viper.BindEnv(DATABASE_MAX_IDLE_CONNECTIONS_TOML, DATABASE_MAX_IDLE_CONNECTIONS)
 	viper.BindEnv(DATABASE_MAX_OPEN_CONNECTIONS_TOML, DATABASE_MAX_OPEN_CONNECTIONS)
 	viper.BindEnv(DATABASE_MAX_CONN_LIFETIME_TOML, DATABASE_MAX_CONN_LIFETIME)
+	viper.BindEnv(DATABASE_CONFLICT_MODE_TOML, DATABASE_CONFLICT_MODE)
+	viper.BindEnv(DATABASE_BLOCK_COMPRESSION_TOML, DATABASE_BLOCK_COMPRESSION)
+	viper.BindEnv(DATABASE_REQUIRE_SPACE_TOML, DATABASE_REQUIRE_SPACE)
+	viper.BindEnv(DATABASE_SPACE_MARGIN_TOML, DATABASE_SPACE_MARGIN)
+	viper.BindEnv(DATABASE_MAX_SIZE_TOML, DATABASE_MAX_SIZE)
+	viper.BindEnv(DATABASE_EXPECTED_SIZE_TOML, DATABASE_EXPECTED_SIZE)
+	viper.BindEnv(DATABASE_SHARDS_TOML, DATABASE_SHARDS)
+	viper.BindEnv(DATABASE_SHARD_FUNCTION_TOML, DATABASE_SHARD_FUNCTION)
+	viper.BindEnv(DATABASE_SHARD_HEADERS_TOML, DATABASE_SHARD_HEADERS)
 
 	dbParams := postgres.Config{}
 	// DB params
@@ -126,6 +276,69 @@ func (c *DBConfig) Init() {
 
 	c.ConnConfig = dbParams
 	c.URI = dbParams.DbConnectionString()
+
+	c.ConflictMode = snapt.ConflictUpsert
+	if modeStr := viper.GetString(DATABASE_CONFLICT_MODE_TOML); modeStr != "" {
+		mode, err := snapt.ParseConflictMode(modeStr)
+		if err != nil {
+			return err
+		}
+		c.ConflictMode = mode
+	}
+	codec, err := pg.ParseCodec(viper.GetString(DATABASE_BLOCK_COMPRESSION_TOML))
+	if err != nil {
+		return err
+	}
+	c.BlockCompression = codec
+
+	c.RequireSpace = viper.GetBool(DATABASE_REQUIRE_SPACE_TOML)
+	c.SpaceMargin = DefaultSpaceMargin
+	if viper.IsSet(DATABASE_SPACE_MARGIN_TOML) {
+		c.SpaceMargin = viper.GetFloat64(DATABASE_SPACE_MARGIN_TOML)
+	}
+	c.MaxSize = viper.GetUint64(DATABASE_MAX_SIZE_TOML) * 1024 * 1024
+	c.ExpectedSize = viper.GetUint64(DATABASE_EXPECTED_SIZE_TOML) * 1024 * 1024
+
+	for _, dsns := range viper.GetStringSlice(DATABASE_SHARDS_TOML) {
+		for _, dsn := range strings.Split(dsns, ",") {
+			if dsn = strings.TrimSpace(dsn); dsn == "" {
+				continue
+			}
+			shard, err := ParseDSN(dsn, dbParams)
+			if err != nil {
+				return fmt.Errorf("invalid database shard: %w", err)
+			}
+			c.Shards = append(c.Shards, shard)
+		}
+	}
+	if c.ShardFunc, err = sharded.ParseShardFunc(viper.GetString(DATABASE_SHARD_FUNCTION_TOML)); err != nil {
+		return err
+	}
+	c.ShardHeaders, err = sharded.ParseHeaderPlacement(viper.GetString(DATABASE_SHARD_HEADERS_TOML))
+	return err
+}
+
+// ParseDSN parses a postgres connection URI, taking the connection settings from base
+func ParseDSN(dsn string, base postgres.Config) (postgres.Config, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return base, fmt.Errorf("invalid database URI %q: %w", dsn, err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return base, fmt.Errorf("invalid database URI %q: expected a postgres:// URI", dsn)
+	}
+	ret := base
+	ret.Hostname = u.Hostname()
+	ret.Port = 5432
+	if port := u.Port(); port != "" {
+		if ret.Port, err = strconv.Atoi(port); err != nil {
+			return base, fmt.Errorf("invalid database URI %q: %w", dsn, err)
+		}
+	}
+	ret.DatabaseName = strings.TrimPrefix(u.Path, "/")
+	ret.Username = u.User.Username()
+	ret.Password, _ = u.User.Password()
+	return ret, nil
 }
 
 func (c *FileConfig) Init() error {
@@ -137,3 +350,60 @@ func (c *FileConfig) Init() error {
 	}
 	return nil
 }
+
+func (c *KVConfig) Init() error {
+	viper.BindEnv(KV_OUTPUT_DIR_TOML, KV_OUTPUT_DIR)
+	c.OutputDir = viper.GetString(KV_OUTPUT_DIR_TOML)
+	if c.OutputDir == "" {
+		logrus.Infof("no key-value store directory set, using default: %s", defaultKVOutputDir)
+		c.OutputDir = defaultKVOutputDir
+	}
+	return nil
+}
+
+func (c *ClickHouseConfig) Init() error {
+	viper.BindEnv(CLICKHOUSE_OUTPUT_DIR_TOML, CLICKHOUSE_OUTPUT_DIR)
+	viper.BindEnv(CLICKHOUSE_URL_TOML, CLICKHOUSE_URL)
+	viper.BindEnv(CLICKHOUSE_DATABASE_TOML, CLICKHOUSE_DATABASE)
+	viper.BindEnv(CLICKHOUSE_USER_TOML, CLICKHOUSE_USER)
+	viper.BindEnv(CLICKHOUSE_PASSWORD_TOML, CLICKHOUSE_PASSWORD)
+	viper.BindEnv(CLICKHOUSE_BATCH_ROWS_TOML, CLICKHOUSE_BATCH_ROWS)
+	c.OutputDir = viper.GetString(CLICKHOUSE_OUTPUT_DIR_TOML)
+	c.URL = viper.GetString(CLICKHOUSE_URL_TOML)
+	c.Database = viper.GetString(CLICKHOUSE_DATABASE_TOML)
+	c.User = viper.GetString(CLICKHOUSE_USER_TOML)
+	c.Password = viper.GetString(CLICKHOUSE_PASSWORD_TOML)
+	c.BatchRows = viper.GetUint(CLICKHOUSE_BATCH_ROWS_TOML)
+	if c.OutputDir == "" && c.URL == "" {
+		logrus.Infof("no ClickHouse URL or output directory set, using default: %s", defaultClickHouseOutputDir)
+		c.OutputDir = defaultClickHouseOutputDir
+	}
+	if c.Database == "" {
+		c.Database = defaultClickHouseDatabase
+	}
+	return nil
+}
+
+func (c *ManifestConfig) Init() {
+	viper.BindEnv(SNAPSHOT_MANIFEST_FILE_TOML, SNAPSHOT_MANIFEST_FILE)
+	viper.BindEnv(SNAPSHOT_PRIOR_MANIFEST_TOML, SNAPSHOT_PRIOR_MANIFEST)
+	viper.BindEnv(SNAPSHOT_SINCE_SNAPSHOT_TOML, SNAPSHOT_SINCE_SNAPSHOT)
+	c.OutputFile = viper.GetString(SNAPSHOT_MANIFEST_FILE_TOML)
+	c.PriorFile = viper.GetString(SNAPSHOT_PRIOR_MANIFEST_TOML)
+	c.SinceSnapshot = -1
+	if viper.IsSet(SNAPSHOT_SINCE_SNAPSHOT_TOML) {
+		c.SinceSnapshot = viper.GetInt64(SNAPSHOT_SINCE_SNAPSHOT_TOML)
+	}
+}
+
+func (c *StatsConfig) Init() {
+	viper.BindEnv(SNAPSHOT_STATS_FILE_TOML, SNAPSHOT_STATS_FILE)
+	c.OutputFile = viper.GetString(SNAPSHOT_STATS_FILE_TOML)
+}
+
+func (c *SchemaConfig) Init() {
+	viper.BindEnv(SNAPSHOT_STORAGE_STATE_KEYS_TOML, SNAPSHOT_STORAGE_STATE_KEYS)
+	c.StorageStateKeys = viper.GetBool(SNAPSHOT_STORAGE_STATE_KEYS_TOML)
+	viper.BindEnv(SNAPSHOT_NODE_TYPE_NAMES_TOML, SNAPSHOT_NODE_TYPE_NAMES)
+	c.NodeTypeNames = viper.GetBool(SNAPSHOT_NODE_TYPE_NAMES_TOML)
+}
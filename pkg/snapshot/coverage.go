@@ -0,0 +1,122 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// MaxCoverageDepth is the deepest prefix depth a coverage summary can be made at
+const MaxCoverageDepth = 3
+
+// PrefixCoverage summarizes the state nodes published under each path prefix of a depth, keyed by the
+// prefix nibbles
+type PrefixCoverage struct {
+	Depth  int
+	Counts map[string]int64
+	// Expected holds the prefixes under which the state trie has nodes, or is nil if the trie is unknown
+	Expected map[string]bool
+}
+
+// StatePrefixes returns the hash of the canonical header at a height and the path prefixes of a depth
+// under which its state trie has nodes
+func (s *Service) StatePrefixes(height uint64, depth int) (string, map[string]bool, error) {
+	header, err := s.readHeader(height)
+	if err != nil {
+		return "", nil, err
+	}
+	tree, err := s.stateDB.OpenTrie(header.Root)
+	if err != nil {
+		return "", nil, wrapTrieError(err)
+	}
+	ret := map[string]bool{}
+	it := tree.NodeIterator(nil)
+	for it.Next(len(it.Path()) < depth) {
+		// paths below an extension may skip past the depth
+		if path := it.Path(); len(path) >= depth && !IsNullHash(it.Hash()) {
+			ret[string(path[:depth])] = true
+		}
+	}
+	return header.Hash().String(), ret, wrapTrieError(it.Error())
+}
+
+// prefixes lists the path prefixes of a depth in order
+func prefixes(depth int) []string {
+	ret := []string{""}
+	for i := 0; i < depth; i++ {
+		var next []string
+		for _, prefix := range ret {
+			for nibble := byte(0); nibble < 16; nibble++ {
+				next = append(next, prefix+string([]byte{nibble}))
+			}
+		}
+		ret = next
+	}
+	return ret
+}
+
+func nibblesToHex(nibbles string) string {
+	var sb strings.Builder
+	for i := 0; i < len(nibbles); i++ {
+		sb.WriteByte("0123456789abcdef"[nibbles[i]&0xf])
+	}
+	return sb.String()
+}
+
+// Gaps returns the prefixes with no published nodes where some are expected, in order. If the state trie
+// is unknown, empty prefixes are suspicious when most prefixes have nodes, as the keys of a large trie are
+// spread evenly across them.
+func (c *PrefixCoverage) Gaps() []string {
+	all := prefixes(c.Depth)
+	populated := 0
+	for _, prefix := range all {
+		if c.Counts[prefix] > 0 {
+			populated++
+		}
+	}
+	var ret []string
+	for _, prefix := range all {
+		if c.Counts[prefix] > 0 {
+			continue
+		}
+		if c.Expected != nil && c.Expected[prefix] || c.Expected == nil && populated*2 >= len(all) {
+			ret = append(ret, nibblesToHex(prefix))
+		}
+	}
+	return ret
+}
+
+// WriteGrid writes the counts as a grid with a row per prefix of depth-1 nibbles and a column for the last
+// nibble. Empty prefixes are shown as "-", and gaps are marked with "!".
+func (c *PrefixCoverage) WriteGrid(w io.Writer) error {
+	gaps := map[string]bool{}
+	for _, gap := range c.Gaps() {
+		gaps[gap] = true
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%*s", c.Depth+1, "")
+	for nibble := 0; nibble < 16; nibble++ {
+		fmt.Fprintf(&sb, " %7x", nibble)
+	}
+	sb.WriteByte('\n')
+	for _, row := range prefixes(c.Depth - 1) {
+		label := nibblesToHex(row) + "*"
+		fmt.Fprintf(&sb, "%*s", c.Depth+1, label)
+		for nibble := byte(0); nibble < 16; nibble++ {
+			prefix := row + string([]byte{nibble})
+			cell := "-"
+			if count := c.Counts[prefix]; count > 0 {
+				cell = fmt.Sprint(count)
+			}
+			if gaps[nibblesToHex(prefix)] {
+				cell += "!"
+			}
+			fmt.Fprintf(&sb, " %7s", cell)
+		}
+		sb.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,151 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient/gethclient"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/statediff/indexer/ipld"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// ProofSource returns the eth_getProof result of an account, as gethclient.Client does
+type ProofSource interface {
+	GetProof(ctx context.Context, account common.Address, keys []string, blockNumber *big.Int) (*gethclient.AccountResult, error)
+}
+
+// CrossCheckMismatch is a difference between the snapshot and the reference node
+type CrossCheckMismatch struct {
+	// Account is the leaf key of the account, or the zero hash for the state root
+	Account  common.Hash
+	Field    string
+	Snapshot string
+	Expected string
+}
+
+func (m CrossCheckMismatch) String() string {
+	if m.Account == (common.Hash{}) {
+		return fmt.Sprintf("%s: snapshot has %s, expected %s", m.Field, m.Snapshot, m.Expected)
+	}
+	return fmt.Sprintf("account %s %s: snapshot has %s, expected %s", m.Account.Hex(), m.Field, m.Snapshot, m.Expected)
+}
+
+// CrossCheckReport is the outcome of a cross-check of a snapshot
+type CrossCheckReport struct {
+	Height    uint64
+	StateRoot common.Hash
+	// Checked accounts were compared with the reference node; Skipped accounts had no known address
+	Checked, Skipped int
+	Mismatches       []CrossCheckMismatch
+}
+
+func (r *CrossCheckReport) mismatch(account common.Hash, field string, snapshot, expected interface{}) {
+	m := CrossCheckMismatch{account, field, fmt.Sprint(snapshot), fmt.Sprint(expected)}
+	log.Error(m.String())
+	r.Mismatches = append(r.Mismatches, m)
+}
+
+// StateRootCID returns the CID of the state trie root node with the given hash
+func StateRootCID(root common.Hash) (string, error) {
+	mh, err := multihash.Encode(root.Bytes(), multihash.KECCAK_256)
+	if err != nil {
+		return "", err
+	}
+	return cid.NewCidV1(ipld.MEthStateTrie, mh).String(), nil
+}
+
+// CheckRoot compares the CID of the root node published for the header with the header's state root
+func (r *CrossCheckReport) CheckRoot(publishedCID string) error {
+	expected, err := StateRootCID(r.StateRoot)
+	if err != nil {
+		return err
+	}
+	if publishedCID == "" {
+		publishedCID = "no root node"
+	}
+	if publishedCID != expected {
+		r.mismatch(common.Hash{}, "root node CID", publishedCID, expected)
+	}
+	return nil
+}
+
+// CheckStateRoot compares the state root of the header with the reference node's header at the height
+func (r *CrossCheckReport) CheckStateRoot(expected common.Hash) {
+	if r.StateRoot != expected {
+		r.mismatch(common.Hash{}, "state root", r.StateRoot.Hex(), expected.Hex())
+	}
+}
+
+// CheckAccounts decodes each sampled leaf from its published block, and compares the account with the
+// one returned by the reference node's eth_getProof at the report's height. The addresses of the leaf
+// keys are looked up with preimage; leaves without a known address are skipped.
+func (r *CrossCheckReport) CheckAccounts(ctx context.Context, leaves []pg.StateLeaf, blocks pg.BlockSource,
+	proofs ProofSource, preimage func(common.Hash) []byte) error {
+	for _, leaf := range leaves {
+		key := common.HexToHash(leaf.LeafKey)
+		addr := preimage(key)
+		if len(addr) != common.AddressLength {
+			log.Debugf("no address is known for account %s, skipping", key.Hex())
+			r.Skipped++
+			continue
+		}
+		account, err := publishedAccount(ctx, leaf, blocks)
+		if err != nil {
+			return fmt.Errorf("account %s: %w", key.Hex(), err)
+		}
+		result, err := proofs.GetProof(ctx, common.BytesToAddress(addr), nil, new(big.Int).SetUint64(r.Height))
+		if err != nil {
+			return fmt.Errorf("failed to get proof of account %s: %w", common.BytesToAddress(addr).Hex(), err)
+		}
+		r.Checked++
+		if account.Nonce != result.Nonce {
+			r.mismatch(key, "nonce", account.Nonce, result.Nonce)
+		}
+		if account.Balance.Cmp(result.Balance) != 0 {
+			r.mismatch(key, "balance", account.Balance, result.Balance)
+		}
+		if account.Root != result.StorageHash {
+			r.mismatch(key, "storage root", account.Root.Hex(), result.StorageHash.Hex())
+		}
+		if codeHash := common.BytesToHash(account.CodeHash); codeHash != result.CodeHash {
+			r.mismatch(key, "code hash", codeHash.Hex(), result.CodeHash.Hex())
+		}
+	}
+	return nil
+}
+
+// publishedAccount fetches and decodes the account of a published state leaf
+func publishedAccount(ctx context.Context, leaf pg.StateLeaf, blocks pg.BlockSource) (*types.StateAccount, error) {
+	c, err := cid.Decode(leaf.CID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %s: %w", leaf.CID, err)
+	}
+	data, err := blocks.GetBlock(ctx, c, leaf.MhKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch block %s: %w", leaf.CID, err)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("block %s is missing", leaf.CID)
+	}
+	var elements []interface{}
+	if err := rlp.DecodeBytes(data, &elements); err != nil {
+		return nil, fmt.Errorf("error decoding leaf %s: %w", leaf.CID, err)
+	}
+	if ty, err := CheckKeyType(elements); err != nil || ty != Leaf {
+		return nil, fmt.Errorf("%w: block %s is not a leaf", ErrUnexpectedNodeType, leaf.CID)
+	}
+	var account types.StateAccount
+	if err := rlp.DecodeBytes(elements[1].([]byte), &account); err != nil {
+		return nil, fmt.Errorf("error decoding account of leaf %s: %w", leaf.CID, err)
+	}
+	return &account, nil
+}
@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	decodedAccountsFile = "accounts.json"
+	decodedStorageFile  = "storage.json"
+)
+
+// decodedAccount is the output record for a state leaf node
+type decodedAccount struct {
+	HeaderID    string `json:"header_id"`
+	LeafKey     string `json:"leaf_key"`
+	Path        string `json:"path"`
+	Nonce       uint64 `json:"nonce"`
+	Balance     string `json:"balance"`
+	StorageRoot string `json:"storage_root"`
+	CodeHash    string `json:"code_hash"`
+}
+
+// decodedSlot is the output record for a storage leaf node
+type decodedSlot struct {
+	HeaderID  string `json:"header_id"`
+	StatePath string `json:"state_path"`
+	LeafKey   string `json:"leaf_key"`
+	Path      string `json:"path"`
+	Value     string `json:"value"`
+}
+
+// decodedWriter writes the decoded contents of leaf nodes as newline-delimited JSON, one file
+// for accounts and one for storage slots.
+// A nil *decodedWriter writes nothing.
+type decodedWriter struct {
+	mu       sync.Mutex
+	files    []*os.File
+	bufs     []*bufio.Writer
+	accounts *json.Encoder
+	storage  *json.Encoder
+}
+
+func newDecodedWriter(dir string) (*decodedWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &decodedWriter{}
+	var encs []*json.Encoder
+	for _, name := range []string{decodedAccountsFile, decodedStorageFile} {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		buf := bufio.NewWriter(file)
+		w.files = append(w.files, file)
+		w.bufs = append(w.bufs, buf)
+		encs = append(encs, json.NewEncoder(buf))
+	}
+	w.accounts, w.storage = encs[0], encs[1]
+	return w, nil
+}
+
+func (w *decodedWriter) writeAccount(headerID string, leafKey common.Hash, path []byte, account *types.StateAccount) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.accounts.Encode(decodedAccount{
+		HeaderID:    headerID,
+		LeafKey:     leafKey.Hex(),
+		Path:        fmt.Sprintf("%x", path),
+		Nonce:       account.Nonce,
+		Balance:     account.Balance.String(),
+		StorageRoot: account.Root.Hex(),
+		CodeHash:    common.BytesToHash(account.CodeHash).Hex(),
+	})
+}
+
+// writeSlot writes a storage leaf, given the RLP encoded slot value it holds
+func (w *decodedWriter) writeSlot(headerID string, statePath []byte, leafKey common.Hash, path []byte, encodedValue []byte) error {
+	if w == nil {
+		return nil
+	}
+	var value []byte
+	if err := rlp.DecodeBytes(encodedValue, &value); err != nil {
+		return fmt.Errorf("error decoding storage value for leaf node at path %x: %w", path, err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.storage.Encode(decodedSlot{
+		HeaderID:  headerID,
+		StatePath: fmt.Sprintf("%x", statePath),
+		LeafKey:   leafKey.Hex(),
+		Path:      fmt.Sprintf("%x", path),
+		Value:     common.BytesToHash(value).Hex(),
+	})
+}
+
+func (w *decodedWriter) close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var ret error
+	for i, file := range w.files {
+		if err := w.bufs[i].Flush(); err != nil && ret == nil {
+			ret = err
+		}
+		if err := file.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
@@ -0,0 +1,122 @@
+package snapshot
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/prom"
+)
+
+// CodeDedupMode specifies how contract code already published by the snapshot is tracked, so that
+// code shared by many accounts is only published once
+type CodeDedupMode string
+
+const (
+	// CodeDedupNone publishes code for every account which references it
+	CodeDedupNone CodeDedupMode = "none"
+	// CodeDedupGlobal tracks published code in a cache shared by all workers
+	CodeDedupGlobal CodeDedupMode = "global"
+	// CodeDedupLocal tracks published code in a cache per worker, avoiding lock contention at the cost
+	// of code shared across workers being published once by each of them
+	CodeDedupLocal CodeDedupMode = "local"
+)
+
+func ParseCodeDedupMode(s string) (CodeDedupMode, error) {
+	switch mode := CodeDedupMode(s); mode {
+	case CodeDedupNone, CodeDedupGlobal, CodeDedupLocal:
+		return mode, nil
+	case "":
+		return CodeDedupNone, nil
+	}
+	return "", fmt.Errorf("invalid code dedup mode: %s", s)
+}
+
+// codeDedup hands out the code caches used by each worker.
+// A nil *codeDedup hands out nil caches, which never report code as seen.
+type codeDedup struct {
+	mode   CodeDedupMode
+	global *codeCache
+
+	mu     sync.Mutex
+	locals []*codeCache
+}
+
+// codeCache records the code hashes published by one or more workers.
+// A nil *codeCache records nothing.
+type codeCache struct {
+	mu     *sync.Mutex // nil when owned by a single worker
+	hashes map[common.Hash]struct{}
+}
+
+func newCodeDedup(mode CodeDedupMode) *codeDedup {
+	switch mode {
+	case CodeDedupGlobal:
+		return &codeDedup{mode: mode, global: &codeCache{
+			mu:     &sync.Mutex{},
+			hashes: make(map[common.Hash]struct{}),
+		}}
+	case CodeDedupLocal:
+		return &codeDedup{mode: mode}
+	}
+	return nil
+}
+
+// forWorker returns the cache to be used by a single worker
+func (d *codeDedup) forWorker() *codeCache {
+	if d == nil {
+		return nil
+	}
+	if d.mode == CodeDedupGlobal {
+		return d.global
+	}
+	local := &codeCache{hashes: make(map[common.Hash]struct{})}
+	d.mu.Lock()
+	d.locals = append(d.locals, local)
+	d.mu.Unlock()
+	return local
+}
+
+// reconcile counts the code published by more than one worker, which is only possible with
+// worker-local caches
+func (d *codeDedup) reconcile() uint64 {
+	if d == nil || d.mode != CodeDedupLocal {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var duplicates uint64
+	seen := make(map[common.Hash]struct{})
+	for _, local := range d.locals {
+		for hash := range local.hashes {
+			if _, ok := seen[hash]; ok {
+				duplicates++
+				continue
+			}
+			seen[hash] = struct{}{}
+		}
+	}
+	if duplicates > 0 {
+		log.Infof("%d code entries were published by more than one worker", duplicates)
+	}
+	prom.AddDuplicateCodeCount(duplicates)
+	return duplicates
+}
+
+// add records the code hash, returning false if it was already recorded
+func (c *codeCache) add(hash common.Hash) bool {
+	if c == nil {
+		return true
+	}
+	if c.mu != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	}
+	if _, ok := c.hashes[hash]; ok {
+		return false
+	}
+	c.hashes[hash] = struct{}{}
+	return true
+}
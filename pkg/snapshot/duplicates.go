@@ -0,0 +1,89 @@
+package snapshot
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/prom"
+)
+
+const (
+	// maximum number of node paths tracked, about 8M entries or a few hundred MB; paths seen after
+	// this is reached are checked against those tracked but not added
+	maxTrackedPaths = 1 << 23
+	// maximum number of duplicates logged individually, later ones are only counted
+	maxLoggedDuplicates = 100
+)
+
+// duplicateDetector records the paths of the nodes published for a header, counting those
+// published more than once. Paths are recorded by a 64-bit hash, so a collision may rarely be
+// reported as a duplicate.
+// A nil *duplicateDetector detects nothing.
+type duplicateDetector struct {
+	mu    sync.Mutex
+	paths map[uint64]struct{}
+	full  bool
+	count uint64
+}
+
+func newDuplicateDetector(enabled bool) *duplicateDetector {
+	if !enabled {
+		return nil
+	}
+	return &duplicateDetector{paths: make(map[uint64]struct{})}
+}
+
+// check records the path of a state node, or of a storage node if statePath is non-nil, returning
+// false if it was already recorded
+func (d *duplicateDetector) check(headerID string, statePath, path []byte) bool {
+	if d == nil {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(headerID))
+	if statePath != nil {
+		// paths are nibbles, so 0xff separates the state path unambiguously
+		h.Write(statePath)
+		h.Write([]byte{0xff})
+	}
+	h.Write(path)
+	key := h.Sum64()
+
+	d.mu.Lock()
+	_, seen := d.paths[key]
+	if !seen && !d.full {
+		d.paths[key] = struct{}{}
+		if len(d.paths) >= maxTrackedPaths {
+			d.full = true
+			log.Warnf("tracked %d node paths, later paths are no longer checked for duplicates", maxTrackedPaths)
+		}
+	}
+	d.mu.Unlock()
+	if !seen {
+		return true
+	}
+
+	prom.IncDuplicateNodeCount()
+	if atomic.AddUint64(&d.count, 1) <= maxLoggedDuplicates {
+		fields := log.Fields{"header": headerID, "path": nibblesToHex(string(path))}
+		if statePath != nil {
+			fields["statePath"] = nibblesToHex(string(statePath))
+		}
+		log.WithFields(fields).Warn("node published more than once")
+	}
+	return false
+}
+
+func (d *duplicateDetector) logSummary() {
+	if d == nil {
+		return
+	}
+	if count := atomic.LoadUint64(&d.count); count > 0 {
+		log.Warnf("%d nodes were published more than once", count)
+	} else {
+		log.Info("no nodes were published more than once")
+	}
+}
@@ -22,8 +22,65 @@ const (
 	SNAPSHOT_RECOVERY_FILE = "SNAPSHOT_RECOVERY_FILE"
 	SNAPSHOT_MODE          = "SNAPSHOT_MODE"
 
+	SNAPSHOT_MANIFEST_FILE  = "SNAPSHOT_MANIFEST_FILE"
+	SNAPSHOT_PRIOR_MANIFEST = "SNAPSHOT_PRIOR_MANIFEST"
+	SNAPSHOT_SINCE_SNAPSHOT = "SNAPSHOT_SINCE_SNAPSHOT"
+	SNAPSHOT_MAX_MEMORY     = "SNAPSHOT_MAX_MEMORY"
+
+	SNAPSHOT_DECODED_OUTPUT_DIR      = "SNAPSHOT_DECODED_OUTPUT_DIR"
+	SNAPSHOT_STATS_FILE              = "SNAPSHOT_STATS_FILE"
+	SNAPSHOT_CODE_DEDUP              = "SNAPSHOT_CODE_DEDUP"
+	SNAPSHOT_NODE_ID                 = "SNAPSHOT_NODE_ID"
+	SNAPSHOT_STORAGE_ORDER           = "SNAPSHOT_STORAGE_ORDER"
+	SNAPSHOT_STORAGE_SUBTRIE_SPLIT   = "SNAPSHOT_STORAGE_SUBTRIE_SPLIT"
+	SNAPSHOT_STORAGE_SPLIT_THRESHOLD = "SNAPSHOT_STORAGE_SPLIT_THRESHOLD"
+	SNAPSHOT_AUTO_RESTART            = "SNAPSHOT_AUTO_RESTART"
+	SNAPSHOT_CHANGED_ACCOUNTS        = "SNAPSHOT_CHANGED_ACCOUNTS"
+	SNAPSHOT_PREIMAGES               = "SNAPSHOT_PREIMAGES"
+	SNAPSHOT_COMMIT_PER_ACCOUNT      = "SNAPSHOT_COMMIT_PER_ACCOUNT"
+	SNAPSHOT_STORAGE_STATE_KEYS      = "SNAPSHOT_STORAGE_STATE_KEYS"
+	SNAPSHOT_NODE_TYPE_NAMES         = "SNAPSHOT_NODE_TYPE_NAMES"
+	SNAPSHOT_MAX_BATCH_AGE           = "SNAPSHOT_MAX_BATCH_AGE"
+	SNAPSHOT_RECOVERY_PER_WORKER     = "SNAPSHOT_RECOVERY_PER_WORKER"
+	SNAPSHOT_FAIL_ON_EMPTY_RANGE     = "SNAPSHOT_FAIL_ON_EMPTY_RANGE"
+	SNAPSHOT_DETECT_DUPLICATES       = "SNAPSHOT_DETECT_DUPLICATES"
+	SNAPSHOT_SHARDED_STORAGE         = "SNAPSHOT_SHARDED_STORAGE"
+	SNAPSHOT_WEBHOOK_URL             = "SNAPSHOT_WEBHOOK_URL"
+	SNAPSHOT_WEBHOOK_EVENTS          = "SNAPSHOT_WEBHOOK_EVENTS"
+	SNAPSHOT_TIME_BUDGET             = "SNAPSHOT_TIME_BUDGET"
+	SNAPSHOT_STORAGE_ROOT_CACHE      = "SNAPSHOT_STORAGE_ROOT_CACHE"
+
+	EXPORT_ADDRESSES     = "EXPORT_ADDRESSES"
+	EXPORT_FORMAT        = "EXPORT_FORMAT"
+	EXPORT_RAW_SLOTS     = "EXPORT_RAW_SLOTS"
+	EXPORT_OUTPUT_FILE   = "EXPORT_OUTPUT_FILE"
+	EXPORT_WITH_BYTECODE = "EXPORT_WITH_BYTECODE"
+	EXPORT_CODE_DIR      = "EXPORT_CODE_DIR"
+
+	VERIFY_SAMPLE   = "VERIFY_SAMPLE"
+	VERIFY_IPFS_API = "VERIFY_IPFS_API"
+
+	COVERAGE_DEPTH = "COVERAGE_DEPTH"
+
+	REPLAY_MANIFEST  = "REPLAY_MANIFEST"
+	REPLAY_SOURCE_DB = "REPLAY_SOURCE_DB"
+	REPLAY_IPFS_API  = "REPLAY_IPFS_API"
+	REPLAY_HEADER_ID = "REPLAY_HEADER_ID"
+
+	CROSS_CHECK_RPC    = "CROSS_CHECK_RPC"
+	CROSS_CHECK_SAMPLE = "CROSS_CHECK_SAMPLE"
+
+	PROVE_ADDRESS     = "PROVE_ADDRESS"
+	PROVE_SLOTS       = "PROVE_SLOTS"
+	PROVE_FORMAT      = "PROVE_FORMAT"
+	PROVE_OUTPUT_FILE = "PROVE_OUTPUT_FILE"
+
+	STORAGE_SHARD_ACCOUNT  = "STORAGE_SHARD_ACCOUNT"
+	STORAGE_SHARD_PREFIXES = "STORAGE_SHARD_PREFIXES"
+
 	LOGRUS_LEVEL = "LOGRUS_LEVEL"
 	LOGRUS_FILE  = "LOGRUS_FILE"
+	LOG_MACHINE  = "LOG_MACHINE"
 
 	PROM_METRICS   = "PROM_METRICS"
 	PROM_HTTP      = "PROM_HTTP"
@@ -32,9 +89,18 @@ const (
 	PROM_DB_STATS  = "PROM_DB_STATS"
 
 	FILE_OUTPUT_DIR = "FILE_OUTPUT_DIR"
+	KV_OUTPUT_DIR   = "KV_OUTPUT_DIR"
 
-	ANCIENT_DB_PATH = "ANCIENT_DB_PATH"
-	LVL_DB_PATH     = "LVL_DB_PATH"
+	CLICKHOUSE_OUTPUT_DIR = "CLICKHOUSE_OUTPUT_DIR"
+	CLICKHOUSE_URL        = "CLICKHOUSE_URL"
+	CLICKHOUSE_DATABASE   = "CLICKHOUSE_DATABASE"
+	CLICKHOUSE_USER       = "CLICKHOUSE_USER"
+	CLICKHOUSE_PASSWORD   = "CLICKHOUSE_PASSWORD"
+	CLICKHOUSE_BATCH_ROWS = "CLICKHOUSE_BATCH_ROWS"
+
+	ANCIENT_DB_PATH       = "ANCIENT_DB_PATH"
+	ANCIENT_DB_CACHE_SIZE = "ANCIENT_DB_CACHE_SIZE"
+	LVL_DB_PATH           = "LVL_DB_PATH"
 
 	ETH_CLIENT_NAME   = "ETH_CLIENT_NAME"
 	ETH_GENESIS_BLOCK = "ETH_GENESIS_BLOCK"
@@ -42,6 +108,9 @@ const (
 	ETH_NODE_ID       = "ETH_NODE_ID"
 	ETH_CHAIN_ID      = "ETH_CHAIN_ID"
 
+	ETH_EMPTY_CODE_HASH = "ETH_EMPTY_CODE_HASH"
+	ETH_EMPTY_ROOT      = "ETH_EMPTY_ROOT"
+
 	DATABASE_NAME                 = "DATABASE_NAME"
 	DATABASE_HOSTNAME             = "DATABASE_HOSTNAME"
 	DATABASE_PORT                 = "DATABASE_PORT"
@@ -50,6 +119,16 @@ const (
 	DATABASE_MAX_IDLE_CONNECTIONS = "DATABASE_MAX_IDLE_CONNECTIONS"
 	DATABASE_MAX_OPEN_CONNECTIONS = "DATABASE_MAX_OPEN_CONNECTIONS"
 	DATABASE_MAX_CONN_LIFETIME    = "DATABASE_MAX_CONN_LIFETIME"
+	DATABASE_CONFLICT_MODE        = "DATABASE_CONFLICT_MODE"
+	DATABASE_BLOCK_COMPRESSION    = "DATABASE_BLOCK_COMPRESSION"
+	DATABASE_REQUIRE_SPACE        = "DATABASE_REQUIRE_SPACE"
+	DATABASE_SPACE_MARGIN         = "DATABASE_SPACE_MARGIN"
+	DATABASE_MAX_SIZE             = "DATABASE_MAX_SIZE"
+	DATABASE_EXPECTED_SIZE        = "DATABASE_EXPECTED_SIZE"
+
+	DATABASE_SHARDS         = "DATABASE_SHARDS"
+	DATABASE_SHARD_FUNCTION = "DATABASE_SHARD_FUNCTION"
+	DATABASE_SHARD_HEADERS  = "DATABASE_SHARD_HEADERS"
 )
 
 // TOML bindings
@@ -59,8 +138,65 @@ const (
 	SNAPSHOT_RECOVERY_FILE_TOML = "snapshot.recoveryFile"
 	SNAPSHOT_MODE_TOML          = "snapshot.mode"
 
+	SNAPSHOT_MANIFEST_FILE_TOML  = "snapshot.manifestFile"
+	SNAPSHOT_PRIOR_MANIFEST_TOML = "snapshot.priorManifest"
+	SNAPSHOT_SINCE_SNAPSHOT_TOML = "snapshot.sinceSnapshot"
+	SNAPSHOT_MAX_MEMORY_TOML     = "snapshot.maxMemory"
+
+	SNAPSHOT_DECODED_OUTPUT_DIR_TOML      = "snapshot.decodedOutputDir"
+	SNAPSHOT_STATS_FILE_TOML              = "snapshot.statsFile"
+	SNAPSHOT_CODE_DEDUP_TOML              = "snapshot.codeDedup"
+	SNAPSHOT_NODE_ID_TOML                 = "snapshot.nodeID"
+	SNAPSHOT_STORAGE_ORDER_TOML           = "snapshot.storageOrder"
+	SNAPSHOT_STORAGE_SUBTRIE_SPLIT_TOML   = "snapshot.storageSubtrieSplit"
+	SNAPSHOT_STORAGE_SPLIT_THRESHOLD_TOML = "snapshot.storageSplitThreshold"
+	SNAPSHOT_AUTO_RESTART_TOML            = "snapshot.autoRestart"
+	SNAPSHOT_CHANGED_ACCOUNTS_TOML        = "snapshot.changedAccounts"
+	SNAPSHOT_PREIMAGES_TOML               = "snapshot.preimages"
+	SNAPSHOT_COMMIT_PER_ACCOUNT_TOML      = "snapshot.commitPerAccount"
+	SNAPSHOT_STORAGE_STATE_KEYS_TOML      = "snapshot.storageStateKeys"
+	SNAPSHOT_NODE_TYPE_NAMES_TOML         = "snapshot.nodeTypeNames"
+	SNAPSHOT_MAX_BATCH_AGE_TOML           = "snapshot.maxBatchAge"
+	SNAPSHOT_RECOVERY_PER_WORKER_TOML     = "snapshot.recoveryPerWorker"
+	SNAPSHOT_FAIL_ON_EMPTY_RANGE_TOML     = "snapshot.failOnEmptyRange"
+	SNAPSHOT_DETECT_DUPLICATES_TOML       = "snapshot.detectDuplicates"
+	SNAPSHOT_SHARDED_STORAGE_TOML         = "snapshot.shardedStorage"
+	SNAPSHOT_WEBHOOK_URL_TOML             = "snapshot.webhookURL"
+	SNAPSHOT_WEBHOOK_EVENTS_TOML          = "snapshot.webhookEvents"
+	SNAPSHOT_TIME_BUDGET_TOML             = "snapshot.timeBudget"
+	SNAPSHOT_STORAGE_ROOT_CACHE_TOML      = "snapshot.storageRootCache"
+
+	EXPORT_ADDRESSES_TOML     = "export.addresses"
+	EXPORT_FORMAT_TOML        = "export.format"
+	EXPORT_RAW_SLOTS_TOML     = "export.rawSlots"
+	EXPORT_OUTPUT_FILE_TOML   = "export.outputFile"
+	EXPORT_WITH_BYTECODE_TOML = "export.withBytecode"
+	EXPORT_CODE_DIR_TOML      = "export.codeDir"
+
+	VERIFY_SAMPLE_TOML   = "verify.sample"
+	VERIFY_IPFS_API_TOML = "verify.ipfsAPI"
+
+	COVERAGE_DEPTH_TOML = "coverage.depth"
+
+	REPLAY_MANIFEST_TOML  = "replay.manifest"
+	REPLAY_SOURCE_DB_TOML = "replay.sourceDB"
+	REPLAY_IPFS_API_TOML  = "replay.ipfsAPI"
+	REPLAY_HEADER_ID_TOML = "replay.headerID"
+
+	CROSS_CHECK_RPC_TOML    = "crossCheck.rpc"
+	CROSS_CHECK_SAMPLE_TOML = "crossCheck.sample"
+
+	PROVE_ADDRESS_TOML     = "prove.address"
+	PROVE_SLOTS_TOML       = "prove.slots"
+	PROVE_FORMAT_TOML      = "prove.format"
+	PROVE_OUTPUT_FILE_TOML = "prove.outputFile"
+
+	STORAGE_SHARD_ACCOUNT_TOML  = "storageShard.account"
+	STORAGE_SHARD_PREFIXES_TOML = "storageShard.prefixes"
+
 	LOGRUS_LEVEL_TOML = "log.level"
 	LOGRUS_FILE_TOML  = "log.file"
+	LOG_MACHINE_TOML  = "log.machine"
 
 	PROM_METRICS_TOML   = "prom.metrics"
 	PROM_HTTP_TOML      = "prom.http"
@@ -69,9 +205,18 @@ const (
 	PROM_DB_STATS_TOML  = "prom.dbStats"
 
 	FILE_OUTPUT_DIR_TOML = "file.outputDir"
+	KV_OUTPUT_DIR_TOML   = "kv.outputDir"
 
-	ANCIENT_DB_PATH_TOML = "leveldb.ancient"
-	LVL_DB_PATH_TOML     = "leveldb.path"
+	CLICKHOUSE_OUTPUT_DIR_TOML = "clickhouse.outputDir"
+	CLICKHOUSE_URL_TOML        = "clickhouse.url"
+	CLICKHOUSE_DATABASE_TOML   = "clickhouse.database"
+	CLICKHOUSE_USER_TOML       = "clickhouse.user"
+	CLICKHOUSE_PASSWORD_TOML   = "clickhouse.password"
+	CLICKHOUSE_BATCH_ROWS_TOML = "clickhouse.batchRows"
+
+	ANCIENT_DB_PATH_TOML       = "leveldb.ancient"
+	ANCIENT_DB_CACHE_SIZE_TOML = "leveldb.ancientCacheSize"
+	LVL_DB_PATH_TOML           = "leveldb.path"
 
 	ETH_CLIENT_NAME_TOML   = "ethereum.clientName"
 	ETH_GENESIS_BLOCK_TOML = "ethereum.genesisBlock"
@@ -79,6 +224,9 @@ const (
 	ETH_NODE_ID_TOML       = "ethereum.nodeID"
 	ETH_CHAIN_ID_TOML      = "ethereum.chainID"
 
+	ETH_EMPTY_CODE_HASH_TOML = "ethereum.emptyCodeHash"
+	ETH_EMPTY_ROOT_TOML      = "ethereum.emptyRoot"
+
 	DATABASE_NAME_TOML                 = "database.name"
 	DATABASE_HOSTNAME_TOML             = "database.hostname"
 	DATABASE_PORT_TOML                 = "database.port"
@@ -87,6 +235,16 @@ const (
 	DATABASE_MAX_IDLE_CONNECTIONS_TOML = "database.maxIdle"
 	DATABASE_MAX_OPEN_CONNECTIONS_TOML = "database.maxOpen"
 	DATABASE_MAX_CONN_LIFETIME_TOML    = "database.maxLifetime"
+	DATABASE_CONFLICT_MODE_TOML        = "database.conflictMode"
+	DATABASE_BLOCK_COMPRESSION_TOML    = "database.blockCompression"
+	DATABASE_REQUIRE_SPACE_TOML        = "database.requireSpace"
+	DATABASE_SPACE_MARGIN_TOML         = "database.spaceMargin"
+	DATABASE_MAX_SIZE_TOML             = "database.maxSize"
+	DATABASE_EXPECTED_SIZE_TOML        = "database.expectedSize"
+
+	DATABASE_SHARDS_TOML         = "database.shards"
+	DATABASE_SHARD_FUNCTION_TOML = "database.shardFunction"
+	DATABASE_SHARD_HEADERS_TOML  = "database.shardHeaders"
 )
 
 // CLI flags
@@ -96,8 +254,65 @@ const (
 	SNAPSHOT_RECOVERY_FILE_CLI = "recovery-file"
 	SNAPSHOT_MODE_CLI          = "snapshot-mode"
 
+	SNAPSHOT_MANIFEST_FILE_CLI  = "manifest-file"
+	SNAPSHOT_PRIOR_MANIFEST_CLI = "prior-manifest"
+	SNAPSHOT_SINCE_SNAPSHOT_CLI = "since-snapshot"
+	SNAPSHOT_MAX_MEMORY_CLI     = "max-memory"
+
+	SNAPSHOT_DECODED_OUTPUT_DIR_CLI      = "decoded-output-dir"
+	SNAPSHOT_STATS_FILE_CLI              = "stats-file"
+	SNAPSHOT_CODE_DEDUP_CLI              = "code-dedup"
+	SNAPSHOT_NODE_ID_CLI                 = "node-id"
+	SNAPSHOT_STORAGE_ORDER_CLI           = "storage-order"
+	SNAPSHOT_STORAGE_SUBTRIE_SPLIT_CLI   = "storage-subtrie-split"
+	SNAPSHOT_STORAGE_SPLIT_THRESHOLD_CLI = "storage-split-threshold"
+	SNAPSHOT_AUTO_RESTART_CLI            = "auto-restart"
+	SNAPSHOT_CHANGED_ACCOUNTS_CLI        = "changed-accounts"
+	SNAPSHOT_PREIMAGES_CLI               = "preimages"
+	SNAPSHOT_COMMIT_PER_ACCOUNT_CLI      = "commit-per-account"
+	SNAPSHOT_STORAGE_STATE_KEYS_CLI      = "storage-state-keys"
+	SNAPSHOT_NODE_TYPE_NAMES_CLI         = "node-type-names"
+	SNAPSHOT_MAX_BATCH_AGE_CLI           = "max-batch-age"
+	SNAPSHOT_RECOVERY_PER_WORKER_CLI     = "recovery-per-worker"
+	SNAPSHOT_FAIL_ON_EMPTY_RANGE_CLI     = "fail-on-empty-range"
+	SNAPSHOT_DETECT_DUPLICATES_CLI       = "detect-duplicates"
+	SNAPSHOT_SHARDED_STORAGE_CLI         = "sharded-storage"
+	SNAPSHOT_WEBHOOK_URL_CLI             = "webhook-url"
+	SNAPSHOT_WEBHOOK_EVENTS_CLI          = "webhook-events"
+	SNAPSHOT_TIME_BUDGET_CLI             = "time-budget"
+	SNAPSHOT_STORAGE_ROOT_CACHE_CLI      = "storage-root-cache"
+
+	EXPORT_ADDRESSES_CLI     = "addresses"
+	EXPORT_FORMAT_CLI        = "format"
+	EXPORT_RAW_SLOTS_CLI     = "raw-slots"
+	EXPORT_OUTPUT_FILE_CLI   = "output-file"
+	EXPORT_WITH_BYTECODE_CLI = "with-bytecode"
+	EXPORT_CODE_DIR_CLI      = "code-dir"
+
+	VERIFY_SAMPLE_CLI   = "sample"
+	VERIFY_IPFS_API_CLI = "ipfs-api"
+
+	COVERAGE_DEPTH_CLI = "depth"
+
+	REPLAY_MANIFEST_CLI  = "manifest"
+	REPLAY_SOURCE_DB_CLI = "source-db"
+	REPLAY_IPFS_API_CLI  = "ipfs-api"
+	REPLAY_HEADER_ID_CLI = "header-id"
+
+	CROSS_CHECK_RPC_CLI    = "rpc"
+	CROSS_CHECK_SAMPLE_CLI = "sample"
+
+	PROVE_ADDRESS_CLI     = "address"
+	PROVE_SLOTS_CLI       = "slots"
+	PROVE_FORMAT_CLI      = "format"
+	PROVE_OUTPUT_FILE_CLI = "output-file"
+
+	STORAGE_SHARD_ACCOUNT_CLI  = "account"
+	STORAGE_SHARD_PREFIXES_CLI = "prefixes"
+
 	LOGRUS_LEVEL_CLI = "log-level"
 	LOGRUS_FILE_CLI  = "log-file"
+	LOG_MACHINE_CLI  = "machine-logs"
 
 	PROM_METRICS_CLI   = "prom-metrics"
 	PROM_HTTP_CLI      = "prom-http"
@@ -106,9 +321,16 @@ const (
 	PROM_DB_STATS_CLI  = "prom-dbStats"
 
 	FILE_OUTPUT_DIR_CLI = "output-dir"
+	KV_OUTPUT_DIR_CLI   = "kv-output-dir"
+
+	CLICKHOUSE_OUTPUT_DIR_CLI = "clickhouse-output-dir"
+	CLICKHOUSE_URL_CLI        = "clickhouse-url"
+	CLICKHOUSE_DATABASE_CLI   = "clickhouse-database"
+	CLICKHOUSE_BATCH_ROWS_CLI = "clickhouse-batch-rows"
 
-	ANCIENT_DB_PATH_CLI = "ancient-path"
-	LVL_DB_PATH_CLI     = "leveldb-path"
+	ANCIENT_DB_PATH_CLI       = "ancient-path"
+	ANCIENT_DB_CACHE_SIZE_CLI = "ancient-cache-size"
+	LVL_DB_PATH_CLI           = "leveldb-path"
 
 	ETH_CLIENT_NAME_CLI   = "ethereum-client-name"
 	ETH_GENESIS_BLOCK_CLI = "ethereum-genesis-block"
@@ -116,6 +338,9 @@ const (
 	ETH_NODE_ID_CLI       = "ethereum-node-id"
 	ETH_CHAIN_ID_CLI      = "ethereum-chain-id"
 
+	ETH_EMPTY_CODE_HASH_CLI = "ethereum-empty-code-hash"
+	ETH_EMPTY_ROOT_CLI      = "ethereum-empty-root"
+
 	DATABASE_NAME_CLI                 = "database-name"
 	DATABASE_HOSTNAME_CLI             = "database-hostname"
 	DATABASE_PORT_CLI                 = "database-port"
@@ -124,4 +349,14 @@ const (
 	DATABASE_MAX_IDLE_CONNECTIONS_CLI = "database-max-idle"
 	DATABASE_MAX_OPEN_CONNECTIONS_CLI = "database-max-open"
 	DATABASE_MAX_CONN_LIFETIME_CLI    = "database-max-lifetime"
+	DATABASE_CONFLICT_MODE_CLI        = "database-conflict-mode"
+	DATABASE_BLOCK_COMPRESSION_CLI    = "database-block-compression"
+	DATABASE_REQUIRE_SPACE_CLI        = "require-space"
+	DATABASE_SPACE_MARGIN_CLI         = "space-margin"
+	DATABASE_MAX_SIZE_CLI             = "database-max-size"
+	DATABASE_EXPECTED_SIZE_CLI        = "expected-snapshot-size"
+
+	DATABASE_SHARDS_CLI         = "database-shards"
+	DATABASE_SHARD_FUNCTION_CLI = "database-shard-function"
+	DATABASE_SHARD_HEADERS_CLI  = "database-shard-headers"
 )
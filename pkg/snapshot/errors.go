@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/trie"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// Errors returned by the snapshot service, wrapped with the details of the failure
+var (
+	// ErrMissingHeader is returned when a header, or data associated with it, is not in the database
+	ErrMissingHeader = errors.New("missing header")
+	// ErrMissingCode is returned when an account's code is not in the database
+	ErrMissingCode = errors.New("missing code")
+	// ErrMissingTrieNode is returned when a state or storage trie node is not in the database
+	ErrMissingTrieNode = errors.New("missing trie node")
+	// ErrUnexpectedNodeType is returned when a trie node can't be decoded as a branch, extension or leaf
+	ErrUnexpectedNodeType = errors.New("unexpected node type")
+	// ErrRecoveryMismatch is returned when the recovery file can't be resumed with the given parameters
+	ErrRecoveryMismatch = errors.New("recovery file does not match parameters")
+	// ErrBlockMismatch is returned when a replayed block is missing from the source or doesn't hash to its CID
+	ErrBlockMismatch = errors.New("block does not match manifest")
+	// ErrEmptyRange is returned when the split of the state trie leaves a worker no nodes, and empty ranges
+	// are not allowed
+	ErrEmptyRange = errors.New("empty worker range")
+	// ErrTimeBudgetReached is returned when the snapshot stops at its time budget. The published nodes are
+	// committed and the snapshot can be resumed from the recovery file.
+	ErrTimeBudgetReached = errors.New("time budget reached")
+)
+
+// IsFatal reports whether an error is caused by the data or configuration, rather than a transient
+// failure of the database or output, so that retrying the snapshot can't succeed
+func IsFatal(err error) bool {
+	for _, fatal := range []error{
+		ErrMissingHeader, ErrMissingCode, ErrMissingTrieNode, ErrUnexpectedNodeType, ErrRecoveryMismatch, ErrEmptyRange,
+	} {
+		if errors.Is(err, fatal) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapTrieError identifies the errors of trie iteration caused by missing nodes
+func wrapTrieError(err error) error {
+	var missing *trie.MissingNodeError
+	if errors.As(err, &missing) {
+		return fmt.Errorf("%w: %v", ErrMissingTrieNode, err)
+	}
+	return err
+}
+
+// nodeTypeName names a node type for error messages
+func nodeTypeName(t fmt.Stringer) string {
+	if name := t.String(); name != "unknown" {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", t)
+}
+
+// wrapStateError adds the type and path of a state node and the header it was published for to an error
+// publishing it
+func wrapStateError(err error, node *Node, headerID string) error {
+	return fmt.Errorf("failed publishing %s state node at path %x for header %s: %w",
+		nodeTypeName(node.NodeType), node.Path, headerID, err)
+}
+
+// wrapStorageError adds the type and path of a storage node, the path of the account owning it and the
+// header it was published for to an error publishing it
+func wrapStorageError(err error, node *Node, headerID string, statePath []byte) error {
+	return fmt.Errorf("failed publishing %s storage node at path %x of account at path %x for header %s: %w",
+		nodeTypeName(node.NodeType), node.Path, statePath, headerID, err)
+}
@@ -0,0 +1,164 @@
+package snapshot
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// ExportFormat specifies the output format of exported storage slots
+type ExportFormat string
+
+const (
+	ExportCSV  ExportFormat = "csv"
+	ExportJSON ExportFormat = "json"
+)
+
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch format := ExportFormat(s); format {
+	case ExportCSV, ExportJSON:
+		return format, nil
+	case "":
+		return ExportCSV, nil
+	}
+	return "", fmt.Errorf("invalid export format: %s", s)
+}
+
+// StorageSlot is a decoded storage leaf of an account
+type StorageSlot struct {
+	Address common.Address
+	// SlotHash is the hashed slot key, the storage trie key
+	SlotHash common.Hash
+	// Slot is the preimage of the slot hash, nil if it isn't known
+	Slot  []byte
+	Value common.Hash
+}
+
+// ExportStorage walks the storage tries of the given accounts at a height, calling fn with each slot
+func (s *Service) ExportStorage(height uint64, addresses []common.Address, fn func(StorageSlot) error) error {
+	header, err := s.readHeader(height)
+	if err != nil {
+		return err
+	}
+	tree, err := s.stateDB.OpenTrie(header.Root)
+	if err != nil {
+		return wrapTrieError(err)
+	}
+	for _, addr := range addresses {
+		enc, err := tree.TryGet(addr.Bytes())
+		if err != nil {
+			return wrapTrieError(err)
+		}
+		if len(enc) == 0 {
+			log.Warnf("account %s does not exist at height %d", addr.Hex(), height)
+			continue
+		}
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(enc, &account); err != nil {
+			return fmt.Errorf("error decoding account %s: %w", addr.Hex(), err)
+		}
+		if err = s.walkStorageLeaves(addr, account.Root, fn); err != nil {
+			return fmt.Errorf("failed exporting storage for account %s: %w", addr.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// walkStorageLeaves calls fn with the decoded slot of each leaf of a storage trie
+func (s *Service) walkStorageLeaves(addr common.Address, sr common.Hash, fn func(StorageSlot) error) error {
+	if sr == s.emptyRoot {
+		return nil
+	}
+	sTrie, err := s.stateDB.OpenTrie(sr)
+	if err != nil {
+		return wrapTrieError(err)
+	}
+	it := sTrie.NodeIterator(nil)
+	for it.Next(true) {
+		res, err := resolveNode(it, s.stateDB.TrieDB())
+		if err != nil {
+			return err
+		}
+		if res == nil {
+			continue
+		}
+		putNodeBuffer(res.node.Value)
+		if res.node.NodeType != Leaf {
+			continue
+		}
+		slot := StorageSlot{Address: addr, SlotHash: res.leafKey()}
+		var value []byte
+		if err = rlp.DecodeBytes(res.elements[1].([]byte), &value); err != nil {
+			return fmt.Errorf("error decoding storage value for leaf node at path %x: %w", res.node.Path, err)
+		}
+		slot.Value = common.BytesToHash(value)
+		slot.Slot = sTrie.GetKey(slot.SlotHash.Bytes())
+		if err = fn(slot); err != nil {
+			return err
+		}
+	}
+	return wrapTrieError(it.Error())
+}
+
+// StorageExportWriter writes exported storage slots as CSV or newline-delimited JSON
+type StorageExportWriter struct {
+	format   ExportFormat
+	rawSlots bool
+	csv      *csv.Writer
+	json     *json.Encoder
+}
+
+type exportedSlot struct {
+	Address string `json:"address"`
+	Slot    string `json:"slot"`
+	Value   string `json:"value"`
+}
+
+// NewStorageExportWriter creates a writer of storage slots. If rawSlots is set, the slot preimages are
+// written in place of the hashed slot keys.
+func NewStorageExportWriter(out io.Writer, format ExportFormat, rawSlots bool) (*StorageExportWriter, error) {
+	w := &StorageExportWriter{format: format, rawSlots: rawSlots}
+	switch format {
+	case ExportCSV:
+		w.csv = csv.NewWriter(out)
+		if err := w.csv.Write([]string{"address", "slot", "value"}); err != nil {
+			return nil, err
+		}
+	case ExportJSON:
+		w.json = json.NewEncoder(out)
+	default:
+		return nil, fmt.Errorf("invalid export format: %s", format)
+	}
+	return w, nil
+}
+
+func (w *StorageExportWriter) Write(slot StorageSlot) error {
+	key := slot.SlotHash.Hex()
+	if w.rawSlots {
+		if slot.Slot == nil {
+			return fmt.Errorf("no preimage known for slot %s of account %s", key, slot.Address.Hex())
+		}
+		key = common.BytesToHash(slot.Slot).Hex()
+	}
+	row := exportedSlot{slot.Address.Hex(), key, slot.Value.Hex()}
+	if w.format == ExportJSON {
+		return w.json.Encode(row)
+	}
+	return w.csv.Write([]string{row.Address, row.Slot, row.Value})
+}
+
+func (w *StorageExportWriter) Flush() error {
+	if w.csv == nil {
+		return nil
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
@@ -18,6 +18,7 @@ package publisher
 import (
 	"encoding/csv"
 	"fmt"
+	"math/big"
 	"os"
 	"path/filepath"
 	"sync/atomic"
@@ -52,6 +53,7 @@ var (
 		&snapt.TableIPLDBlock,
 		&snapt.TableStateNode,
 		&snapt.TableStorageNode,
+		&snapt.TableKeyPreimage,
 	}
 )
 
@@ -61,14 +63,22 @@ type publisher struct {
 	dir     string // dir containing output files
 	writers fileWriters
 
-	nodeInfo nodeinfo.Info
-
-	startTime          time.Time
-	currBatchSize      uint
-	stateNodeCounter   uint64
-	storageNodeCounter uint64
-	codeNodeCounter    uint64
-	txCounter          uint32
+	nodeInfo  nodeinfo.Info
+	prior     snapt.CIDSet
+	manifest  *snapt.ManifestWriter
+	statsFile string
+	// whether storage rows also record the leaf key of their account
+	storageStateKeys bool
+	// whether node rows also record the name of their node type
+	nodeTypeNames bool
+
+	startTime           time.Time
+	currBatchSize       uint
+	stateNodeCounter    uint64
+	storageNodeCounter  uint64
+	codeNodeCounter     uint64
+	skippedBlockCounter uint64
+	txCounter           uint32
 }
 
 type fileWriter struct {
@@ -78,7 +88,17 @@ type fileWriter struct {
 // fileWriters wraps the file writers for each output table
 type fileWriters map[string]fileWriter
 
-type fileTx struct{ fileWriters }
+type fileTx struct {
+	fileWriters
+	manifest *snapt.ManifestBatch
+}
+
+func (tx fileTx) Commit() error {
+	if err := tx.fileWriters.Commit(); err != nil {
+		return err
+	}
+	return tx.manifest.Flush()
+}
 
 func (tx fileWriters) Commit() error {
 	for _, w := range tx {
@@ -141,6 +161,30 @@ func NewPublisher(path string, node nodeinfo.Info) (*publisher, error) {
 	return pub, nil
 }
 
+// SetManifests sets the CIDs published by a prior snapshot, whose blocks are not written again,
+// and the manifest recording the nodes published by this one. Either may be nil.
+func (p *publisher) SetManifests(prior snapt.CIDSet, manifest *snapt.ManifestWriter) {
+	p.prior = prior
+	p.manifest = manifest
+}
+
+// SetStorageStateKeys sets whether storage rows also record the leaf key of their account, in the
+// state_leaf_key column
+func (p *publisher) SetStorageStateKeys(enabled bool) {
+	p.storageStateKeys = enabled
+}
+
+// SetNodeTypeNames sets whether node rows also record the name of their node type, in the
+// node_type_name column
+func (p *publisher) SetNodeTypeNames(enabled bool) {
+	p.nodeTypeNames = enabled
+}
+
+// SetStatsFile sets a file to which the current stats are written each time they are logged
+func (p *publisher) SetStatsFile(path string) {
+	p.statsFile = path
+}
+
 func TableFile(dir, name string) string { return filepath.Join(dir, name+".csv") }
 
 func (p *publisher) txDir(index uint32) string {
@@ -155,17 +199,23 @@ func (p *publisher) BeginTx() (snapt.Tx, error) {
 		return nil, err
 	}
 
-	return fileTx{writers}, nil
+	return fileTx{writers, p.manifest.NewBatch()}, nil
 }
 
 // PublishRaw derives a cid from raw bytes and provided codec and multihash type, and writes it to the db tx
+// unless the block is known from the prior manifest
 // returns the CID and blockstore prefixed multihash key
-func (tx fileWriters) publishRaw(codec uint64, raw []byte) (cid, prefixedKey string, err error) {
+func (p *publisher) publishRaw(tx fileTx, codec uint64, raw []byte) (cid, prefixedKey string, err error) {
 	c, err := ipld.RawdataToCid(codec, raw, multihash.KECCAK_256)
 	if err != nil {
 		return
 	}
 	cid = c.String()
+	if p.prior.Has(cid) {
+		atomic.AddUint64(&p.skippedBlockCounter, 1)
+		prom.IncSkippedBlockCount()
+		return cid, shared.MultihashKeyFromCID(c), nil
+	}
 	prefixedKey, err = tx.publishIPLD(c, raw)
 	return
 }
@@ -178,7 +228,7 @@ func (tx fileWriters) publishIPLD(c cid.Cid, raw []byte) (string, error) {
 
 // PublishHeader writes the header to the ipfs backing pg datastore and adds secondary
 // indexes in the header_cids table
-func (p *publisher) PublishHeader(header *types.Header) error {
+func (p *publisher) PublishHeader(header *types.Header, td, reward *big.Int) error {
 	headerNode, err := ipld.NewEthHeader(header)
 	if err != nil {
 		return err
@@ -194,7 +244,7 @@ func (p *publisher) PublishHeader(header *types.Header) error {
 		return err
 	}
 	err = p.writers.write(&snapt.TableHeader, header.Number.String(), header.Hash().Hex(), header.ParentHash.Hex(),
-		headerNode.Cid().String(), 0, p.nodeInfo.ID, 0, header.Root.Hex(), header.TxHash.Hex(),
+		headerNode.Cid().String(), td, p.nodeInfo.ID, reward, header.Root.Hex(), header.TxHash.Hex(),
 		header.ReceiptHash.Hex(), header.UncleHash.Hex(), header.Bloom.Bytes(), header.Time, mhKey,
 		0, header.Coinbase.String())
 	if err != nil {
@@ -212,16 +262,33 @@ func (p *publisher) PublishStateNode(node *snapt.Node, headerID string, snapTx s
 	}
 
 	tx := snapTx.(fileTx)
-	stateCIDStr, mhKey, err := tx.publishRaw(ipld.MEthStateTrie, node.Value)
+	stateCIDStr, mhKey, err := p.publishRaw(tx, ipld.MEthStateTrie, node.Value)
 	if err != nil {
 		return err
 	}
 
-	err = tx.write(&snapt.TableStateNode, headerID, stateKey, stateCIDStr, node.Path,
-		node.NodeType, false, mhKey)
+	tbl, args := snapt.TableStateNode, []interface{}{
+		headerID, stateKey, stateCIDStr, node.Path, node.NodeType, node.Diff, mhKey}
+	if p.nodeTypeNames {
+		tbl, args = tbl.WithNodeTypeName(), append(args, node.NodeType.String())
+	}
+	err = tx.write(&tbl, args...)
 	if err != nil {
 		return err
 	}
+	if node.Preimage != nil {
+		if err = tx.write(&snapt.TableKeyPreimage, stateKey, node.Preimage); err != nil {
+			return err
+		}
+	}
+	tx.manifest.Add(snapt.ManifestEntry{
+		Kind:     snapt.StateManifestKind,
+		CID:      stateCIDStr,
+		MhKey:    mhKey,
+		Path:     node.Path,
+		NodeType: node.NodeType,
+		LeafKey:  stateKey,
+	})
 	// increment state node counter.
 	atomic.AddUint64(&p.stateNodeCounter, 1)
 	prom.IncStateNodeCount()
@@ -240,16 +307,37 @@ func (p *publisher) PublishStorageNode(node *snapt.Node, headerID string, stateP
 	}
 
 	tx := snapTx.(fileTx)
-	storageCIDStr, mhKey, err := tx.publishRaw(ipld.MEthStorageTrie, node.Value)
+	storageCIDStr, mhKey, err := p.publishRaw(tx, ipld.MEthStorageTrie, node.Value)
 	if err != nil {
 		return err
 	}
 
-	err = tx.write(&snapt.TableStorageNode, headerID, statePath, storageKey, storageCIDStr, node.Path,
-		node.NodeType, false, mhKey)
+	tbl, args := snapt.TableStorageNode, []interface{}{
+		headerID, statePath, storageKey, storageCIDStr, node.Path, node.NodeType, node.Diff, mhKey}
+	if p.storageStateKeys {
+		tbl, args = snapt.TableStorageNodeWithStateKey, append(args, node.StateKey.Hex())
+	}
+	if p.nodeTypeNames {
+		tbl, args = tbl.WithNodeTypeName(), append(args, node.NodeType.String())
+	}
+	err = tx.write(&tbl, args...)
 	if err != nil {
 		return err
 	}
+	if node.Preimage != nil {
+		if err = tx.write(&snapt.TableKeyPreimage, storageKey, node.Preimage); err != nil {
+			return err
+		}
+	}
+	tx.manifest.Add(snapt.ManifestEntry{
+		Kind:      snapt.StorageManifestKind,
+		CID:       storageCIDStr,
+		MhKey:     mhKey,
+		StatePath: statePath,
+		Path:      node.Path,
+		NodeType:  node.NodeType,
+		LeafKey:   storageKey,
+	})
 	// increment storage node counter.
 	atomic.AddUint64(&p.storageNodeCounter, 1)
 	prom.IncStorageNodeCount()
@@ -292,10 +380,25 @@ func (p *publisher) logNodeCounters() {
 }
 
 func (p *publisher) printNodeCounters(msg string) {
-	logrus.WithFields(logrus.Fields{
-		"runtime":       time.Now().Sub(p.startTime).String(),
-		"state nodes":   atomic.LoadUint64(&p.stateNodeCounter),
-		"storage nodes": atomic.LoadUint64(&p.storageNodeCounter),
-		"code nodes":    atomic.LoadUint64(&p.codeNodeCounter),
-	}).Info(msg)
+	stats := p.Stats()
+	snapt.LogEvent(msg, stats.LogFields()...)
+	if p.statsFile != "" {
+		if err := snapt.WriteStatsFile(p.statsFile, stats); err != nil {
+			logrus.Errorf("failed to write stats file: %v", err)
+		}
+	}
+}
+
+// Stats returns the current node counts
+func (p *publisher) Stats() snapt.Stats {
+	now := time.Now()
+	return snapt.Stats{
+		StartTime:     p.startTime,
+		UpdatedAt:     now,
+		Runtime:       now.Sub(p.startTime).String(),
+		StateNodes:    atomic.LoadUint64(&p.stateNodeCounter),
+		StorageNodes:  atomic.LoadUint64(&p.storageNodeCounter),
+		CodeNodes:     atomic.LoadUint64(&p.codeNodeCounter),
+		SkippedBlocks: atomic.LoadUint64(&p.skippedBlockCounter),
+	}
 }
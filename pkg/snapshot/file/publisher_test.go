@@ -5,6 +5,7 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"math/big"
 	"os"
 	"path/filepath"
 	"testing"
@@ -33,7 +34,7 @@ var (
 func writeFiles(t *testing.T, dir string) *publisher {
 	pub, err := NewPublisher(dir, nodeInfo)
 	test.NoError(t, err)
-	test.NoError(t, pub.PublishHeader(&fixt.Block1_Header))
+	test.NoError(t, pub.PublishHeader(&fixt.Block1_Header, big.NewInt(1), big.NewInt(0)))
 	tx, err := pub.BeginTx()
 	test.NoError(t, err)
 
@@ -79,6 +80,72 @@ func TestWriting(t *testing.T) {
 	}
 }
 
+func countRows(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	test.NoError(t, err)
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	test.NoError(t, err)
+	return len(rows)
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifestPath := filepath.Join(dir, "manifest.csv")
+	manifest, err := snapt.NewManifestWriter(manifestPath)
+	test.NoError(t, err)
+	defer manifest.Close()
+
+	first, err := NewPublisher(filepath.Join(dir, "first"), nodeInfo)
+	test.NoError(t, err)
+	first.SetManifests(nil, manifest)
+	headerID := fixt.Block1_Header.Hash().String()
+	tx, err := first.BeginTx()
+	test.NoError(t, err)
+	test.NoError(t, first.PublishStateNode(&fixt.Block1_StateNode0, headerID, tx))
+	test.NoError(t, tx.Commit())
+	test.ExpectEqual(t, 1, countRows(t, manifestPath))
+
+	prior, err := snapt.LoadManifest(manifestPath)
+	test.NoError(t, err)
+	test.ExpectEqual(t, 1, len(prior))
+
+	second, err := NewPublisher(filepath.Join(dir, "second"), nodeInfo)
+	test.NoError(t, err)
+	second.SetManifests(prior, nil)
+	tx, err = second.BeginTx()
+	test.NoError(t, err)
+	test.NoError(t, second.PublishStateNode(&fixt.Block1_StateNode0, headerID, tx))
+	test.NoError(t, tx.Commit())
+
+	// the index row is written, but not the block
+	test.ExpectEqual(t, uint64(1), second.skippedBlockCounter)
+	test.ExpectEqual(t, 0, countRows(t, TableFile(second.txDir(0), snapt.TableIPLDBlock.Name)))
+	test.ExpectEqual(t, 1, countRows(t, TableFile(second.txDir(0), snapt.TableStateNode.Name)))
+}
+
+func TestNodeTypeNames(t *testing.T) {
+	dir := t.TempDir()
+	pub, err := NewPublisher(dir, nodeInfo)
+	test.NoError(t, err)
+	pub.SetNodeTypeNames(true)
+	headerID := fixt.Block1_Header.Hash().String()
+	tx, err := pub.BeginTx()
+	test.NoError(t, err)
+	test.NoError(t, pub.PublishStateNode(&fixt.Block1_StateNode0, headerID, tx))
+	test.NoError(t, tx.Commit())
+
+	file, err := os.Open(TableFile(pub.txDir(0), snapt.TableStateNode.Name))
+	test.NoError(t, err)
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	test.NoError(t, err)
+	test.ExpectEqual(t, 1, len(rows))
+	// the name is written after the integer columns
+	test.ExpectEqual(t, len(snapt.TableStateNode.Columns)+1, len(rows[0]))
+	test.ExpectEqual(t, fixt.Block1_StateNode0.NodeType.String(), rows[0][len(rows[0])-1])
+}
+
 // Note: DB user requires role membership "pg_read_server_files"
 func TestPgCopy(t *testing.T) {
 	test.NeedsDB(t)
@@ -0,0 +1,195 @@
+package snapshot
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// flushCoordinator pauses the running workers at a flush request, so their transactions can be
+// committed and the recovery state dumped at a consistent point.
+type flushCoordinator struct {
+	flushing  sync.Mutex // serializes flush requests
+	requested int32
+
+	mu      sync.Mutex
+	members map[*flushMember]struct{}
+	nextID  uint64
+	req     *flushRequest
+}
+
+// flushMember identifies a registered worker. A request only waits on the members registered
+// when it was made, so workers starting during a flush don't join it.
+type flushMember struct {
+	id uint64
+}
+
+type flushRequest struct {
+	pending map[*flushMember]struct{} // members yet to commit
+	err     error
+	done    chan struct{} // closed once all members have committed
+	release chan struct{} // closed once the recovery state is dumped
+}
+
+func (c *flushCoordinator) register() *flushMember {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.add()
+}
+
+func (c *flushCoordinator) add() *flushMember {
+	if c.members == nil {
+		c.members = make(map[*flushMember]struct{})
+	}
+	m := &flushMember{id: c.nextID}
+	c.nextID++
+	c.members[m] = struct{}{}
+	return m
+}
+
+// unregister removes a finished worker, which no pending request needs to wait for
+func (c *flushCoordinator) unregister(m *flushMember) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.members, m)
+	if c.req != nil {
+		c.req.ack(m, nil)
+	}
+}
+
+// handOff replaces a worker by n members, which take over its place in any pending request.
+// The worker's transaction must be committed beforehand.
+func (c *flushCoordinator) handOff(m *flushMember, n int) []*flushMember {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.members, m)
+	joined := false
+	if c.req != nil {
+		_, joined = c.req.pending[m]
+		delete(c.req.pending, m)
+	}
+	ms := make([]*flushMember, n)
+	for i := range ms {
+		ms[i] = c.add()
+		if joined {
+			c.req.pending[ms[i]] = struct{}{}
+		}
+	}
+	return ms
+}
+
+// takeBack returns a worker's membership once the members it was handed off to have unregistered.
+// It joins no pending request, as the worker has nothing left uncommitted from before it.
+func (c *flushCoordinator) takeBack(m *flushMember) {
+	if m == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.members[m] = struct{}{}
+}
+
+// ack records that a member has committed; acks of non-members are ignored
+func (r *flushRequest) ack(m *flushMember, err error) {
+	if _, ok := r.pending[m]; !ok {
+		return
+	}
+	delete(r.pending, m)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	if len(r.pending) == 0 {
+		close(r.done)
+	}
+}
+
+// Flush commits the current transactions of all running workers and writes the recovery file,
+// returning once both are durable. Workers are paused until it returns.
+// It does nothing if no snapshot is running.
+func (s *Service) Flush(ctx context.Context) error {
+	c := &s.flusher
+	c.flushing.Lock()
+	defer c.flushing.Unlock()
+
+	c.mu.Lock()
+	if len(c.members) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	req := &flushRequest{
+		pending: make(map[*flushMember]struct{}, len(c.members)),
+		done:    make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	for m := range c.members {
+		req.pending[m] = struct{}{}
+	}
+	c.req = req
+	atomic.StoreInt32(&c.requested, 1)
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.req = nil
+		atomic.StoreInt32(&c.requested, 0)
+		c.mu.Unlock()
+		close(req.release)
+	}()
+
+	select {
+	case <-req.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	err := req.err
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.trackerMu.Lock()
+	defer s.trackerMu.Unlock()
+	return s.tracker.checkpoint()
+}
+
+// checkpoint commits the member's transaction if a flush waiting on it is requested, and waits for
+// the flush to complete
+func (s *Service) checkpoint(m *flushMember, tx Tx) (Tx, error) {
+	c := &s.flusher
+	if atomic.LoadInt32(&c.requested) == 0 {
+		return tx, nil
+	}
+	c.mu.Lock()
+	req := c.req
+	member := false
+	if req != nil {
+		_, member = req.pending[m]
+	}
+	c.mu.Unlock()
+	if !member {
+		return tx, nil
+	}
+
+	next, err := s.commitTx(tx)
+	c.mu.Lock()
+	req.ack(m, err)
+	c.mu.Unlock()
+	<-req.release
+	if err != nil {
+		// the deferred rollback of the committed transaction is harmless
+		return tx, err
+	}
+	return next, nil
+}
+
+// commitTx commits a worker's transaction and begins the next one without the per-worker setup of
+// BeginTx, which the worker already made.
+// PrepareTxForBatch can't be used, as in file mode it doesn't commit.
+func (s *Service) commitTx(tx Tx) (Tx, error) {
+	if err := tx.Commit(); err != nil {
+		return tx, err
+	}
+	return BeginBatchTx(s.ipfsPublisher)
+}
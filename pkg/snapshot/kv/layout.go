@@ -0,0 +1,103 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kv
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ipfs/go-cid"
+
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// Key prefixes of the store. Index entries are RLP encoded.
+var (
+	blockPrefix    = []byte("b") // blockPrefix + multihash -> block data
+	headerPrefix   = []byte("h") // headerPrefix + number (uint64 big endian) + hash -> HeaderEntry
+	statePrefix    = []byte("s") // statePrefix + header hash + path -> NodeEntry
+	storagePrefix  = []byte("t") // storagePrefix + header hash + state leaf key + path -> NodeEntry
+	preimagePrefix = []byte("p") // preimagePrefix + leaf key -> preimage
+)
+
+// HeaderEntry indexes a published header
+type HeaderEntry struct {
+	CID    []byte
+	TD     *big.Int
+	Reward *big.Int
+	NodeID string
+}
+
+// NodeEntry indexes a published state or storage node
+type NodeEntry struct {
+	NodeType uint64
+	// LeafKey is empty for branch and extension nodes
+	LeafKey []byte
+	CID     []byte
+	Diff    bool
+}
+
+func newNodeEntry(node *snapt.Node, c cid.Cid) NodeEntry {
+	entry := NodeEntry{NodeType: uint64(node.NodeType), CID: c.Bytes(), Diff: node.Diff}
+	if !snapt.IsNullHash(node.Key) {
+		entry.LeafKey = node.Key.Bytes()
+	}
+	return entry
+}
+
+func leafKeyHex(node *snapt.Node) string {
+	if snapt.IsNullHash(node.Key) {
+		return ""
+	}
+	return node.Key.Hex()
+}
+
+func concat(parts ...[]byte) []byte {
+	var ret []byte
+	for _, part := range parts {
+		ret = append(ret, part...)
+	}
+	return ret
+}
+
+// BlockKey is the key of the block with a multihash
+func BlockKey(mh []byte) []byte {
+	return concat(blockPrefix, mh)
+}
+
+// HeaderKey is the key of the entry of a header. Headers are ordered by height.
+func HeaderKey(number uint64, hash common.Hash) []byte {
+	var enc [8]byte
+	binary.BigEndian.PutUint64(enc[:], number)
+	return concat(headerPrefix, enc[:], hash.Bytes())
+}
+
+// StateKey is the key of the entry of the state node of a header at a path. Path is in nibbles, one per
+// byte, so the nodes under a path prefix are contiguous.
+func StateKey(header common.Hash, path []byte) []byte {
+	return concat(statePrefix, header.Bytes(), path)
+}
+
+// StorageKey is the key of the entry of the storage node at a path of the account with a leaf key
+func StorageKey(header, stateLeafKey common.Hash, path []byte) []byte {
+	return concat(storagePrefix, header.Bytes(), stateLeafKey.Bytes(), path)
+}
+
+// PreimageKey is the key of the preimage of a leaf key
+func PreimageKey(leafKey common.Hash) []byte {
+	return concat(preimagePrefix, leafKey.Bytes())
+}
@@ -0,0 +1,294 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kv
+
+import (
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/statediff/indexer/ipld"
+	nodeinfo "github.com/ethereum/go-ethereum/statediff/indexer/node"
+	"github.com/ethereum/go-ethereum/statediff/indexer/shared"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/sirupsen/logrus"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/prom"
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+var _ snapt.Publisher = (*publisher)(nil)
+var _ snapt.StatsReporter = (*publisher)(nil)
+
+const logInterval = 1 * time.Minute
+
+type publisher struct {
+	db       ethdb.KeyValueStore
+	nodeInfo nodeinfo.Info
+
+	prior     snapt.CIDSet
+	manifest  *snapt.ManifestWriter
+	statsFile string
+
+	startTime           time.Time
+	currBatchSize       uint
+	stateNodeCounter    uint64
+	storageNodeCounter  uint64
+	codeNodeCounter     uint64
+	skippedBlockCounter uint64
+}
+
+type kvTx struct {
+	ethdb.Batch
+	manifest *snapt.ManifestBatch
+}
+
+func (tx kvTx) Commit() error {
+	if err := tx.Batch.Write(); err != nil {
+		return err
+	}
+	return tx.manifest.Flush()
+}
+
+func (tx kvTx) Rollback() error {
+	tx.Batch.Reset()
+	return nil
+}
+
+// NewPublisher creates a publisher which writes blocks and their index entries to a key-value store,
+// in the layout described by the key functions of this package
+func NewPublisher(db ethdb.KeyValueStore, node nodeinfo.Info) *publisher {
+	pub := &publisher{
+		db:        db,
+		nodeInfo:  node,
+		startTime: time.Now(),
+	}
+	go pub.logNodeCounters()
+	return pub
+}
+
+// NewLevelDBPublisher creates a publisher writing to a LevelDB database in dir, which is created if it
+// does not exist
+func NewLevelDBPublisher(dir string, node nodeinfo.Info) (*publisher, error) {
+	db, err := rawdb.NewLevelDBDatabase(dir, 256, 256, "snapshot/kv", false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open key-value store at %s: %w", dir, err)
+	}
+	return NewPublisher(db, node), nil
+}
+
+// SetManifests sets the CIDs published by a prior snapshot, whose blocks are not written again,
+// and the manifest recording the nodes published by this one. Either may be nil.
+func (p *publisher) SetManifests(prior snapt.CIDSet, manifest *snapt.ManifestWriter) {
+	p.prior = prior
+	p.manifest = manifest
+}
+
+// SetStatsFile sets a file to which the current stats are written each time they are logged
+func (p *publisher) SetStatsFile(path string) {
+	p.statsFile = path
+}
+
+// Close logs the final stats and closes the store
+func (p *publisher) Close() error {
+	p.printNodeCounters("final stats")
+	return p.db.Close()
+}
+
+func (p *publisher) BeginTx() (snapt.Tx, error) {
+	return kvTx{p.db.NewBatch(), p.manifest.NewBatch()}, nil
+}
+
+// publishRaw derives a cid from raw bytes and provided codec, and writes the block to the batch
+// unless it is known from the prior manifest
+func (p *publisher) publishRaw(tx ethdb.KeyValueWriter, codec uint64, raw []byte) (cid.Cid, error) {
+	c, err := ipld.RawdataToCid(codec, raw, multihash.KECCAK_256)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	if p.prior.Has(c.String()) {
+		atomic.AddUint64(&p.skippedBlockCounter, 1)
+		prom.IncSkippedBlockCount()
+		return c, nil
+	}
+	return c, tx.Put(BlockKey(c.Hash()), raw)
+}
+
+// putEntry writes the RLP encoding of an index entry
+func putEntry(tx ethdb.KeyValueWriter, key []byte, entry interface{}) error {
+	enc, err := rlp.EncodeToBytes(entry)
+	if err != nil {
+		return err
+	}
+	return tx.Put(key, enc)
+}
+
+// PublishHeader writes the header block and its index entry
+func (p *publisher) PublishHeader(header *types.Header, td, reward *big.Int) error {
+	headerNode, err := ipld.NewEthHeader(header)
+	if err != nil {
+		return err
+	}
+	batch := p.db.NewBatch()
+	if err = batch.Put(BlockKey(headerNode.Cid().Hash()), headerNode.RawData()); err != nil {
+		return err
+	}
+	entry := HeaderEntry{
+		CID:    headerNode.Cid().Bytes(),
+		TD:     td,
+		Reward: reward,
+		NodeID: p.nodeInfo.ID,
+	}
+	if err = putEntry(batch, HeaderKey(header.Number.Uint64(), header.Hash()), &entry); err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// PublishStateNode writes the state node block and its index entry
+func (p *publisher) PublishStateNode(node *snapt.Node, headerID string, snapTx snapt.Tx) error {
+	tx := snapTx.(kvTx)
+	c, err := p.publishRaw(tx, ipld.MEthStateTrie, node.Value)
+	if err != nil {
+		return err
+	}
+	entry := newNodeEntry(node, c)
+	if err = putEntry(tx, StateKey(common.HexToHash(headerID), node.Path), &entry); err != nil {
+		return err
+	}
+	if err = p.publishPreimage(tx, node); err != nil {
+		return err
+	}
+	tx.manifest.Add(snapt.ManifestEntry{
+		Kind:     snapt.StateManifestKind,
+		CID:      c.String(),
+		MhKey:    shared.MultihashKeyFromCID(c),
+		Path:     node.Path,
+		NodeType: node.NodeType,
+		LeafKey:  leafKeyHex(node),
+	})
+	atomic.AddUint64(&p.stateNodeCounter, 1)
+	prom.IncStateNodeCount()
+
+	p.currBatchSize += 2
+	return nil
+}
+
+// PublishStorageNode writes the storage node block and its index entry, keyed by the leaf key of the
+// owning account
+func (p *publisher) PublishStorageNode(node *snapt.Node, headerID string, statePath []byte, snapTx snapt.Tx) error {
+	tx := snapTx.(kvTx)
+	c, err := p.publishRaw(tx, ipld.MEthStorageTrie, node.Value)
+	if err != nil {
+		return err
+	}
+	entry := newNodeEntry(node, c)
+	if err = putEntry(tx, StorageKey(common.HexToHash(headerID), node.StateKey, node.Path), &entry); err != nil {
+		return err
+	}
+	if err = p.publishPreimage(tx, node); err != nil {
+		return err
+	}
+	tx.manifest.Add(snapt.ManifestEntry{
+		Kind:      snapt.StorageManifestKind,
+		CID:       c.String(),
+		MhKey:     shared.MultihashKeyFromCID(c),
+		StatePath: statePath,
+		Path:      node.Path,
+		NodeType:  node.NodeType,
+		LeafKey:   leafKeyHex(node),
+	})
+	atomic.AddUint64(&p.storageNodeCounter, 1)
+	prom.IncStorageNodeCount()
+
+	p.currBatchSize += 2
+	return nil
+}
+
+func (p *publisher) publishPreimage(tx ethdb.KeyValueWriter, node *snapt.Node) error {
+	if node.Preimage == nil {
+		return nil
+	}
+	return tx.Put(PreimageKey(node.Key), node.Preimage)
+}
+
+// PublishCode writes the code block, keyed by the multihash of the code hash
+func (p *publisher) PublishCode(codeHash common.Hash, codeBytes []byte, snapTx snapt.Tx) error {
+	mh, err := multihash.Encode(codeHash.Bytes(), multihash.KECCAK_256)
+	if err != nil {
+		return fmt.Errorf("error deriving multihash from codehash: %v", err)
+	}
+	tx := snapTx.(kvTx)
+	if err = tx.Put(BlockKey(mh), codeBytes); err != nil {
+		return fmt.Errorf("error publishing code IPLD: %v", err)
+	}
+	atomic.AddUint64(&p.codeNodeCounter, 1)
+	prom.IncCodeNodeCount()
+
+	p.currBatchSize++
+	return nil
+}
+
+// PrepareTxForBatch writes the batch and starts a new one once it reaches the maximum size
+func (p *publisher) PrepareTxForBatch(tx snapt.Tx, maxBatchSize uint) (snapt.Tx, error) {
+	if maxBatchSize <= p.currBatchSize {
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		p.currBatchSize = 0
+		return p.BeginTx()
+	}
+	return tx, nil
+}
+
+// logNodeCounters periodically logs the number of node processed.
+func (p *publisher) logNodeCounters() {
+	t := time.NewTicker(logInterval)
+	for range t.C {
+		p.printNodeCounters("progress")
+	}
+}
+
+func (p *publisher) printNodeCounters(msg string) {
+	stats := p.Stats()
+	snapt.LogEvent(msg, stats.LogFields()...)
+	if p.statsFile != "" {
+		if err := snapt.WriteStatsFile(p.statsFile, stats); err != nil {
+			logrus.Errorf("failed to write stats file: %v", err)
+		}
+	}
+}
+
+// Stats returns the current node counts
+func (p *publisher) Stats() snapt.Stats {
+	now := time.Now()
+	return snapt.Stats{
+		StartTime:     p.startTime,
+		UpdatedAt:     now,
+		Runtime:       now.Sub(p.startTime).String(),
+		StateNodes:    atomic.LoadUint64(&p.stateNodeCounter),
+		StorageNodes:  atomic.LoadUint64(&p.storageNodeCounter),
+		CodeNodes:     atomic.LoadUint64(&p.codeNodeCounter),
+		SkippedBlocks: atomic.LoadUint64(&p.skippedBlockCounter),
+	}
+}
@@ -0,0 +1,72 @@
+package kv
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/statediff/indexer/ipld"
+	"github.com/multiformats/go-multihash"
+
+	fixt "github.com/vulcanize/ipld-eth-state-snapshot/fixture"
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+	"github.com/vulcanize/ipld-eth-state-snapshot/test"
+)
+
+func TestWriting(t *testing.T) {
+	db := memorydb.New()
+	pub := NewPublisher(db, test.DefaultNodeInfo)
+	test.NoError(t, pub.PublishHeader(&fixt.Block1_Header, big.NewInt(1), big.NewInt(0)))
+
+	header := fixt.Block1_Header.Hash()
+	tx, err := pub.BeginTx()
+	test.NoError(t, err)
+	test.NoError(t, pub.PublishStateNode(&fixt.Block1_StateNode0, header.String(), tx))
+	storageNode := fixt.Block1_StateNode0
+	storageNode.StateKey = common.Hash{1}
+	test.NoError(t, pub.PublishStorageNode(&storageNode, header.String(), []byte{1}, tx))
+
+	// nothing is written until the batch is committed
+	reader := NewReader(db)
+	c, err := ipld.RawdataToCid(ipld.MEthStateTrie, fixt.Block1_StateNode0.Value, multihash.KECCAK_256)
+	test.NoError(t, err)
+	block, err := reader.Block(c)
+	test.NoError(t, err)
+	if block != nil {
+		t.Fatal("expected block to be absent before commit")
+	}
+	test.NoError(t, tx.Commit())
+
+	block, err = reader.Block(c)
+	test.NoError(t, err)
+	test.ExpectEqual(t, fixt.Block1_StateNode0.Value, block)
+
+	var paths [][]byte
+	err = reader.StateNodes(header, []byte{12}, func(path []byte, entry NodeEntry) error {
+		paths = append(paths, path)
+		test.ExpectEqual(t, c.Bytes(), entry.CID)
+		return nil
+	})
+	test.NoError(t, err)
+	test.ExpectEqual(t, [][]byte{fixt.Block1_StateNode0.Path}, paths)
+
+	var storageCount int
+	err = reader.StorageNodes(header, common.Hash{1}, nil, func(path []byte, entry NodeEntry) error {
+		storageCount++
+		test.ExpectEqual(t, uint64(snapt.Branch), entry.NodeType)
+		return nil
+	})
+	test.NoError(t, err)
+	test.ExpectEqual(t, 1, storageCount)
+}
+
+func TestRollback(t *testing.T) {
+	db := memorydb.New()
+	pub := NewPublisher(db, test.DefaultNodeInfo)
+	tx, err := pub.BeginTx()
+	test.NoError(t, err)
+	test.NoError(t, pub.PublishStateNode(&fixt.Block1_StateNode0, fixt.Block1_Header.Hash().String(), tx))
+	test.NoError(t, tx.Rollback())
+	test.ExpectEqual(t, 0, db.Len())
+}
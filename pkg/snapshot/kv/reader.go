@@ -0,0 +1,71 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kv
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ipfs/go-cid"
+)
+
+// Reader reads the blocks and index entries written by the publisher
+type Reader struct {
+	db ethdb.KeyValueReader
+	it ethdb.Iteratee
+}
+
+// NewReader creates a reader of a store written by the publisher
+func NewReader(db ethdb.KeyValueStore) *Reader {
+	return &Reader{db, db}
+}
+
+// Block returns the block with a CID, or nil if it is absent
+func (r *Reader) Block(c cid.Cid) ([]byte, error) {
+	key := BlockKey(c.Hash())
+	if has, err := r.db.Has(key); err != nil || !has {
+		return nil, err
+	}
+	return r.db.Get(key)
+}
+
+// StateNodes calls fn with the path and entry of each state node of a header under a path prefix, in
+// path order
+func (r *Reader) StateNodes(header common.Hash, prefix []byte, fn func(path []byte, entry NodeEntry) error) error {
+	return r.nodes(StateKey(header, nil), prefix, fn)
+}
+
+// StorageNodes calls fn with the path and entry of each storage node of an account under a path prefix,
+// in path order
+func (r *Reader) StorageNodes(header, stateLeafKey common.Hash, prefix []byte, fn func(path []byte, entry NodeEntry) error) error {
+	return r.nodes(StorageKey(header, stateLeafKey, nil), prefix, fn)
+}
+
+func (r *Reader) nodes(base, prefix []byte, fn func([]byte, NodeEntry) error) error {
+	it := r.it.NewIterator(concat(base, prefix), nil)
+	defer it.Release()
+	for it.Next() {
+		var entry NodeEntry
+		if err := rlp.DecodeBytes(it.Value(), &entry); err != nil {
+			return err
+		}
+		path := common.CopyBytes(it.Key()[len(base):])
+		if err := fn(path, entry); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
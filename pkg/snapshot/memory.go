@@ -0,0 +1,100 @@
+package snapshot
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	memoryCheckInterval = 500 * time.Millisecond
+	// maximum time a worker pauses waiting for memory to be freed
+	maxThrottleWait = 30 * time.Second
+)
+
+// nodeBufferPool recycles the buffers holding node values once they are published
+var nodeBufferPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+func getNodeBuffer(src []byte) []byte {
+	buf := nodeBufferPool.Get().(*[]byte)
+	return append((*buf)[:0], src...)
+}
+
+func putNodeBuffer(buf []byte) {
+	buf = buf[:0]
+	nodeBufferPool.Put(&buf)
+}
+
+// memoryLimiter tracks whether heap usage exceeds a soft cap.
+// A nil *memoryLimiter is never exceeded.
+type memoryLimiter struct {
+	max      uint64
+	exceeded int32
+	disabled int32
+	quit     chan struct{}
+}
+
+func newMemoryLimiter(max uint64) *memoryLimiter {
+	if max == 0 {
+		return nil
+	}
+	l := &memoryLimiter{max: max, quit: make(chan struct{})}
+	go l.watch()
+	return l
+}
+
+func (l *memoryLimiter) watch() {
+	t := time.NewTicker(memoryCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.check()
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+func (l *memoryLimiter) check() bool {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	if stats.HeapInuse > l.max {
+		atomic.StoreInt32(&l.exceeded, 1)
+		return true
+	}
+	atomic.StoreInt32(&l.exceeded, 0)
+	return false
+}
+
+func (l *memoryLimiter) Exceeded() bool {
+	return l != nil && atomic.LoadInt32(&l.disabled) == 0 && atomic.LoadInt32(&l.exceeded) == 1
+}
+
+// wait blocks until heap usage falls below the cap. If it does not within maxThrottleWait,
+// the cap is too low to be met, so it is disabled for the rest of the run.
+func (l *memoryLimiter) wait() {
+	debug.FreeOSMemory()
+	deadline := time.Now().Add(maxThrottleWait)
+	for l.check() {
+		if time.Now().After(deadline) {
+			if atomic.CompareAndSwapInt32(&l.disabled, 0, 1) {
+				log.Warnf("unable to reduce heap usage below max memory (%d bytes), disabling cap", l.max)
+			}
+			return
+		}
+		time.Sleep(memoryCheckInterval)
+	}
+}
+
+func (l *memoryLimiter) stop() {
+	if l != nil {
+		close(l.quit)
+	}
+}
@@ -0,0 +1,123 @@
+package mock
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// FaultInjector wraps a publisher to make chosen calls fail, for exercising error handling
+// and recovery in tests.
+type FaultInjector struct {
+	snapt.Publisher
+
+	mu         sync.Mutex
+	stateNodes int
+	commits    int
+	faults     map[faultKey]error
+}
+
+type faultOp int
+
+const (
+	faultStateNode faultOp = iota
+	faultCommit
+)
+
+type faultKey struct {
+	op faultOp
+	n  int
+}
+
+type faultTx struct {
+	snapt.Tx
+	injector *FaultInjector
+}
+
+// NewFaultInjector wraps the publisher, passing calls through until a fault is set
+func NewFaultInjector(pub snapt.Publisher) *FaultInjector {
+	return &FaultInjector{
+		Publisher: pub,
+		faults:    map[faultKey]error{},
+	}
+}
+
+// FailStateNode makes the nth (starting at 1) call to PublishStateNode return err
+func (f *FaultInjector) FailStateNode(n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[faultKey{faultStateNode, n}] = err
+}
+
+// FailCommit makes the nth (starting at 1) call to Commit on a transaction return err, without committing.
+// Batches committed within PrepareTxForBatch are not counted.
+func (f *FaultInjector) FailCommit(n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[faultKey{faultCommit, n}] = err
+}
+
+// next counts a call and returns the fault set for it, if any
+func (f *FaultInjector) next(op faultOp) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int
+	switch op {
+	case faultStateNode:
+		f.stateNodes++
+		n = f.stateNodes
+	case faultCommit:
+		f.commits++
+		n = f.commits
+	}
+	return f.faults[faultKey{op, n}]
+}
+
+func (f *FaultInjector) wrap(tx snapt.Tx) snapt.Tx {
+	if tx == nil {
+		return nil
+	}
+	return faultTx{tx, f}
+}
+
+func unwrap(tx snapt.Tx) snapt.Tx {
+	if ftx, ok := tx.(faultTx); ok {
+		return ftx.Tx
+	}
+	return tx
+}
+
+func (tx faultTx) Commit() error {
+	if err := tx.injector.next(faultCommit); err != nil {
+		tx.Tx.Rollback()
+		return err
+	}
+	return tx.Tx.Commit()
+}
+
+func (f *FaultInjector) PublishStateNode(node *snapt.Node, headerID string, tx snapt.Tx) error {
+	if err := f.next(faultStateNode); err != nil {
+		return err
+	}
+	return f.Publisher.PublishStateNode(node, headerID, unwrap(tx))
+}
+
+func (f *FaultInjector) PublishStorageNode(node *snapt.Node, headerID string, statePath []byte, tx snapt.Tx) error {
+	return f.Publisher.PublishStorageNode(node, headerID, statePath, unwrap(tx))
+}
+
+func (f *FaultInjector) PublishCode(codeHash common.Hash, codeBytes []byte, tx snapt.Tx) error {
+	return f.Publisher.PublishCode(codeHash, codeBytes, unwrap(tx))
+}
+
+func (f *FaultInjector) BeginTx() (snapt.Tx, error) {
+	tx, err := f.Publisher.BeginTx()
+	return f.wrap(tx), err
+}
+
+func (f *FaultInjector) PrepareTxForBatch(tx snapt.Tx, batchSize uint) (snapt.Tx, error) {
+	next, err := f.Publisher.PrepareTxForBatch(unwrap(tx), batchSize)
+	return f.wrap(next), err
+}
@@ -0,0 +1,46 @@
+package pg
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// number of lookups of blocks in a base snapshot whose answers are cached
+const baseCacheSize = 100000
+
+// baseSnapshot looks up whether blocks are referenced by the state or storage rows of the headers of a
+// base snapshot in the database. Answers are cached, as blocks are repeated, e.g. by identical storage tries.
+// A nil baseSnapshot holds no blocks.
+type baseSnapshot struct {
+	db        *postgres.DB
+	headerIDs []string
+	cache     *lru.Cache
+}
+
+func newBaseSnapshot(db *postgres.DB, headerIDs []string) (*baseSnapshot, error) {
+	cache, err := lru.New(baseCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &baseSnapshot{db: db, headerIDs: headerIDs, cache: cache}, nil
+}
+
+// has reports whether a block is referenced by the base snapshot's rows
+func (b *baseSnapshot) has(ctx context.Context, cid string) (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+	if known, ok := b.cache.Get(cid); ok {
+		return known.(bool), nil
+	}
+	var known []bool
+	err := b.db.Select(ctx, &known, `SELECT EXISTS (SELECT 1 FROM eth.state_cids WHERE header_id = ANY($1) AND cid = $2)
+		OR EXISTS (SELECT 1 FROM eth.storage_cids WHERE header_id = ANY($1) AND cid = $2)`, b.headerIDs, cid)
+	if err != nil || len(known) == 0 {
+		return false, err
+	}
+	b.cache.Add(cid, known[0])
+	return known[0], nil
+}
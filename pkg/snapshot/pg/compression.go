@@ -0,0 +1,52 @@
+package pg
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+// Codec specifies how IPLD block data is compressed in the blocks table
+type Codec string
+
+const (
+	// CodecNone stores blocks uncompressed
+	CodecNone Codec = "none"
+	// CodecSnappy stores blocks compressed with snappy, where it makes them smaller
+	CodecSnappy Codec = "snappy"
+)
+
+func ParseCodec(s string) (Codec, error) {
+	switch codec := Codec(s); codec {
+	case CodecNone, CodecSnappy:
+		return codec, nil
+	case "":
+		return CodecNone, nil
+	}
+	return "", fmt.Errorf("invalid block compression codec: %s", s)
+}
+
+// compressBlock compresses block data with a codec, returning the data to store and the codec to record
+// with it. Blocks which the codec doesn't make smaller are stored uncompressed, with a nil codec.
+func compressBlock(codec Codec, raw []byte) ([]byte, *string) {
+	if codec != CodecSnappy {
+		return raw, nil
+	}
+	compressed := snappy.Encode(nil, raw)
+	if len(compressed) >= len(raw) {
+		return raw, nil
+	}
+	name := string(codec)
+	return compressed, &name
+}
+
+// DecompressBlock returns the data of a block stored with a codec, or stored uncompressed if codec is empty
+func DecompressBlock(codec string, data []byte) ([]byte, error) {
+	switch Codec(codec) {
+	case "", CodecNone:
+		return data, nil
+	case CodecSnappy:
+		return snappy.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("unknown block compression codec: %s", codec)
+}
@@ -0,0 +1,44 @@
+package pg
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+
+	fixt "github.com/vulcanize/ipld-eth-state-snapshot/fixture"
+	"github.com/vulcanize/ipld-eth-state-snapshot/test"
+)
+
+func TestBlockCompression(t *testing.T) {
+	compressible := bytes.Repeat([]byte{0x60, 0x80, 0x60, 0x40}, 256)
+	data, codec := compressBlock(CodecSnappy, compressible)
+	if codec == nil || *codec != string(CodecSnappy) {
+		t.Fatalf("expected block to be compressed, got codec %v", codec)
+	}
+	if len(data) >= len(compressible) {
+		t.Errorf("expected compressed block to be smaller, got %d bytes from %d", len(data), len(compressible))
+	}
+	decompressed, err := DecompressBlock(*codec, data)
+	test.NoError(t, err)
+	test.ExpectEqual(t, compressible, decompressed)
+
+	// a hash doesn't compress, so is stored as is
+	hash := crypto.Keccak256([]byte("incompressible"))
+	data, codec = compressBlock(CodecSnappy, hash)
+	if codec != nil {
+		t.Errorf("expected incompressible block to be stored uncompressed, got codec %s", *codec)
+	}
+	test.ExpectEqual(t, hash, data)
+
+	// compression is off by default
+	data, codec = compressBlock(CodecNone, fixt.Block1_StateNode0.Value)
+	if codec != nil {
+		t.Errorf("expected no codec, got %s", *codec)
+	}
+	test.ExpectEqual(t, fixt.Block1_StateNode0.Value, data)
+
+	if _, err = DecompressBlock("zstd", data); err == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pg
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+)
+
+type prefixCount struct {
+	Prefix []byte `db:"prefix"`
+	Count  int64  `db:"count"`
+}
+
+// StatePrefixCounts counts the state nodes of a header under each path prefix of depth nibbles.
+// Nodes at paths shorter than the depth are not counted. The counts are keyed by the prefix nibbles.
+func StatePrefixCounts(ctx context.Context, db *postgres.DB, headerID string, depth int) (map[string]int64, error) {
+	var rows []prefixCount
+	err := db.Select(ctx, &rows, `SELECT substring(state_path FROM 1 FOR $2) AS prefix, COUNT(*) AS count
+		FROM eth.state_cids WHERE header_id = $1 AND length(state_path) >= $2
+		GROUP BY prefix`, headerID, depth)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		ret[string(row.Prefix)] = row.Count
+	}
+	return ret, nil
+}
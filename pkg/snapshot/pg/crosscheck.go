@@ -0,0 +1,36 @@
+package pg
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// StateLeaf is a published state leaf row
+type StateLeaf struct {
+	LeafKey string `db:"state_leaf_key"`
+	CID     string `db:"cid"`
+	MhKey   string `db:"mh_key"`
+	Path    []byte `db:"state_path"`
+}
+
+// StateRootCID returns the CID of the root node published for a header, or "" if there is none
+func StateRootCID(ctx context.Context, db *postgres.DB, headerID string) (string, error) {
+	var cids []string
+	err := db.Select(ctx, &cids, `SELECT cid FROM eth.state_cids
+		WHERE header_id = $1 AND (state_path = '\x'::BYTEA OR state_path IS NULL)`, headerID)
+	if err != nil || len(cids) == 0 {
+		return "", err
+	}
+	return cids[0], nil
+}
+
+// SampleStateLeaves returns up to n state leaves published for a header, chosen at random
+func SampleStateLeaves(ctx context.Context, db *postgres.DB, headerID string, n int) ([]StateLeaf, error) {
+	var leaves []StateLeaf
+	err := db.Select(ctx, &leaves, `SELECT state_leaf_key, cid, mh_key, state_path FROM eth.state_cids
+		WHERE header_id = $1 AND node_type = $2 ORDER BY random() LIMIT $3`, headerID, int(snapt.Leaf), n)
+	return leaves, err
+}
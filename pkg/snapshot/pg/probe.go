@@ -0,0 +1,50 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pg
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// ProbeWriteLatency measures the median time taken to write a block in a transaction, over n samples.
+// The transactions are rolled back, so nothing is written.
+func ProbeWriteLatency(ctx context.Context, db *postgres.DB, n int) (time.Duration, error) {
+	samples := make([]time.Duration, 0, n)
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(ctx, snapt.TableIPLDBlock.ToInsertStatement(), "/blocks/latency-probe", []byte{})
+		rberr := tx.Rollback(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if rberr != nil {
+			return 0, rberr
+		}
+		samples = append(samples, time.Since(start))
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[n/2], nil
+}
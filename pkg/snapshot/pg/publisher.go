@@ -18,6 +18,7 @@ package pg
 import (
 	"context"
 	"fmt"
+	"math/big"
 	"sync/atomic"
 	"time"
 
@@ -38,17 +39,29 @@ import (
 )
 
 var _ snapt.Publisher = (*publisher)(nil)
+var _ snapt.StateNodeCounter = (*publisher)(nil)
+var _ snapt.BatchTxBeginner = (*publisher)(nil)
+var _ snapt.StatsReporter = (*publisher)(nil)
 
 const logInterval = 1 * time.Minute
 
 // Publisher is wrapper around DB.
 type publisher struct {
-	db                 *postgres.DB
-	currBatchSize      uint
-	stateNodeCounter   uint64
-	storageNodeCounter uint64
-	codeNodeCounter    uint64
-	startTime          time.Time
+	db                  *postgres.DB
+	conflictMode        snapt.ConflictMode
+	prior               snapt.CIDSet
+	base                *baseSnapshot
+	manifest            *snapt.ManifestWriter
+	statsFile           string
+	storageStateKeys    bool
+	nodeTypeNames       bool
+	codec               Codec
+	currBatchSize       uint
+	stateNodeCounter    uint64
+	storageNodeCounter  uint64
+	codeNodeCounter     uint64
+	skippedBlockCounter uint64
+	startTime           time.Time
 }
 
 // NewPublisher creates Publisher
@@ -59,9 +72,58 @@ func NewPublisher(db *postgres.DB) *publisher {
 	}
 }
 
+// SetConflictMode sets how header, state and storage node rows which already exist are handled.
+// IPLD blocks are content-addressed, so existing blocks are always kept.
+func (p *publisher) SetConflictMode(mode snapt.ConflictMode) {
+	p.conflictMode = mode
+}
+
+// SetManifests sets the CIDs published by a prior snapshot, whose blocks are not written again,
+// and the manifest recording the nodes published by this one. Either may be nil.
+func (p *publisher) SetManifests(prior snapt.CIDSet, manifest *snapt.ManifestWriter) {
+	p.prior = prior
+	p.manifest = manifest
+}
+
+// SetBaseSnapshot sets the headers of a snapshot in the database whose blocks are not written again.
+// Each block is looked up among the state and storage rows of the headers before it is written.
+func (p *publisher) SetBaseSnapshot(headerIDs []string) error {
+	base, err := newBaseSnapshot(p.db, headerIDs)
+	if err != nil {
+		return err
+	}
+	p.base = base
+	return nil
+}
+
+// SetStorageStateKeys sets whether storage rows also record the leaf key of their account, in the
+// state_leaf_key column
+func (p *publisher) SetStorageStateKeys(enabled bool) {
+	p.storageStateKeys = enabled
+}
+
+// SetNodeTypeNames sets whether node rows also record the name of their node type, in the
+// node_type_name column
+func (p *publisher) SetNodeTypeNames(enabled bool) {
+	p.nodeTypeNames = enabled
+}
+
+// SetBlockCompression sets the codec IPLD blocks are compressed with, recorded in the codec column of
+// the blocks table. CodecNone writes blocks without the column.
+func (p *publisher) SetBlockCompression(codec Codec) {
+	p.codec = codec
+}
+
+// SetStatsFile sets a file to which the current stats are written each time they are logged
+func (p *publisher) SetStatsFile(path string) {
+	p.statsFile = path
+}
+
 type pubTx struct {
 	sql.Tx
 	callback func()
+	manifest *snapt.ManifestBatch
+	codec    Codec
 }
 
 func (tx pubTx) Rollback() error { return tx.Tx.Rollback(context.Background()) }
@@ -69,7 +131,10 @@ func (tx pubTx) Commit() error {
 	if tx.callback != nil {
 		defer tx.callback()
 	}
-	return tx.Tx.Commit(context.Background())
+	if err := tx.Tx.Commit(context.Background()); err != nil {
+		return err
+	}
+	return tx.manifest.Flush()
 }
 func (tx pubTx) Exec(sql string, args ...interface{}) (sql.Result, error) {
 	return tx.Tx.Exec(context.Background(), sql, args...)
@@ -81,19 +146,43 @@ func (p *publisher) BeginTx() (snapt.Tx, error) {
 		return nil, err
 	}
 	go p.logNodeCounters()
-	return pubTx{tx, func() {
-		p.printNodeCounters("final stats")
-	}}, nil
+	return pubTx{
+		Tx:       tx,
+		callback: func() { p.printNodeCounters("final stats") },
+		manifest: p.manifest.NewBatch(),
+		codec:    p.codec,
+	}, nil
+}
+
+// BeginBatchTx begins a transaction without starting the progress logging or the final stats of BeginTx
+func (p *publisher) BeginBatchTx() (snapt.Tx, error) {
+	tx, err := p.db.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return pubTx{Tx: tx, manifest: p.manifest.NewBatch(), codec: p.codec}, nil
 }
 
 // PublishRaw derives a cid from raw bytes and provided codec and multihash type, and writes it to the db tx
+// unless the block is known from the prior manifest or the base snapshot
 // returns the CID and blockstore prefixed multihash key
-func (tx pubTx) publishRaw(codec uint64, raw []byte) (cid, prefixedKey string, err error) {
+func (p *publisher) publishRaw(tx pubTx, codec uint64, raw []byte) (cid, prefixedKey string, err error) {
 	c, err := ipld.RawdataToCid(codec, raw, multihash.KECCAK_256)
 	if err != nil {
 		return
 	}
 	cid = c.String()
+	known := p.prior.Has(cid)
+	if !known {
+		if known, err = p.base.has(context.Background(), cid); err != nil {
+			return
+		}
+	}
+	if known {
+		atomic.AddUint64(&p.skippedBlockCounter, 1)
+		prom.IncSkippedBlockCount()
+		return cid, shared.MultihashKeyFromCID(c), nil
+	}
 	prefixedKey, err = tx.publishIPLD(c, raw)
 	return
 }
@@ -101,12 +190,31 @@ func (tx pubTx) publishRaw(codec uint64, raw []byte) (cid, prefixedKey string, e
 func (tx pubTx) publishIPLD(c cid.Cid, raw []byte) (string, error) {
 	dbKey := dshelp.MultihashToDsKey(c.Hash())
 	prefixedKey := blockstore.BlockPrefix.String() + dbKey.String()
-	_, err := tx.Exec(snapt.TableIPLDBlock.ToInsertStatement(), prefixedKey, raw)
-	return prefixedKey, err
+	return prefixedKey, tx.insertBlock(prefixedKey, raw)
+}
+
+// insertBlock writes block data under a key, compressed with the transaction's codec
+func (tx pubTx) insertBlock(key string, raw []byte) error {
+	if tx.codec == "" || tx.codec == CodecNone {
+		_, err := tx.Exec(snapt.TableIPLDBlock.ToInsertStatement(), key, raw)
+		return err
+	}
+	data, codec := compressBlock(tx.codec, raw)
+	_, err := tx.Exec(snapt.TableIPLDBlockWithCodec.ToInsertStatement(), key, data, codec)
+	return err
+}
+
+// publishPreimage writes the preimage of a leaf node's key, if it has one
+func (tx pubTx) publishPreimage(node *snapt.Node) error {
+	if node.Preimage == nil {
+		return nil
+	}
+	_, err := tx.Exec(snapt.TableKeyPreimage.ToInsertStatement(), node.Key.Hex(), node.Preimage)
+	return err
 }
 
 // PublishHeader writes the header to the ipfs backing pg datastore and adds secondary indexes in the header_cids table
-func (p *publisher) PublishHeader(header *types.Header) (err error) {
+func (p *publisher) PublishHeader(header *types.Header, td, reward *big.Int) (err error) {
 	headerNode, err := ipld.NewEthHeader(header)
 	if err != nil {
 		return err
@@ -116,7 +224,7 @@ func (p *publisher) PublishHeader(header *types.Header) (err error) {
 	if err != nil {
 		return err
 	}
-	tx := pubTx{snapTx, nil}
+	tx := pubTx{Tx: snapTx, codec: p.codec}
 	defer func() { err = snapt.CommitOrRollback(tx, err) }()
 
 	if _, err = tx.publishIPLD(headerNode.Cid(), headerNode.RawData()); err != nil {
@@ -124,13 +232,21 @@ func (p *publisher) PublishHeader(header *types.Header) (err error) {
 	}
 
 	mhKey := shared.MultihashKeyFromCID(headerNode.Cid())
-	_, err = tx.Exec(snapt.TableHeader.ToInsertStatement(), header.Number.Uint64(), header.Hash().Hex(),
-		header.ParentHash.Hex(), headerNode.Cid().String(), "0", p.db.NodeID(), "0",
+	_, err = tx.Exec(snapt.TableHeader.ToInsertStatementWith(p.conflictMode), header.Number.Uint64(), header.Hash().Hex(),
+		header.ParentHash.Hex(), headerNode.Cid().String(), td.String(), p.db.NodeID(), reward.String(),
 		header.Root.Hex(), header.TxHash.Hex(), header.ReceiptHash.Hex(), header.UncleHash.Hex(),
 		header.Bloom.Bytes(), header.Time, mhKey, 0, header.Coinbase.String())
 	return err
 }
 
+// CountStateNodes returns the number of state nodes indexed for the header
+func (p *publisher) CountStateNodes(headerID string) (int64, error) {
+	var count int64
+	err := p.db.QueryRow(context.Background(),
+		`SELECT COUNT(*) FROM eth.state_cids WHERE header_id = $1`, headerID).Scan(&count)
+	return count, err
+}
+
 // PublishStateNode writes the state node to the ipfs backing datastore and adds secondary indexes in the state_cids table
 func (p *publisher) PublishStateNode(node *snapt.Node, headerID string, snapTx snapt.Tx) error {
 	var stateKey string
@@ -139,16 +255,31 @@ func (p *publisher) PublishStateNode(node *snapt.Node, headerID string, snapTx s
 	}
 
 	tx := snapTx.(pubTx)
-	stateCIDStr, mhKey, err := tx.publishRaw(ipld.MEthStateTrie, node.Value)
+	stateCIDStr, mhKey, err := p.publishRaw(tx, ipld.MEthStateTrie, node.Value)
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(snapt.TableStateNode.ToInsertStatement(),
-		headerID, stateKey, stateCIDStr, node.Path, node.NodeType, false, mhKey)
+	tbl, args := snapt.TableStateNode, []interface{}{
+		headerID, stateKey, stateCIDStr, node.Path, node.NodeType, node.Diff, mhKey}
+	if p.nodeTypeNames {
+		tbl, args = tbl.WithNodeTypeName(), append(args, node.NodeType.String())
+	}
+	_, err = tx.Exec(tbl.ToInsertStatementWith(p.conflictMode), args...)
 	if err != nil {
 		return err
 	}
+	if err = tx.publishPreimage(node); err != nil {
+		return err
+	}
+	tx.manifest.Add(snapt.ManifestEntry{
+		Kind:     snapt.StateManifestKind,
+		CID:      stateCIDStr,
+		MhKey:    mhKey,
+		Path:     node.Path,
+		NodeType: node.NodeType,
+		LeafKey:  stateKey,
+	})
 	// increment state node counter.
 	atomic.AddUint64(&p.stateNodeCounter, 1)
 	prom.IncStateNodeCount()
@@ -166,16 +297,35 @@ func (p *publisher) PublishStorageNode(node *snapt.Node, headerID string, stateP
 	}
 
 	tx := snapTx.(pubTx)
-	storageCIDStr, mhKey, err := tx.publishRaw(ipld.MEthStorageTrie, node.Value)
+	storageCIDStr, mhKey, err := p.publishRaw(tx, ipld.MEthStorageTrie, node.Value)
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(snapt.TableStorageNode.ToInsertStatement(),
-		headerID, statePath, storageKey, storageCIDStr, node.Path, node.NodeType, false, mhKey)
+	tbl, args := snapt.TableStorageNode, []interface{}{
+		headerID, statePath, storageKey, storageCIDStr, node.Path, node.NodeType, node.Diff, mhKey}
+	if p.storageStateKeys {
+		tbl, args = snapt.TableStorageNodeWithStateKey, append(args, node.StateKey.Hex())
+	}
+	if p.nodeTypeNames {
+		tbl, args = tbl.WithNodeTypeName(), append(args, node.NodeType.String())
+	}
+	_, err = tx.Exec(tbl.ToInsertStatementWith(p.conflictMode), args...)
 	if err != nil {
 		return err
 	}
+	if err = tx.publishPreimage(node); err != nil {
+		return err
+	}
+	tx.manifest.Add(snapt.ManifestEntry{
+		Kind:      snapt.StorageManifestKind,
+		CID:       storageCIDStr,
+		MhKey:     mhKey,
+		StatePath: statePath,
+		Path:      node.Path,
+		NodeType:  node.NodeType,
+		LeafKey:   storageKey,
+	})
 	// increment storage node counter.
 	atomic.AddUint64(&p.storageNodeCounter, 1)
 	prom.IncStorageNodeCount()
@@ -194,7 +344,7 @@ func (p *publisher) PublishCode(codeHash common.Hash, codeBytes []byte, snapTx s
 	}
 
 	tx := snapTx.(pubTx)
-	if _, err = tx.Exec(snapt.TableIPLDBlock.ToInsertStatement(), mhKey, codeBytes); err != nil {
+	if err = tx.insertBlock(mhKey, codeBytes); err != nil {
 		return fmt.Errorf("error publishing code IPLD: %v", err)
 	}
 
@@ -215,7 +365,7 @@ func (p *publisher) PrepareTxForBatch(tx snapt.Tx, maxBatchSize uint) (snapt.Tx,
 		}
 
 		snapTx, err := p.db.Begin(context.Background())
-		tx = pubTx{Tx: snapTx}
+		tx = pubTx{Tx: snapTx, manifest: p.manifest.NewBatch(), codec: p.codec}
 		if err != nil {
 			return nil, err
 		}
@@ -235,10 +385,25 @@ func (p *publisher) logNodeCounters() {
 }
 
 func (p *publisher) printNodeCounters(msg string) {
-	log.WithFields(log.Fields{
-		"runtime":       time.Now().Sub(p.startTime).String(),
-		"state nodes":   atomic.LoadUint64(&p.stateNodeCounter),
-		"storage nodes": atomic.LoadUint64(&p.storageNodeCounter),
-		"code nodes":    atomic.LoadUint64(&p.codeNodeCounter),
-	}).Info(msg)
+	stats := p.Stats()
+	snapt.LogEvent(msg, stats.LogFields()...)
+	if p.statsFile != "" {
+		if err := snapt.WriteStatsFile(p.statsFile, stats); err != nil {
+			log.Errorf("failed to write stats file: %v", err)
+		}
+	}
+}
+
+// Stats returns the current node counts
+func (p *publisher) Stats() snapt.Stats {
+	now := time.Now()
+	return snapt.Stats{
+		StartTime:     p.startTime,
+		UpdatedAt:     now,
+		Runtime:       now.Sub(p.startTime).String(),
+		StateNodes:    atomic.LoadUint64(&p.stateNodeCounter),
+		StorageNodes:  atomic.LoadUint64(&p.storageNodeCounter),
+		CodeNodes:     atomic.LoadUint64(&p.codeNodeCounter),
+		SkippedBlocks: atomic.LoadUint64(&p.skippedBlockCounter),
+	}
 }
@@ -3,11 +3,13 @@ package pg
 import (
 	"context"
 	"fmt"
+	"math/big"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
 	"github.com/ethereum/go-ethereum/statediff/indexer/ipld"
 	"github.com/jackc/pgx/v4"
+	"github.com/multiformats/go-multihash"
 
 	fixt "github.com/vulcanize/ipld-eth-state-snapshot/fixture"
 	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
@@ -31,7 +33,7 @@ func writeData(t *testing.T) *publisher {
 	driver, err := postgres.NewPGXDriver(context.Background(), pgConfig, nodeInfo)
 	test.NoError(t, err)
 	pub := NewPublisher(postgres.NewPostgresDB(driver))
-	test.NoError(t, pub.PublishHeader(&fixt.Block1_Header))
+	test.NoError(t, pub.PublishHeader(&fixt.Block1_Header, big.NewInt(1), big.NewInt(0)))
 	tx, err := pub.BeginTx()
 	test.NoError(t, err)
 
@@ -42,6 +44,15 @@ func writeData(t *testing.T) *publisher {
 	return pub
 }
 
+// clearData deletes the existing test data
+func clearData(t *testing.T, conn *pgx.Conn) {
+	pgDeleteTable := `DELETE FROM %s`
+	for _, tbl := range allTables {
+		_, err := conn.Exec(context.Background(), fmt.Sprintf(pgDeleteTable, tbl.Name))
+		test.NoError(t, err)
+	}
+}
+
 // Note: DB user requires role membership "pg_read_server_files"
 func TestBasic(t *testing.T) {
 	test.NeedsDB(t)
@@ -50,13 +61,7 @@ func TestBasic(t *testing.T) {
 	conn, err := pgx.Connect(ctx, pgConfig.DbConnectionString())
 	test.NoError(t, err)
 
-	// clear existing test data
-	pgDeleteTable := `DELETE FROM %s`
-	for _, tbl := range allTables {
-		_, err = conn.Exec(ctx, fmt.Sprintf(pgDeleteTable, tbl.Name))
-		test.NoError(t, err)
-	}
-
+	clearData(t, conn)
 	_ = writeData(t)
 
 	// check header was successfully committed
@@ -76,3 +81,41 @@ func TestBasic(t *testing.T) {
 	test.ExpectEqual(t, headerNode.Cid().String(), header.CID)
 	test.ExpectEqual(t, fixt.Block1_Header.Hash().String(), header.BlockHash)
 }
+
+func TestBaseSnapshot(t *testing.T) {
+	test.NeedsDB(t)
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, pgConfig.DbConnectionString())
+	test.NoError(t, err)
+
+	clearData(t, conn)
+	pub := writeData(t)
+
+	headerID := fixt.Block1_Header.Hash().String()
+	var stateCID string
+	err = conn.QueryRow(ctx, `SELECT cid FROM eth.state_cids WHERE header_id = $1`, headerID).Scan(&stateCID)
+	test.NoError(t, err)
+
+	ids, err := HeaderIDsAt(ctx, pub.db, fixt.Block1_Header.Number.Uint64())
+	test.NoError(t, err)
+	test.ExpectEqual(t, []string{headerID}, ids)
+
+	base, err := newBaseSnapshot(pub.db, ids)
+	test.NoError(t, err)
+	for i := 0; i < 2; i++ { // the second lookup is answered from the cache
+		known, err := base.has(ctx, stateCID)
+		test.NoError(t, err)
+		test.ExpectEqual(t, true, known)
+	}
+	headerCID, err := ipld.RawdataToCid(ipld.MEthHeader, []byte{0xc0}, multihash.KECCAK_256)
+	test.NoError(t, err)
+	known, err := base.has(ctx, headerCID.String())
+	test.NoError(t, err)
+	test.ExpectEqual(t, false, known)
+
+	var none *baseSnapshot
+	known, err = none.has(ctx, stateCID)
+	test.NoError(t, err)
+	test.ExpectEqual(t, false, known)
+}
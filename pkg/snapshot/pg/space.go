@@ -0,0 +1,31 @@
+package pg
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+)
+
+// SpaceUsage is the space taken by a database, and by the snapshots already in it
+type SpaceUsage struct {
+	// DatabaseSize is the size of the whole database in bytes
+	DatabaseSize uint64 `db:"database_size"`
+	// NodesSize is the size in bytes of the IPLD blocks and the state and storage tables, with their indexes
+	NodesSize uint64 `db:"nodes_size"`
+	// Headers is the number of headers in the database, which the nodes are shared between
+	Headers uint64 `db:"headers"`
+}
+
+// QuerySpaceUsage queries the space taken by a database and its snapshot tables. The table sizes are
+// those reported by postgres, so they include dead tuples not yet vacuumed.
+func QuerySpaceUsage(ctx context.Context, db *postgres.DB) (*SpaceUsage, error) {
+	var usage SpaceUsage
+	err := db.Get(ctx, &usage, `SELECT pg_database_size(current_database()) AS database_size,
+		pg_total_relation_size('public.blocks') + pg_total_relation_size('eth.state_cids') +
+			pg_total_relation_size('eth.storage_cids') AS nodes_size,
+		(SELECT count(*) FROM eth.header_cids) AS headers`)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
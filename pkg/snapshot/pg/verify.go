@@ -0,0 +1,266 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	"github.com/ipfs/go-cid"
+)
+
+// BlockSource fetches IPLD blocks, returning nil if the block is absent
+type BlockSource interface {
+	GetBlock(ctx context.Context, c cid.Cid, mhKey string) ([]byte, error)
+}
+
+type dbBlockSource struct {
+	db *postgres.DB
+
+	// whether the blocks table has a codec column, checked on first use
+	checkCodec sync.Once
+	hasCodec   bool
+	checkErr   error
+}
+
+// NewDBBlockSource fetches blocks from the IPLD blocks table of the database, decompressing them if they
+// were stored compressed
+func NewDBBlockSource(db *postgres.DB) BlockSource {
+	return &dbBlockSource{db: db}
+}
+
+type storedBlock struct {
+	Data  []byte  `db:"data"`
+	Codec *string `db:"codec"`
+}
+
+func (src *dbBlockSource) GetBlock(ctx context.Context, _ cid.Cid, mhKey string) ([]byte, error) {
+	src.checkCodec.Do(func() {
+		src.hasCodec, src.checkErr = hasCodecColumn(ctx, src.db)
+	})
+	if src.checkErr != nil {
+		return nil, src.checkErr
+	}
+	if !src.hasCodec {
+		var data [][]byte
+		err := src.db.Select(ctx, &data, `SELECT data FROM public.blocks WHERE key = $1`, mhKey)
+		if err != nil || len(data) == 0 {
+			return nil, err
+		}
+		return data[0], nil
+	}
+	var rows []storedBlock
+	err := src.db.Select(ctx, &rows, `SELECT data, codec FROM public.blocks WHERE key = $1`, mhKey)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	if rows[0].Codec == nil {
+		return rows[0].Data, nil
+	}
+	return DecompressBlock(*rows[0].Codec, rows[0].Data)
+}
+
+// hasCodecColumn checks whether the blocks table has the codec column added for compressed blocks
+func hasCodecColumn(ctx context.Context, db *postgres.DB) (bool, error) {
+	var exists []bool
+	err := db.Select(ctx, &exists, `SELECT EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name = 'blocks' AND column_name = 'codec')`)
+	if err != nil || len(exists) == 0 {
+		return false, err
+	}
+	return exists[0], nil
+}
+
+type ipfsBlockSource struct {
+	api    string
+	client *http.Client
+}
+
+// NewIPFSBlockSource fetches blocks from an IPFS node through its HTTP API, e.g. http://127.0.0.1:5001
+func NewIPFSBlockSource(api string) BlockSource {
+	return ipfsBlockSource{strings.TrimSuffix(api, "/"), http.DefaultClient}
+}
+
+func (src ipfsBlockSource) GetBlock(ctx context.Context, c cid.Cid, _ string) ([]byte, error) {
+	endpoint := src.api + "/api/v0/block/get?arg=" + url.QueryEscape(c.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := src.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return io.ReadAll(res.Body)
+	}
+	// the API responds with an error status and message for blocks it can't find, as for any other failure
+	var apiErr struct{ Message string }
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if json.Unmarshal(body, &apiErr) != nil {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	if isIPFSNotFound(apiErr.Message) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("IPFS API responded %s: %s", res.Status, apiErr.Message)
+}
+
+// isIPFSNotFound reports whether an IPFS API error message is for a missing block
+func isIPFSNotFound(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "could not find")
+}
+
+// IPLDVerification is the result of checking the IPLD blocks referenced by a header's rows
+type IPLDVerification struct {
+	Checked int
+	// CIDs referenced by index rows whose blocks are absent
+	Dangling []string
+	// CIDs whose blocks don't hash to the CID
+	Corrupt []string
+}
+
+func (v *IPLDVerification) OK() bool {
+	return len(v.Dangling) == 0 && len(v.Corrupt) == 0
+}
+
+// HeaderIDsAt returns the hashes of the headers indexed at a height
+func HeaderIDsAt(ctx context.Context, db *postgres.DB, height uint64) ([]string, error) {
+	var ids []string
+	err := db.Select(ctx, &ids, `SELECT block_hash FROM eth.header_cids WHERE block_number = $1`, height)
+	return ids, err
+}
+
+// number of rows read per query when checking every row of a header
+const verifyBatchSize = 100000
+
+type indexedCID struct {
+	CID         string `db:"cid"`
+	MhKey       string `db:"mh_key"`
+	StatePath   []byte `db:"state_path"`
+	StoragePath []byte `db:"storage_path"`
+}
+
+// VerifyIPLD checks that the blocks referenced by the header row of a header and its state and storage
+// rows can be fetched from the source, and that their contents hash to the CIDs. If sample is
+// nonzero, only a random sample of that many rows is checked; otherwise all rows are read in batches
+// in key order, so the tables are not locked for the whole read.
+func VerifyIPLD(ctx context.Context, db *postgres.DB, src BlockSource, headerID string, sample int) (*IPLDVerification, error) {
+	ret := &IPLDVerification{}
+	if sample > 0 {
+		var rows []indexedCID
+		err := db.Select(ctx, &rows, `SELECT cid, mh_key FROM eth.header_cids WHERE block_hash = $1
+			UNION ALL SELECT cid, mh_key FROM eth.state_cids WHERE header_id = $1
+			UNION ALL SELECT cid, mh_key FROM eth.storage_cids WHERE header_id = $1
+			ORDER BY random() LIMIT $2`, headerID, sample)
+		if err != nil {
+			return nil, err
+		}
+		return ret, ret.check(ctx, src, rows)
+	}
+
+	var rows []indexedCID
+	if err := db.Select(ctx, &rows, `SELECT cid, mh_key FROM eth.header_cids WHERE block_hash = $1`, headerID); err != nil {
+		return nil, err
+	}
+	if err := ret.check(ctx, src, rows); err != nil {
+		return nil, err
+	}
+
+	var last *indexedCID
+	for {
+		var rows []indexedCID
+		var err error
+		if last == nil {
+			err = db.Select(ctx, &rows, `SELECT cid, mh_key, state_path FROM eth.state_cids WHERE header_id = $1
+				ORDER BY state_path NULLS FIRST LIMIT $2`, headerID, verifyBatchSize)
+		} else {
+			err = db.Select(ctx, &rows, `SELECT cid, mh_key, state_path FROM eth.state_cids WHERE header_id = $1
+				AND state_path > $2 ORDER BY state_path LIMIT $3`, headerID, last.StatePath, verifyBatchSize)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = ret.check(ctx, src, rows); err != nil {
+			return nil, err
+		}
+		if len(rows) < verifyBatchSize {
+			break
+		}
+		last = &rows[len(rows)-1]
+	}
+
+	last = nil
+	for {
+		var rows []indexedCID
+		var err error
+		if last == nil {
+			err = db.Select(ctx, &rows, `SELECT cid, mh_key, state_path, storage_path FROM eth.storage_cids
+				WHERE header_id = $1 ORDER BY state_path, storage_path LIMIT $2`, headerID, verifyBatchSize)
+		} else {
+			err = db.Select(ctx, &rows, `SELECT cid, mh_key, state_path, storage_path FROM eth.storage_cids
+				WHERE header_id = $1 AND (state_path, storage_path) > ($2, $3) ORDER BY state_path, storage_path LIMIT $4`,
+				headerID, last.StatePath, last.StoragePath, verifyBatchSize)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = ret.check(ctx, src, rows); err != nil {
+			return nil, err
+		}
+		if len(rows) < verifyBatchSize {
+			break
+		}
+		last = &rows[len(rows)-1]
+	}
+	return ret, nil
+}
+
+// check fetches the blocks of rows from the source, recording those which are absent or corrupt
+func (v *IPLDVerification) check(ctx context.Context, src BlockSource, rows []indexedCID) error {
+	for _, row := range rows {
+		c, err := cid.Decode(row.CID)
+		if err != nil {
+			return fmt.Errorf("invalid CID %s: %w", row.CID, err)
+		}
+		data, err := src.GetBlock(ctx, c, row.MhKey)
+		if err != nil {
+			return fmt.Errorf("failed to fetch block %s: %w", row.CID, err)
+		}
+		v.Checked++
+		if data == nil {
+			v.Dangling = append(v.Dangling, row.CID)
+			continue
+		}
+		sum, err := c.Prefix().Sum(data)
+		if err != nil {
+			return err
+		}
+		if !sum.Equals(c) {
+			v.Corrupt = append(v.Corrupt, row.CID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package pg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/ipld"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/test"
+)
+
+func TestIPFSBlockSource(t *testing.T) {
+	block := []byte{0xc0}
+	stored, err := ipld.RawdataToCid(ipld.MEthStateTrie, block, multihash.KECCAK_256)
+	test.NoError(t, err)
+	missing, err := ipld.RawdataToCid(ipld.MEthStateTrie, []byte{0x80}, multihash.KECCAK_256)
+	test.NoError(t, err)
+	failing, err := ipld.RawdataToCid(ipld.MEthStorageTrie, block, multihash.KECCAK_256)
+	test.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("arg") {
+		case stored.String():
+			w.Write(block)
+		case missing.String():
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"Message":"block was not found locally (offline): ipld: could not find node","Code":0,"Type":"error"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"Message":"context deadline exceeded","Code":0,"Type":"error"}`))
+		}
+	}))
+	defer server.Close()
+	src := NewIPFSBlockSource(server.URL)
+
+	data, err := src.GetBlock(context.Background(), stored, "")
+	test.NoError(t, err)
+	test.ExpectEqual(t, block, data)
+
+	// only a missing block is reported as absent
+	data, err = src.GetBlock(context.Background(), missing, "")
+	test.NoError(t, err)
+	if data != nil {
+		t.Errorf("expected no data for a missing block, got %x", data)
+	}
+	if _, err = src.GetBlock(context.Background(), failing, ""); err == nil {
+		t.Fatal("expected an error for a failed request")
+	}
+}
@@ -0,0 +1,55 @@
+package snapshot
+
+import (
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/prom"
+)
+
+// preimageLookup reads the preimages of hashed leaf keys, counting those found and missing
+type preimageLookup struct {
+	db             ethdb.KeyValueReader
+	found, missing uint64
+}
+
+func newPreimageLookup(enabled bool, db ethdb.KeyValueReader) *preimageLookup {
+	if !enabled {
+		return nil
+	}
+	return &preimageLookup{db: db}
+}
+
+// lookup returns the preimage of a leaf key, or nil if it isn't recorded
+func (p *preimageLookup) lookup(key common.Hash) []byte {
+	if p == nil {
+		return nil
+	}
+	preimage := rawdb.ReadPreimage(p.db, key)
+	if len(preimage) == 0 {
+		atomic.AddUint64(&p.missing, 1)
+		prom.IncPreimageMissingCount()
+		return nil
+	}
+	atomic.AddUint64(&p.found, 1)
+	prom.IncPreimageFoundCount()
+	return preimage
+}
+
+func (p *preimageLookup) logSummary() {
+	if p == nil {
+		return
+	}
+	found, missing := atomic.LoadUint64(&p.found), atomic.LoadUint64(&p.missing)
+	log.WithFields(log.Fields{
+		"found":   found,
+		"missing": missing,
+	}).Info("key preimages")
+	if found == 0 && missing > 0 {
+		log.Warn("no key preimages were found, they may not have been recorded (see geth's --cache.preimages)")
+	}
+}
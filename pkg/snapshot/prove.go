@@ -0,0 +1,204 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// ProofFormat specifies the output format of a proof
+type ProofFormat string
+
+const (
+	ProofJSON ProofFormat = "json"
+	ProofRLP  ProofFormat = "rlp"
+)
+
+func ParseProofFormat(s string) (ProofFormat, error) {
+	switch format := ProofFormat(s); format {
+	case ProofJSON, ProofRLP:
+		return format, nil
+	case "":
+		return ProofJSON, nil
+	}
+	return "", fmt.Errorf("invalid proof format: %s", s)
+}
+
+// Proof holds the trie nodes on the paths from the state root to an account, and from its storage
+// root to some of its slots, in the layout of eth_getProof. Each list of nodes is ordered from the root.
+// The proofs of absent accounts and slots end at the node where their paths diverge.
+type Proof struct {
+	Height       uint64          `json:"height"`
+	BlockHash    common.Hash     `json:"blockHash"`
+	StateRoot    common.Hash     `json:"stateRoot"`
+	Address      common.Address  `json:"address"`
+	AccountProof []hexutil.Bytes `json:"accountProof"`
+	// the account fields are zero if the account doesn't exist
+	Balance      *hexutil.Big   `json:"balance"`
+	Nonce        hexutil.Uint64 `json:"nonce"`
+	CodeHash     common.Hash    `json:"codeHash"`
+	StorageHash  common.Hash    `json:"storageHash"`
+	StorageProof []StorageProof `json:"storageProof"`
+}
+
+// StorageProof holds the trie nodes on the path from a storage root to a slot
+type StorageProof struct {
+	Key   common.Hash     `json:"key"`
+	Value *hexutil.Big    `json:"value"`
+	Proof []hexutil.Bytes `json:"proof"`
+}
+
+// Prove assembles the proof of an account, and of the given storage slots of it, at a height
+func (s *Service) Prove(height uint64, addr common.Address, slots []common.Hash) (*Proof, error) {
+	header, err := s.readHeader(height)
+	if err != nil {
+		return nil, err
+	}
+	proof := &Proof{
+		Height:       height,
+		BlockHash:    header.Hash(),
+		StateRoot:    header.Root,
+		Address:      addr,
+		Balance:      (*hexutil.Big)(new(big.Int)),
+		StorageProof: []StorageProof{},
+	}
+	tree, err := s.stateDB.OpenTrie(header.Root)
+	if err != nil {
+		return nil, wrapTrieError(err)
+	}
+	key := crypto.Keccak256Hash(addr.Bytes())
+	if proof.AccountProof, err = s.proofNodes(tree.NodeIterator(nil), key); err != nil {
+		return nil, fmt.Errorf("failed building proof of account %s: %w", addr.Hex(), err)
+	}
+
+	enc, err := tree.TryGet(addr.Bytes())
+	if err != nil {
+		return nil, wrapTrieError(err)
+	}
+	account := types.StateAccount{Root: s.emptyRoot, CodeHash: s.emptyCodeHash.Bytes()}
+	if len(enc) != 0 {
+		if err := rlp.DecodeBytes(enc, &account); err != nil {
+			return nil, fmt.Errorf("error decoding account %s: %w", addr.Hex(), err)
+		}
+		proof.Balance = (*hexutil.Big)(account.Balance)
+		proof.Nonce = hexutil.Uint64(account.Nonce)
+	}
+	proof.CodeHash = common.BytesToHash(account.CodeHash)
+	proof.StorageHash = account.Root
+
+	var sTrie state.Trie
+	if account.Root != s.emptyRoot {
+		if sTrie, err = s.stateDB.OpenTrie(account.Root); err != nil {
+			return nil, wrapTrieError(err)
+		}
+	}
+	for _, slot := range slots {
+		sp := StorageProof{Key: slot, Value: (*hexutil.Big)(new(big.Int)), Proof: []hexutil.Bytes{}}
+		if sTrie != nil {
+			slotKey := crypto.Keccak256Hash(slot.Bytes())
+			if sp.Proof, err = s.proofNodes(sTrie.NodeIterator(nil), slotKey); err != nil {
+				return nil, fmt.Errorf("failed building proof of slot %s of account %s: %w", slot.Hex(), addr.Hex(), err)
+			}
+			enc, err := sTrie.TryGet(slot.Bytes())
+			if err != nil {
+				return nil, wrapTrieError(err)
+			}
+			if len(enc) != 0 {
+				var value []byte
+				if err := rlp.DecodeBytes(enc, &value); err != nil {
+					return nil, fmt.Errorf("error decoding slot %s of account %s: %w", slot.Hex(), addr.Hex(), err)
+				}
+				sp.Value = (*hexutil.Big)(new(big.Int).SetBytes(value))
+			}
+		}
+		proof.StorageProof = append(proof.StorageProof, sp)
+	}
+	return proof, nil
+}
+
+// proofNodes descends a trie along the path to a key, returning the value of each node on it from the root.
+// Nodes embedded in their parents are part of the parent's value, and are not listed separately.
+func (s *Service) proofNodes(it trie.NodeIterator, key common.Hash) ([]hexutil.Bytes, error) {
+	paths, _ := changedPaths([]common.Hash{key})
+	path := newChangedIterator(it, paths)
+	nodes := []hexutil.Bytes{}
+	for path.Next(true) {
+		res, err := resolveNode(path, s.stateDB.TrieDB())
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			continue
+		}
+		nodes = append(nodes, append(hexutil.Bytes{}, res.node.Value...))
+		putNodeBuffer(res.node.Value)
+	}
+	return nodes, wrapTrieError(path.Error())
+}
+
+// WriteProof writes a proof as indented JSON, or as RLP
+func WriteProof(w io.Writer, proof *Proof, format ProofFormat) error {
+	switch format {
+	case ProofRLP:
+		return rlp.Encode(w, proof.rlpProof())
+	default:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(proof)
+	}
+}
+
+// rlpProof is the RLP encoding of a proof, whose fields are in the same order as the JSON
+type rlpProof struct {
+	Height       uint64
+	BlockHash    common.Hash
+	StateRoot    common.Hash
+	Address      common.Address
+	AccountProof [][]byte
+	Balance      *big.Int
+	Nonce        uint64
+	CodeHash     common.Hash
+	StorageHash  common.Hash
+	StorageProof []rlpStorageProof
+}
+
+type rlpStorageProof struct {
+	Key   common.Hash
+	Value *big.Int
+	Proof [][]byte
+}
+
+func (p *Proof) rlpProof() rlpProof {
+	ret := rlpProof{
+		Height:       p.Height,
+		BlockHash:    p.BlockHash,
+		StateRoot:    p.StateRoot,
+		Address:      p.Address,
+		AccountProof: proofBytes(p.AccountProof),
+		Balance:      p.Balance.ToInt(),
+		Nonce:        uint64(p.Nonce),
+		CodeHash:     p.CodeHash,
+		StorageHash:  p.StorageHash,
+	}
+	for _, sp := range p.StorageProof {
+		ret.StorageProof = append(ret.StorageProof, rlpStorageProof{sp.Key, sp.Value.ToInt(), proofBytes(sp.Proof)})
+	}
+	return ret
+}
+
+func proofBytes(nodes []hexutil.Bytes) [][]byte {
+	ret := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		ret[i] = node
+	}
+	return ret
+}
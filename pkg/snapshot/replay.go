@@ -0,0 +1,89 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ipfs/go-cid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// ReplayStats counts the nodes replayed from a manifest
+type ReplayStats struct {
+	StateNodes   uint64
+	StorageNodes uint64
+}
+
+// ReplayManifest copies the blocks of the nodes listed in a manifest from a block source to the publisher,
+// checking that each hashes to its CID, and publishes their state and storage rows for the header
+func ReplayManifest(ctx context.Context, manifest string, src pg.BlockSource, pub Publisher, headerID string) (stats ReplayStats, err error) {
+	tx, err := pub.BeginTx()
+	if err != nil {
+		return stats, err
+	}
+	defer func() { err = CommitOrRollback(tx, err) }()
+
+	err = ReadManifest(manifest, func(e ManifestEntry) error {
+		node, err := replayedNode(ctx, src, e)
+		if err != nil {
+			return err
+		}
+		if tx, err = pub.PrepareTxForBatch(tx, defaultBatchSize); err != nil {
+			return err
+		}
+		switch e.Kind {
+		case StateManifestKind:
+			if err = pub.PublishStateNode(node, headerID, tx); err != nil {
+				return wrapStateError(err, node, headerID)
+			}
+			stats.StateNodes++
+		case StorageManifestKind:
+			if err = pub.PublishStorageNode(node, headerID, e.StatePath, tx); err != nil {
+				return wrapStorageError(err, node, headerID, e.StatePath)
+			}
+			stats.StorageNodes++
+		default:
+			return fmt.Errorf("invalid manifest entry kind %q for CID %s", e.Kind, e.CID)
+		}
+		if n := stats.StateNodes + stats.StorageNodes; n%100000 == 0 {
+			log.Infof("replayed %d nodes", n)
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// replayedNode fetches the block of a manifest entry and checks it against the CID
+func replayedNode(ctx context.Context, src pg.BlockSource, e ManifestEntry) (*Node, error) {
+	c, err := cid.Decode(e.CID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID %s: %w", e.CID, err)
+	}
+	data, err := src.GetBlock(ctx, c, e.MhKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch block %s: %w", e.CID, err)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%w: block %s is missing from the source", ErrBlockMismatch, e.CID)
+	}
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("%w: block fetched for %s hashes to %s", ErrBlockMismatch, e.CID, sum)
+	}
+	node := &Node{
+		NodeType: e.NodeType,
+		Path:     e.Path,
+		Value:    data,
+	}
+	if e.LeafKey != "" {
+		node.Key = common.HexToHash(e.LeafKey)
+	}
+	return node, nil
+}
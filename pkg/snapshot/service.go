@@ -16,10 +16,12 @@
 package snapshot
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
+	"math/big"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
@@ -28,17 +30,19 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/statediff/indexer/shared"
 	"github.com/ethereum/go-ethereum/trie"
 	log "github.com/sirupsen/logrus"
 
-	iter "github.com/vulcanize/go-eth-state-node-iterator"
 	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
 )
 
 var (
-	emptyNode, _      = rlp.EncodeToBytes(&[]byte{})
-	emptyCodeHash     = crypto.Keccak256([]byte{})
-	emptyContractRoot = crypto.Keccak256Hash(emptyNode)
+	emptyNode, _ = rlp.EncodeToBytes(&[]byte{})
+	// DefaultEmptyCodeHash is the hash of empty code on Ethereum
+	DefaultEmptyCodeHash = crypto.Keccak256Hash([]byte{})
+	// DefaultEmptyRoot is the root of the empty trie on Ethereum
+	DefaultEmptyRoot = crypto.Keccak256Hash(emptyNode)
 
 	defaultBatchSize = uint(100)
 )
@@ -51,7 +55,28 @@ type Service struct {
 	ipfsPublisher Publisher
 	maxBatchSize  uint
 	tracker       iteratorTracker
+	trackerMu     sync.Mutex
+	flusher       flushCoordinator
 	recoveryFile  string
+	memLimit      *memoryLimiter
+	batchAge      *batchWatchdog
+	budget        *timeBudget
+	decoded       *decodedWriter
+	codeDedup     *codeDedup
+	duplicates    *duplicateDetector
+	storageRoots  *storageRootCache
+	storageOrder  StorageOrder
+	storageSplit  storageSplitter
+	// accounts whose storage is published by storage shards, and skipped by the walk
+	shardedStorage map[common.Hash]struct{}
+	// whether the published nodes are marked as a diff
+	diff      bool
+	preimages *preimageLookup
+	// whether the batch is committed after the storage of each account
+	commitPerAccount bool
+
+	emptyCodeHash common.Hash
+	emptyRoot     common.Hash
 }
 
 func NewLevelDB(con *EthConfig) (ethdb.Database, error) {
@@ -61,6 +86,9 @@ func NewLevelDB(con *EthConfig) (ethdb.Database, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to create NewLevelDBDatabaseWithFreezer: %s", err)
 	}
+	if con.AncientCacheSize > 0 {
+		return newCachedAncientDB(edb, con.AncientCacheSize)
+	}
 	return edb, nil
 }
 
@@ -72,39 +100,209 @@ func NewSnapshotService(edb ethdb.Database, pub Publisher, recoveryFile string)
 		ipfsPublisher: pub,
 		maxBatchSize:  defaultBatchSize,
 		recoveryFile:  recoveryFile,
+		emptyCodeHash: DefaultEmptyCodeHash,
+		emptyRoot:     DefaultEmptyRoot,
 	}, nil
 }
 
+// SetEmptyHashes sets the hash of empty code and the root of the empty trie, for chains whose
+// conventions differ from Ethereum's. Accounts with these code hashes and storage roots have no
+// code or storage to publish.
+func (s *Service) SetEmptyHashes(codeHash, root common.Hash) {
+	s.emptyCodeHash, s.emptyRoot = codeHash, root
+}
+
 type SnapshotParams struct {
 	Height  uint64
 	Workers uint
+	// soft cap on heap usage in bytes, 0 for no cap
+	MaxMemory uint64
+	// directory to write the decoded accounts and storage slots to, in addition to the trie nodes
+	DecodedOutputDir string
+	// how published contract code is tracked to avoid publishing it again
+	CodeDedup CodeDedupMode
+	// whether a state leaf is committed before its storage nodes are published
+	StorageOrder StorageOrder
+	// number of concurrent walkers to split large storage tries between, 0 to walk them serially
+	StorageSubtrieSplit uint
+	// number of nodes in the top levels of a storage trie at which its walk is split
+	StorageSplitThreshold uint
+	// number of times to resume from the recovery file after a non-fatal error, 0 to fail immediately
+	AutoRestart uint
+	// if non-nil, only the state nodes on the paths to these account keys, and the storage of the
+	// accounts, are published and marked as a diff
+	ChangedAccounts []common.Hash
+	// whether the preimages of leaf keys are looked up and published with the leaves
+	Preimages bool
+	// whether the batch is committed after the storage of each account, so that no transaction
+	// holds the storage of more than one account
+	CommitPerAccount bool
+	// maximum time a batch is left uncommitted for, whatever its size, 0 to commit by size only
+	MaxBatchAge time.Duration
+	// whether the recovery state is written to a file per worker rather than a single file
+	RecoveryPerWorker bool
+	// whether the snapshot fails if the split leaves a worker's range empty, rather than warning
+	FailOnEmptyRange bool
+	// whether nodes published more than once are counted and logged, at the cost of memory
+	DetectDuplicates bool
+	// maximum number of storage trie nodes cached by root, so that accounts sharing a storage root are
+	// published without walking the trie again, 0 for no cache
+	StorageRootCache uint
+	// keys of the accounts whose storage is published separately by storage shards, and not walked
+	ShardedStorage []common.Hash
+	// URL to post the selected events of the snapshot to, empty for none
+	WebhookURL    string
+	WebhookEvents []WebhookEvent
+	// wall-clock time after which the workers are stopped and the recovery file written, 0 for no limit
+	TimeBudget time.Duration
+}
+
+// StorageOrder specifies the ordering of a state leaf and its storage nodes
+type StorageOrder string
+
+const (
+	// StorageInterleaved publishes storage nodes in the same batch as their state leaf, which
+	// may be split across commits
+	StorageInterleaved StorageOrder = "interleaved"
+	// StorageAfterLeaf commits the state leaf before any of its storage nodes are published
+	StorageAfterLeaf StorageOrder = "after-leaf"
+)
+
+func ParseStorageOrder(s string) (StorageOrder, error) {
+	switch order := StorageOrder(s); order {
+	case StorageInterleaved, StorageAfterLeaf:
+		return order, nil
+	case "":
+		return StorageInterleaved, nil
+	}
+	return "", fmt.Errorf("invalid storage order: %s", s)
 }
 
+// CreateSnapshot publishes the state at a height. If params.AutoRestart is set, a run which fails with
+// a non-fatal error is resumed from the recovery file, up to that many times. If params.WebhookURL is
+// set, the start and the outcome of the snapshot are posted to it. If params.TimeBudget is set, the
+// snapshot, including any restarts, stops once it runs out, returning ErrTimeBudgetReached.
 func (s *Service) CreateSnapshot(params SnapshotParams) error {
+	if err := CheckSplitCount("storage subtrie split", params.StorageSubtrieSplit); err != nil {
+		return err
+	}
+	hook := newWebhook(params.WebhookURL, params.WebhookEvents)
+	hook.notify(WebhookStart, params.Height, s.ipfsPublisher, nil)
+	if params.TimeBudget > 0 && s.recoveryFile == "" {
+		log.Warnf("a time budget is set without a recovery file, a stopped snapshot can't be resumed")
+	}
+	s.budget = newTimeBudget(params.TimeBudget)
+	defer s.budget.stop()
+	err := s.createSnapshotRun(params)
+	for attempt := uint(1); err != nil && attempt <= params.AutoRestart; attempt++ {
+		if errors.Is(err, ErrTimeBudgetReached) {
+			break
+		}
+		if IsFatal(err) {
+			log.Errorf("snapshot failed with fatal error, not restarting")
+			break
+		}
+		if s.recoveryFile == "" {
+			log.Errorf("no recovery file is set, not restarting")
+			break
+		}
+		log.Errorf("snapshot failed: %v", err)
+		time.Sleep(autoRestartDelay * time.Duration(attempt))
+		log.Infof("restarting snapshot from recovery file %s (attempt %d of %d)",
+			s.recoveryFile, attempt, params.AutoRestart)
+		err = s.createSnapshotRun(params)
+	}
+	if err != nil {
+		hook.notify(WebhookFailure, params.Height, s.ipfsPublisher, err)
+	} else {
+		hook.notify(WebhookComplete, params.Height, s.ipfsPublisher, nil)
+	}
+	return err
+}
+
+// autoRestartDelay is the delay before the first restart, increasing with each attempt
+var autoRestartDelay = 5 * time.Second
+
+func (s *Service) createSnapshotRun(params SnapshotParams) error {
 	// extract header from lvldb and publish to PG-IPFS
 	// hold onto the headerID so that we can link the state nodes to this header
 	log.Infof("Creating snapshot at height %d", params.Height)
-	hash := rawdb.ReadCanonicalHash(s.ethDB, params.Height)
-	header := rawdb.ReadHeader(s.ethDB, hash, params.Height)
-	if header == nil {
-		return fmt.Errorf("unable to read canonical header at height %d", params.Height)
+	header, err := s.readHeader(params.Height)
+	if err != nil {
+		return err
 	}
 
-	log.Infof("head hash: %s head height: %d", hash.Hex(), params.Height)
+	log.Infof("head hash: %s head height: %d", header.Hash().Hex(), params.Height)
 
-	err := s.ipfsPublisher.PublishHeader(header)
+	err = s.publishHeader(header)
 	if err != nil {
 		return err
 	}
 
+	// the empty trie opens and iterates without error, but has no nodes to publish
+	if header.Root == s.emptyRoot {
+		log.Warnf("state root of header %s is the empty trie root, there are no state nodes to publish",
+			header.Hash().Hex())
+		logSummary(header, true)
+		return nil
+	}
+
+	// check the changed accounts' paths before any iterators are opened
+	var paths [][]byte
+	if params.ChangedAccounts != nil {
+		var anomalies []string
+		paths, anomalies = changedPaths(params.ChangedAccounts)
+		for _, anomaly := range anomalies {
+			log.Warnf("changed accounts: %s", anomaly)
+		}
+		if log.IsLevelEnabled(log.DebugLevel) {
+			hexPaths := make([]string, len(paths))
+			for i, path := range paths {
+				hexPaths[i] = nibblesToHex(string(path))
+			}
+			log.Debugf("changed account paths: %s", strings.Join(hexPaths, ", "))
+		}
+	}
+
 	tree, err := s.stateDB.OpenTrie(header.Root)
 	if err != nil {
-		return err
+		return wrapTrieError(err)
 	}
 
 	headerID := header.Hash().String()
+	s.memLimit = newMemoryLimiter(params.MaxMemory)
+	defer s.memLimit.stop()
+	s.batchAge = newBatchWatchdog(params.MaxBatchAge)
+	defer s.batchAge.stop()
+	if params.DecodedOutputDir != "" {
+		if s.decoded, err = newDecodedWriter(params.DecodedOutputDir); err != nil {
+			return err
+		}
+		defer func() {
+			if err := s.decoded.close(); err != nil {
+				log.Errorf("failed to close decoded output: %v", err)
+			}
+			s.decoded = nil
+		}()
+	}
+	s.codeDedup = newCodeDedup(params.CodeDedup)
+	s.storageOrder = params.StorageOrder
+	s.storageSplit = storageSplitter{params.StorageSubtrieSplit, params.StorageSplitThreshold}
+	s.shardedStorage = make(map[common.Hash]struct{}, len(params.ShardedStorage))
+	for _, key := range params.ShardedStorage {
+		s.shardedStorage[key] = struct{}{}
+	}
+	s.diff = params.ChangedAccounts != nil
+	s.commitPerAccount = params.CommitPerAccount
+	s.preimages = newPreimageLookup(params.Preimages, s.ethDB)
+	defer s.preimages.logSummary()
+	defer s.codeDedup.reconcile()
+	s.duplicates = newDuplicateDetector(params.DetectDuplicates)
+	defer s.duplicates.logSummary()
+	s.storageRoots = newStorageRootCache(params.StorageRootCache)
+	defer s.storageRoots.logSummary()
 	s.tracker = newTracker(s.recoveryFile, int(params.Workers))
-	s.tracker.captureSignal()
+	s.tracker.perWorker = params.RecoveryPerWorker
 
 	var iters []trie.NodeIterator
 	// attempt to restore from recovery file if it exists
@@ -118,14 +316,19 @@ func (s *Service) CreateSnapshot(params SnapshotParams) error {
 		log.Debugf("restored iterators; count: %d", len(iters))
 		if params.Workers < uint(len(iters)) {
 			return fmt.Errorf(
-				"number of recovered workers (%d) is greater than number configured (%d)",
-				len(iters), params.Workers,
+				"%w: number of recovered workers (%d) is greater than number configured (%d)",
+				ErrRecoveryMismatch, len(iters), params.Workers,
 			)
 		}
 	} else { // nothing to restore
 		log.Debugf("no iterators to restore")
+		// Only the first range starts at the root. The others are seeked to their start paths, which passes
+		// over the root without yielding it, so the root is published once, by the first worker, just as a
+		// single iterator publishes it.
 		if params.Workers > 1 {
-			iters = iter.SubtrieIterators(tree, params.Workers)
+			if iters, err = splitTrie(tree, params.Workers, params.FailOnEmptyRange); err != nil {
+				return err
+			}
 		} else {
 			iters = []trie.NodeIterator{tree.NodeIterator(nil)}
 		}
@@ -134,29 +337,115 @@ func (s *Service) CreateSnapshot(params SnapshotParams) error {
 		}
 	}
 
+	if params.ChangedAccounts != nil {
+		log.Infof("publishing only the paths to %d changed accounts", len(paths))
+		for i, it := range iters {
+			iters[i] = newChangedIterator(it, paths)
+		}
+	}
+
+	stopSignals := s.tracker.captureSignal()
 	defer func() {
+		stopSignals()
+		s.trackerMu.Lock()
+		defer s.trackerMu.Unlock()
 		err := s.tracker.haltAndDump()
 		if err != nil {
 			log.Errorf("failed to write recovery file: %v", err)
 		}
 	}()
 
-	if len(iters) > 0 {
-		return s.createSnapshotAsync(iters, headerID)
-	} else {
-		return s.createSnapshot(iters[0], headerID)
+	switch len(iters) {
+	case 0:
+		return errors.New("no iterators to snapshot the state trie with")
+	case 1:
+		err = s.createSnapshot(iters[0], headerID, s.codeDedup.forWorker())
+	default:
+		err = s.createSnapshotAsync(iters, headerID)
 	}
+	if err != nil {
+		return err
+	}
+	logSummary(header, false)
+	return nil
+}
+
+func logSummary(header *types.Header, emptyState bool) {
+	LogEvent("snapshot summary",
+		LogField{"height", header.Number.Uint64()},
+		LogField{"header", header.Hash().Hex()},
+		LogField{"state_root", header.Root.Hex()},
+		LogField{"empty_state", emptyState},
+	)
 }
 
 // Create snapshot up to head (ignores height param)
-func (s *Service) CreateLatestSnapshot(workers uint) error {
+func (s *Service) CreateLatestSnapshot(params SnapshotParams) error {
 	log.Info("Creating snapshot at head")
 	hash := rawdb.ReadHeadHeaderHash(s.ethDB)
 	height := rawdb.ReadHeaderNumber(s.ethDB, hash)
 	if height == nil {
-		return fmt.Errorf("unable to read header height for header hash %s", hash.String())
+		return fmt.Errorf("%w: unable to read header height for header hash %s", ErrMissingHeader, hash.String())
+	}
+	params.Height = *height
+	return s.CreateSnapshot(params)
+}
+
+// PublishHeader publishes only the canonical header at the given height, without its state
+func (s *Service) PublishHeader(height uint64) (*types.Header, error) {
+	header, err := s.readHeader(height)
+	if err != nil {
+		return nil, err
 	}
-	return s.CreateSnapshot(SnapshotParams{Height: *height, Workers: workers})
+	log.Infof("publishing header %s at height %d", header.Hash().Hex(), height)
+	return header, s.publishHeader(header)
+}
+
+func (s *Service) readHeader(height uint64) (*types.Header, error) {
+	start := time.Now()
+	hash := rawdb.ReadCanonicalHash(s.ethDB, height)
+	header := rawdb.ReadHeader(s.ethDB, hash, height)
+	if header == nil {
+		return nil, fmt.Errorf("%w: unable to read canonical header at height %d", ErrMissingHeader, height)
+	}
+	log.Debugf("read header at height %d in %s", height, time.Since(start))
+	return header, nil
+}
+
+// publishHeader publishes the header along with its total difficulty and block reward
+func (s *Service) publishHeader(header *types.Header) error {
+	hash, height := header.Hash(), header.Number.Uint64()
+	td := rawdb.ReadTd(s.ethDB, hash, height)
+	if td == nil {
+		return fmt.Errorf("%w: unable to read total difficulty for header %s", ErrMissingHeader, hash.Hex())
+	}
+	reward, err := s.blockReward(header)
+	if err != nil {
+		return err
+	}
+	return s.ipfsPublisher.PublishHeader(header, td, reward)
+}
+
+// blockReward calculates the miner reward for a block the same way the statediffing indexer does
+func (s *Service) blockReward(header *types.Header) (*big.Int, error) {
+	config := rawdb.ReadChainConfig(s.ethDB, rawdb.ReadCanonicalHash(s.ethDB, 0))
+	if config == nil {
+		return nil, errors.New("unable to read chain config")
+	}
+	// in PoA networks block reward is 0
+	if config.Clique != nil {
+		return big.NewInt(0), nil
+	}
+	hash, height := header.Hash(), header.Number.Uint64()
+	body := rawdb.ReadBody(s.ethDB, hash, height)
+	if body == nil {
+		return nil, fmt.Errorf("%w: unable to read body for header %s", ErrMissingHeader, hash.Hex())
+	}
+	receipts := rawdb.ReadReceipts(s.ethDB, hash, height, config)
+	if len(receipts) != len(body.Transactions) {
+		return nil, fmt.Errorf("%w: unable to read receipts for header %s", ErrMissingHeader, hash.Hex())
+	}
+	return shared.CalcEthBlockReward(header, body.Uncles, body.Transactions, receipts), nil
 }
 
 type nodeResult struct {
@@ -177,7 +466,7 @@ func resolveNode(it trie.NodeIterator, trieDB *trie.Database) (*nodeResult, erro
 	copy(path, it.Path())
 	n, err := trieDB.Node(it.Hash())
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: node %x at path %x: %v", ErrMissingTrieNode, it.Hash(), path, err)
 	}
 	var elements []interface{}
 	if err := rlp.DecodeBytes(n, &elements); err != nil {
@@ -185,26 +474,57 @@ func resolveNode(it trie.NodeIterator, trieDB *trie.Database) (*nodeResult, erro
 	}
 	ty, err := CheckKeyType(elements)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: node %x at path %x: %v", ErrUnexpectedNodeType, it.Hash(), path, err)
 	}
 	return &nodeResult{
 		node: Node{
 			NodeType: ty,
 			Path:     path,
-			Value:    n,
+			Value:    getNodeBuffer(n),
 		},
 		elements: elements,
 	}, nil
 }
 
-func (s *Service) createSnapshot(it trie.NodeIterator, headerID string) error {
+// leafKey computes the key of a leaf node from its path and the partial path it holds
+func (res *nodeResult) leafKey() common.Hash {
+	partialPath := trie.CompactToHex(res.elements[0].([]byte))
+	valueNodePath := append(res.node.Path, partialPath...)
+	encodedPath := trie.HexToCompact(valueNodePath)
+	return common.BytesToHash(encodedPath[1:])
+}
+
+// throttle commits the current batch and pauses the worker while heap usage exceeds the memory cap
+func (s *Service) throttle(tx Tx) (Tx, error) {
+	if !s.memLimit.Exceeded() {
+		return tx, nil
+	}
+	next, err := s.ipfsPublisher.PrepareTxForBatch(tx, 0)
+	if err != nil {
+		return tx, err
+	}
+	s.memLimit.wait()
+	return next, nil
+}
+
+// createSnapshot publishes the nodes of a state trie, using the code cache to skip code already published
+func (s *Service) createSnapshot(it trie.NodeIterator, headerID string, codes *codeCache) (err error) {
 	tx, err := s.ipfsPublisher.BeginTx()
 	if err != nil {
 		return err
 	}
-	defer func() { err = CommitOrRollback(tx, err) }()
+	defer func() { err = commitOrStop(tx, err) }()
+	m := s.flusher.register()
+	defer s.flusher.unregister(m)
+	tracked := asTracked(it)
+	committed := s.batchAge.current()
+	var published uint64
 
 	for it.Next(true) {
+		if s.budget.reached() {
+			logBudgetStop(it, published)
+			return ErrTimeBudgetReached
+		}
 		res, err := resolveNode(it, s.stateDB.TrieDB())
 		if err != nil {
 			return err
@@ -212,12 +532,23 @@ func (s *Service) createSnapshot(it trie.NodeIterator, headerID string) error {
 		if res == nil {
 			continue
 		}
+		res.node.Diff = s.diff
 
+		if tx, err = s.throttle(tx); err != nil {
+			return err
+		}
+		if tx, err = s.checkpoint(m, tx); err != nil {
+			return err
+		}
+		if tx, committed, err = s.commitStale(tx, committed); err != nil {
+			return err
+		}
 		tx, err = s.ipfsPublisher.PrepareTxForBatch(tx, s.maxBatchSize)
 		if err != nil {
 			return err
 		}
 
+		s.duplicates.check(headerID, nil, res.node.Path)
 		switch res.node.NodeType {
 		case Leaf:
 			// if the node is a leaf, decode the account and publish the associated storage trie
@@ -227,57 +558,79 @@ func (s *Service) createSnapshot(it trie.NodeIterator, headerID string) error {
 				return fmt.Errorf(
 					"error decoding account for leaf node at path %x nerror: %v", res.node.Path, err)
 			}
-			partialPath := trie.CompactToHex(res.elements[0].([]byte))
-			valueNodePath := append(res.node.Path, partialPath...)
-			encodedPath := trie.HexToCompact(valueNodePath)
-			leafKey := encodedPath[1:]
-			res.node.Key = common.BytesToHash(leafKey)
+			res.node.Key = res.leafKey()
+			res.node.Preimage = s.preimages.lookup(res.node.Key)
 			err := s.ipfsPublisher.PublishStateNode(&res.node, headerID, tx)
+			putNodeBuffer(res.node.Value)
 			if err != nil {
+				return wrapStateError(err, &res.node, headerID)
+			}
+			published++
+			if err = s.decoded.writeAccount(headerID, res.node.Key, res.node.Path, &account); err != nil {
 				return err
 			}
 
 			// publish any non-nil code referenced by codehash
-			if !bytes.Equal(account.CodeHash, emptyCodeHash) {
-				codeHash := common.BytesToHash(account.CodeHash)
+			codeHash := common.BytesToHash(account.CodeHash)
+			if codeHash != s.emptyCodeHash && codes.add(codeHash) {
 				codeBytes := rawdb.ReadCode(s.ethDB, codeHash)
 				if len(codeBytes) == 0 {
-					log.Error("Code is missing", "account", common.BytesToHash(it.LeafKey()))
-					return errors.New("missing code")
+					return fmt.Errorf("%w: code hash %s for account %s", ErrMissingCode, codeHash.Hex(), res.node.Key.Hex())
 				}
 
 				if err = s.ipfsPublisher.PublishCode(codeHash, codeBytes, tx); err != nil {
-					return err
+					return fmt.Errorf("failed publishing code %s of account %s at path %x: %w",
+						codeHash.Hex(), res.node.Key.Hex(), res.node.Path, err)
 				}
 			}
 
-			if tx, err = s.storageSnapshot(account.Root, headerID, res.node.Path, tx); err != nil {
-				return fmt.Errorf("failed building storage snapshot for account %+v\r\nerror: %w", account, err)
+			// commit the leaf, so that its storage is never committed without it
+			if s.storageOrder == StorageAfterLeaf && account.Root != s.emptyRoot {
+				if tx, err = s.ipfsPublisher.PrepareTxForBatch(tx, 0); err != nil {
+					return err
+				}
+			}
+			next, err := s.storageSnapshot(account.Root, headerID, res.node.Path, res.node.Key, tx, m, tracked)
+			if next != nil {
+				tx = next
+			}
+			if errors.Is(err, ErrTimeBudgetReached) {
+				logBudgetStop(it, published)
+				return ErrTimeBudgetReached
+			}
+			if err != nil {
+				return fmt.Errorf("failed building storage snapshot for account %s at path %x (storage root %s): %w",
+					res.node.Key.Hex(), res.node.Path, account.Root.Hex(), err)
 			}
 		case Extension, Branch:
 			res.node.Key = common.BytesToHash([]byte{})
-			if err := s.ipfsPublisher.PublishStateNode(&res.node, headerID, tx); err != nil {
-				return err
+			err := s.ipfsPublisher.PublishStateNode(&res.node, headerID, tx)
+			putNodeBuffer(res.node.Value)
+			if err != nil {
+				return wrapStateError(err, &res.node, headerID)
 			}
+			published++
 		default:
-			return errors.New("unexpected node type")
+			return fmt.Errorf("%w: %s at path %x", ErrUnexpectedNodeType, nodeTypeName(res.node.NodeType), res.node.Path)
 		}
 	}
-	return it.Error()
+	return wrapTrieError(it.Error())
 }
 
-// Full-trie concurrent snapshot
+// Full-trie concurrent snapshot. The first error is returned, except that a worker stopped by the time
+// budget waits for the others to stop, so that all their batches are committed before the recovery file
+// is written.
 func (s *Service) createSnapshotAsync(iters []trie.NodeIterator, headerID string) error {
-	errors := make(chan error)
+	errs := make(chan error)
 	var wg sync.WaitGroup
 	for _, it := range iters {
 		wg.Add(1)
-		go func(it trie.NodeIterator) {
+		go func(it trie.NodeIterator, codes *codeCache) {
 			defer wg.Done()
-			if err := s.createSnapshot(it, headerID); err != nil {
-				errors <- err
+			if err := s.createSnapshot(it, headerID, codes); err != nil {
+				errs <- err
 			}
-		}(it)
+		}(it, s.codeDedup.forWorker())
 	}
 
 	done := make(chan struct{})
@@ -287,26 +640,82 @@ func (s *Service) createSnapshotAsync(iters []trie.NodeIterator, headerID string
 	}()
 
 	var err error
-	select {
-	case err = <-errors:
-	case <-done:
-		close(errors)
+	for {
+		select {
+		case werr := <-errs:
+			if !errors.Is(werr, ErrTimeBudgetReached) {
+				return werr
+			}
+			err = werr
+		case <-done:
+			close(errs)
+			return err
+		}
 	}
-	return err
 }
 
-func (s *Service) storageSnapshot(sr common.Hash, headerID string, statePath []byte, tx Tx) (Tx, error) {
-	if bytes.Equal(sr.Bytes(), emptyContractRoot.Bytes()) {
+// storageSnapshot publishes the storage trie of the account at statePath. If the state iterator is tracked,
+// the position in the storage trie is recorded with it, and a position restored for the account is resumed from.
+func (s *Service) storageSnapshot(sr common.Hash, headerID string, statePath []byte, stateKey common.Hash, tx Tx, m *flushMember, tracked *trackedIter) (Tx, error) {
+	if sr == s.emptyRoot {
+		return tx, nil
+	}
+	if _, ok := s.shardedStorage[stateKey]; ok {
+		log.Infof("skipping storage of account %s, which is published by storage shards", stateKey.Hex())
 		return tx, nil
 	}
 
 	sTrie, err := s.stateDB.OpenTrie(sr)
 	if err != nil {
-		return nil, err
+		return nil, wrapTrieError(err)
+	}
+	if start := tracked.storageResumeKey(statePath); start != nil {
+		log.Infof("resuming storage of account at path %x from key %x", statePath, start)
+		return s.trackedStorageNodes(sTrie.NodeIterator(start), headerID, statePath, stateKey, tx, m, tracked, nil)
 	}
+	if nodes, ok := s.storageRoots.lookup(sr); ok {
+		log.Debugf("publishing cached storage trie %s for account at path %x", sr.Hex(), statePath)
+		return s.publishCachedStorage(nodes, headerID, statePath, stateKey, tx, m, tracked)
+	}
+	if s.storageSplit.enabled() {
+		large, err := s.storageSplit.isLarge(sTrie)
+		if err != nil {
+			return nil, err
+		}
+		if large {
+			return s.storageSnapshotAsync(sTrie, headerID, statePath, stateKey, tx, m)
+		}
+	}
+	return s.trackedStorageNodes(sTrie.NodeIterator(make([]byte, 0)), headerID, statePath, stateKey, tx, m, tracked,
+		s.storageRoots.recorder(sr))
+}
+
+// trackedStorageNodes publishes the nodes of a storage trie, recording the iterator with the state iterator
+// until the storage is published, so that a failure is recovered from the last storage position. If rec is
+// non-nil, the published nodes are recorded, and cached once the whole trie is published.
+// If commitPerAccount is set, the batch is committed once the storage is published.
+func (s *Service) trackedStorageNodes(it trie.NodeIterator, headerID string, statePath []byte, stateKey common.Hash, tx Tx, m *flushMember, tracked *trackedIter, rec *storageRecording) (Tx, error) {
+	tracked.setStorage(it)
+	tx, err := s.publishStorageNodes(it, headerID, statePath, stateKey, tx, m, rec)
+	if err != nil {
+		return tx, err
+	}
+	tracked.setStorage(nil)
+	s.storageRoots.store(rec)
+	if s.commitPerAccount {
+		return s.ipfsPublisher.PrepareTxForBatch(tx, 0)
+	}
+	return tx, nil
+}
 
-	it := sTrie.NodeIterator(make([]byte, 0))
+// publishStorageNodes publishes the nodes of a storage trie visited by the iterator, recording them in rec.
+// The nodes are linked to the account at statePath, whose leaf key is stateKey.
+func (s *Service) publishStorageNodes(it trie.NodeIterator, headerID string, statePath []byte, stateKey common.Hash, tx Tx, m *flushMember, rec *storageRecording) (Tx, error) {
+	committed := s.batchAge.current()
 	for it.Next(true) {
+		if s.budget.reached() {
+			return tx, ErrTimeBudgetReached
+		}
 		res, err := resolveNode(it, s.stateDB.TrieDB())
 		if err != nil {
 			return nil, err
@@ -314,35 +723,93 @@ func (s *Service) storageSnapshot(sr common.Hash, headerID string, statePath []b
 		if res == nil {
 			continue
 		}
+		res.node.Diff = s.diff
 
-		tx, err = s.ipfsPublisher.PrepareTxForBatch(tx, s.maxBatchSize)
-		if err != nil {
-			return nil, err
-		}
-
-		var nodeData []byte
-		nodeData, err = s.stateDB.TrieDB().Node(it.Hash())
-		if err != nil {
+		if tx, committed, err = s.prepareStorageBatch(tx, m, committed); err != nil {
 			return nil, err
 		}
-		res.node.Value = nodeData
 
+		var slot []byte
 		switch res.node.NodeType {
 		case Leaf:
-			partialPath := trie.CompactToHex(res.elements[0].([]byte))
-			valueNodePath := append(res.node.Path, partialPath...)
-			encodedPath := trie.HexToCompact(valueNodePath)
-			leafKey := encodedPath[1:]
-			res.node.Key = common.BytesToHash(leafKey)
+			res.node.Key = res.leafKey()
+			res.node.Preimage = s.preimages.lookup(res.node.Key)
+			slot = res.elements[1].([]byte)
 		case Extension, Branch:
 			res.node.Key = common.BytesToHash([]byte{})
 		default:
-			return nil, errors.New("unexpected node type")
+			return nil, fmt.Errorf("%w: %s at path %x", ErrUnexpectedNodeType, nodeTypeName(res.node.NodeType), res.node.Path)
 		}
-		if err = s.ipfsPublisher.PublishStorageNode(&res.node, headerID, statePath, tx); err != nil {
+		rec.add(&res.node, slot)
+		err = s.publishStorageNode(&res.node, slot, headerID, statePath, stateKey, tx)
+		putNodeBuffer(res.node.Value)
+		if err != nil {
 			return nil, err
 		}
 	}
 
-	return tx, it.Error()
+	return tx, wrapTrieError(it.Error())
+}
+
+// publishCachedStorage publishes the cached nodes of a storage trie for the account at statePath, whose
+// leaf key is stateKey, without walking the trie. The position reached is recorded with the state iterator
+// as for a walk, so that a stopped or failed run resumes the account's storage from it.
+// If commitPerAccount is set, the batch is committed once the storage is published.
+func (s *Service) publishCachedStorage(nodes []cachedStorageNode, headerID string, statePath []byte, stateKey common.Hash, tx Tx, m *flushMember, tracked *trackedIter) (Tx, error) {
+	committed := s.batchAge.current()
+	pos := &cachedPosition{}
+	tracked.setStorage(pos)
+	for i := range nodes {
+		pos.path = nodes[i].node.Path
+		if s.budget.reached() {
+			return tx, ErrTimeBudgetReached
+		}
+		var err error
+		if tx, committed, err = s.prepareStorageBatch(tx, m, committed); err != nil {
+			return nil, err
+		}
+		// the cached nodes are shared between workers, so each is published from a copy
+		node := nodes[i].node
+		if err = s.publishStorageNode(&node, nodes[i].slot, headerID, statePath, stateKey, tx); err != nil {
+			return nil, err
+		}
+	}
+	tracked.setStorage(nil)
+	if s.commitPerAccount {
+		return s.ipfsPublisher.PrepareTxForBatch(tx, 0)
+	}
+	return tx, nil
+}
+
+// prepareStorageBatch runs the checks made before each storage node is published by the flush member m,
+// which may commit the batch
+func (s *Service) prepareStorageBatch(tx Tx, m *flushMember, committed uint64) (Tx, uint64, error) {
+	var err error
+	if tx, err = s.throttle(tx); err != nil {
+		return tx, committed, err
+	}
+	if tx, err = s.checkpoint(m, tx); err != nil {
+		return tx, committed, err
+	}
+	if tx, committed, err = s.commitStale(tx, committed); err != nil {
+		return tx, committed, err
+	}
+	tx, err = s.ipfsPublisher.PrepareTxForBatch(tx, s.maxBatchSize)
+	return tx, committed, err
+}
+
+// publishStorageNode publishes a storage node of the account at statePath, with its RLP encoded slot value
+// if it is a leaf
+func (s *Service) publishStorageNode(node *Node, slot []byte, headerID string, statePath []byte, stateKey common.Hash, tx Tx) error {
+	if node.NodeType == Leaf {
+		if err := s.decoded.writeSlot(headerID, statePath, node.Key, node.Path, slot); err != nil {
+			return err
+		}
+	}
+	node.StateKey = stateKey
+	s.duplicates.check(headerID, statePath, node.Path)
+	if err := s.ipfsPublisher.PublishStorageNode(node, headerID, statePath, tx); err != nil {
+		return wrapStorageError(err, node, headerID, statePath)
+	}
+	return nil
 }
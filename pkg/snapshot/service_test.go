@@ -1,15 +1,46 @@
 package snapshot
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/gethclient"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	"github.com/ethereum/go-ethereum/statediff/indexer/ipld"
+	"github.com/ethereum/go-ethereum/trie"
 	"github.com/golang/mock/gomock"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
 
+	iter "github.com/vulcanize/go-eth-state-node-iterator"
 	fixt "github.com/vulcanize/ipld-eth-state-snapshot/fixture"
 	mock "github.com/vulcanize/ipld-eth-state-snapshot/mocks/snapshot"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/file"
+	snapmock "github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/mock"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
 	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
 	"github.com/vulcanize/ipld-eth-state-snapshot/test"
 )
@@ -38,7 +69,7 @@ func makeMocks(t *testing.T) (*mock.MockPublisher, *mock.MockTx) {
 func TestCreateSnapshot(t *testing.T) {
 	runCase := func(t *testing.T, workers int) {
 		pub, tx := makeMocks(t)
-		pub.EXPECT().PublishHeader(gomock.Eq(&fixt.Block1_Header))
+		pub.EXPECT().PublishHeader(gomock.Eq(&fixt.Block1_Header), gomock.Any(), gomock.Any())
 		pub.EXPECT().BeginTx().Return(tx, nil).
 			Times(workers)
 		pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).
@@ -79,14 +110,326 @@ func TestCreateSnapshot(t *testing.T) {
 	}
 }
 
+// publishedNodes maps the (state and storage) path of each node published to its CID
+type publishedNodes map[string]string
+
+// collectNodes returns a mock publisher recording the nodes published to it
+func collectNodes(t *testing.T) (*mock.MockPublisher, publishedNodes) {
+	pub, tx := makeMocks(t)
+	var mu sync.Mutex
+	nodes := publishedNodes{}
+	record := func(kind string, codec uint64, node *snapt.Node, statePath []byte) error {
+		c, err := ipld.RawdataToCid(codec, node.Value, multihash.KECCAK_256)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s/%x/%x", kind, statePath, node.Path)
+		mu.Lock()
+		defer mu.Unlock()
+		// nodes at the boundaries of the workers' ranges may be published twice, but must not differ
+		if prev, ok := nodes[key]; ok && prev != c.String() {
+			t.Errorf("%s published with CIDs %s and %s", key, prev, c)
+		}
+		nodes[key] = c.String()
+		return nil
+	}
+	pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any())
+	pub.EXPECT().BeginTx().Return(tx, nil).AnyTimes()
+	pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
+	pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+		DoAndReturn(func(node *snapt.Node, _ string, _ snapt.Tx) error {
+			return record("state", ipld.MEthStateTrie, node, nil)
+		})
+	pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+		DoAndReturn(func(node *snapt.Node, _ string, statePath []byte, _ snapt.Tx) error {
+			return record("storage", ipld.MEthStorageTrie, node, statePath)
+		})
+	pub.EXPECT().PublishCode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	tx.EXPECT().Commit().AnyTimes()
+	return pub, nodes
+}
+
+// TestConcurrentEquivalence checks that snapshots taken with several workers publish the same nodes as
+// a serial snapshot. Run with -race (make test-race) to also catch data races between workers.
+func TestConcurrentEquivalence(t *testing.T) {
+	contracts := rawdb.NewMemoryDatabase()
+	defer contracts.Close()
+	writeGenesisHeader(contracts, writeContractState(t, contracts, 8, 200))
+
+	fixtures := []struct {
+		name   string
+		height uint64
+		open   func(t *testing.T) ethdb.Database
+	}{
+		{"fixture chain", 1, func(t *testing.T) ethdb.Database {
+			edb, err := NewLevelDB(testConfig(fixt.ChaindataPath, fixt.AncientdataPath).Eth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { edb.Close() })
+			return edb
+		}},
+		{"contract storage", 0, func(t *testing.T) ethdb.Database { return contracts }},
+	}
+	snapshot := func(t *testing.T, edb ethdb.Database, height uint64, workers uint) publishedNodes {
+		pub, nodes := collectNodes(t)
+		service, err := NewSnapshotService(edb, pub, filepath.Join(t.TempDir(), "recover.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = service.CreateSnapshot(SnapshotParams{Height: height, Workers: workers}); err != nil {
+			t.Fatal(err)
+		}
+		return nodes
+	}
+
+	for _, fixture := range fixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			edb := fixture.open(t)
+			serial := snapshot(t, edb, fixture.height, 1)
+			if len(serial) == 0 {
+				t.Fatal("no nodes published")
+			}
+			for _, workers := range []uint{4, 16} {
+				t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+					test.ExpectEqual(t, serial, snapshot(t, edb, fixture.height, workers))
+				})
+			}
+		})
+	}
+}
+
+func TestAncientCache(t *testing.T) {
+	config := testConfig(fixt.ChaindataPath, fixt.AncientdataPath)
+	config.Eth.AncientCacheSize = 16
+	edb, err := NewLevelDB(config.Eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer edb.Close()
+
+	service, err := NewSnapshotService(edb, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		header, err := service.readHeader(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.ExpectEqual(t, fixt.Block1_Header.Hash(), header.Hash())
+	}
+	if edb.(*cachedAncientDB).cache.Len() == 0 {
+		t.Fatal("expected cached ancient items")
+	}
+}
+
+// writeGenesisHeader writes a PoA genesis header with the given state root
+func writeGenesisHeader(edb ethdb.Database, root common.Hash) {
+	header := &types.Header{
+		Number:     big.NewInt(0),
+		Root:       root,
+		Difficulty: big.NewInt(1),
+	}
+	rawdb.WriteHeader(edb, header)
+	rawdb.WriteCanonicalHash(edb, header.Hash(), 0)
+	rawdb.WriteTd(edb, header.Hash(), 0, header.Difficulty)
+	rawdb.WriteChainConfig(edb, header.Hash(), params.AllCliqueProtocolChanges)
+}
+
+func TestEmptyStateRoot(t *testing.T) {
+	pub, _ := makeMocks(t)
+	// only the header is published, no transaction is begun
+	pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any())
+
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	writeGenesisHeader(edb, types.EmptyRootHash)
+
+	recovery := filepath.Join(t.TempDir(), "recover.csv")
+	service, err := NewSnapshotService(edb, pub, recovery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(recovery); !os.IsNotExist(err) {
+		t.Fatal("expected no recovery file")
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	hash, err := parseHash("", DefaultEmptyRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.ExpectEqual(t, DefaultEmptyRoot, hash)
+	hash, err = parseHash(DefaultEmptyCodeHash.Hex(), DefaultEmptyRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.ExpectEqual(t, DefaultEmptyCodeHash, hash)
+	for _, bad := range []string{"0x1234", "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470", "0xzz"} {
+		if _, err = parseHash(bad, DefaultEmptyRoot); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestEstimateWorkers(t *testing.T) {
+	cases := []struct {
+		cpus     int
+		latency  time.Duration
+		maxConns int
+		expected uint
+	}{
+		{8, 0, 0, 8},
+		{8, time.Millisecond, 0, 8},
+		{8, 10 * time.Millisecond, 0, 16},
+		{8, 10 * time.Millisecond, 10, 8},
+		{64, 10 * time.Millisecond, 0, 64},
+		{8, 0, 1, 1},
+		{12, 0, 0, 8},
+		{12, 10 * time.Millisecond, 0, 16},
+		{6, 0, 0, 4},
+	}
+	for _, c := range cases {
+		workers, _ := EstimateWorkers(c.cpus, c.latency, c.maxConns)
+		if workers != c.expected {
+			t.Errorf("cpus=%d latency=%s maxConns=%d: expected %d workers, got %d",
+				c.cpus, c.latency, c.maxConns, c.expected, workers)
+		}
+	}
+}
+
+func TestEstimateSpace(t *testing.T) {
+	const mb = 1024 * 1024
+	// 10 headers sharing 1000 MB of nodes, in a database of 1200 MB
+	usage := &pg.SpaceUsage{DatabaseSize: 1200 * mb, NodesSize: 1000 * mb, Headers: 10}
+	cases := []struct {
+		usage    *pg.SpaceUsage
+		expected uint64
+		maxSize  uint64
+		estimate uint64
+		fail     bool
+	}{
+		{usage, 0, 0, 100 * mb, false},
+		{usage, 0, 1320 * mb, 100 * mb, false},
+		{usage, 0, 1300 * mb, 100 * mb, true},
+		{usage, 500 * mb, 1300 * mb, 500 * mb, true},
+		{usage, 0, 1000 * mb, 100 * mb, true},
+		{&pg.SpaceUsage{DatabaseSize: 8 * mb}, 0, 1000 * mb, 0, false},
+	}
+	for i, c := range cases {
+		estimate, _, err := EstimateSpace(c.usage, c.expected, c.maxSize, 0.2)
+		test.ExpectEqual(t, c.estimate, estimate)
+		if c.fail != errors.Is(err, ErrInsufficientSpace) {
+			t.Errorf("case %d: expected failure %v, got error %v", i, c.fail, err)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	newConfig := func() *Config {
+		return &Config{
+			Eth:      &EthConfig{LevelDBPath: "chaindata"},
+			DB:       &DBConfig{ConnConfig: postgres.Config{DatabaseName: "vulcanize_public", Hostname: "localhost", Port: 5432}},
+			File:     &FileConfig{},
+			KV:       &KVConfig{},
+			Manifest: &ManifestConfig{SinceSnapshot: -1},
+			Stats:    &StatsConfig{},
+			Schema:   &SchemaConfig{},
+		}
+	}
+	test.NoError(t, newConfig().Validate(PgSnapshot))
+
+	config := newConfig()
+	config.Eth.LevelDBPath = ""
+	config.DB.ConnConfig.Port = 0
+	config.Manifest.SinceSnapshot = 10
+	config.DB.Shards = []postgres.Config{config.DB.ConnConfig}
+	err := config.Validate(PgSnapshot)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	// the port isn't checked when sharding
+	test.ExpectEqual(t, 2, len(errs))
+
+	config = newConfig()
+	config.Manifest.SinceSnapshot = 10
+	if err := config.Validate(FileSnapshot); err == nil {
+		t.Error("expected since-snapshot to be rejected in file mode")
+	}
+}
+
+func TestPrefixCoverage(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	writeGenesisHeader(edb, writeContractState(t, edb, 3, 10))
+	service, err := NewSnapshotService(edb, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerID, expected, err := service.StatePrefixes(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.ExpectEqual(t, rawdb.ReadCanonicalHash(edb, 0).String(), headerID)
+	if len(expected) == 0 {
+		t.Fatal("expected state nodes below the root")
+	}
+
+	// drop the nodes under one prefix, as an incomplete shard would
+	counts := map[string]int64{}
+	var dropped string
+	for prefix := range expected {
+		if dropped == "" {
+			dropped = prefix
+			continue
+		}
+		counts[prefix] = 1
+	}
+	coverage := PrefixCoverage{Depth: 1, Counts: counts, Expected: expected}
+	test.ExpectEqual(t, []string{nibblesToHex(dropped)}, coverage.Gaps())
+	var out bytes.Buffer
+	if err = coverage.WriteGrid(&out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out.String(), "!") != 1 {
+		t.Errorf("expected one gap in grid:\n%s", out.String())
+	}
+
+	// without the trie, empties are only flagged when most prefixes have nodes
+	coverage = PrefixCoverage{Depth: 1, Counts: map[string]int64{"\x00": 1}}
+	if gaps := coverage.Gaps(); len(gaps) != 0 {
+		t.Errorf("expected no gaps, got %v", gaps)
+	}
+}
+
+func TestMissingHeader(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	service, err := NewSnapshotService(edb, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.PublishHeader(1)
+	if !errors.Is(err, ErrMissingHeader) {
+		t.Fatalf("expected ErrMissingHeader, got %v", err)
+	}
+}
+
 func failingPublishStateNode(_ *snapt.Node, _ string, _ snapt.Tx) error {
 	return errors.New("failingPublishStateNode")
 }
 
 func TestRecovery(t *testing.T) {
-	runCase := func(t *testing.T, workers int) {
+	runCase := func(t *testing.T, workers int, perWorker bool) {
 		pub, tx := makeMocks(t)
-		pub.EXPECT().PublishHeader(gomock.Any()).AnyTimes()
+		pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
 		pub.EXPECT().BeginTx().Return(tx, nil).AnyTimes()
 		pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
 		pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).
@@ -107,14 +450,37 @@ func TestRecovery(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		params := SnapshotParams{Height: 1, Workers: uint(workers)}
+		params := SnapshotParams{Height: 1, Workers: uint(workers), RecoveryPerWorker: perWorker}
 		err = service.CreateSnapshot(params)
 		if err == nil {
 			t.Fatal("expected an error")
 		}
 
-		if _, err = os.Stat(recovery); err != nil {
-			t.Fatal("cannot stat recovery file:", err)
+		workerFiles, err := workerRecoveryFiles(recovery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perWorker {
+			if len(workerFiles) == 0 {
+				t.Fatal("no per-worker recovery files written")
+			}
+			for _, file := range workerFiles {
+				dump, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rows := bytes.Count(dump, []byte("\n")); rows != 1 {
+					t.Errorf("expected one row in %s, got %d", file, rows)
+				}
+			}
+			if _, err = os.Stat(recovery); !os.IsNotExist(err) {
+				t.Fatal("single recovery file written in per-worker mode")
+			}
+		} else {
+			if _, err = os.Stat(recovery); err != nil {
+				t.Fatal("cannot stat recovery file:", err)
+			}
+			test.ExpectEqual(t, 0, len(workerFiles))
 		}
 
 		pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
@@ -131,11 +497,1287 @@ func TestRecovery(t *testing.T) {
 				t.Fatal(err)
 			}
 		}
+		if workerFiles, err = workerRecoveryFiles(recovery); err != nil {
+			t.Fatal(err)
+		}
+		test.ExpectEqual(t, 0, len(workerFiles))
 	}
 
 	testCases := []int{1, 4, 32}
 	for _, tc := range testCases {
-		t.Run("case", func(t *testing.T) { runCase(t, tc) })
+		t.Run("case", func(t *testing.T) { runCase(t, tc, false) })
+		t.Run("per-worker case", func(t *testing.T) { runCase(t, tc, true) })
+	}
+
+}
+
+// writeContractState writes a state of 10 accounts without storage and the given number of contracts
+// with slots 1 to n set, returning its root
+func writeContractState(t *testing.T, edb ethdb.Database, contracts int, n int64) common.Hash {
+	sdb := state.NewDatabase(edb)
+	statedb, err := state.New(common.Hash{}, sdb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 10; i++ {
+		statedb.SetBalance(common.BigToAddress(big.NewInt(i)), big.NewInt(i))
+	}
+	for c := 0; c < contracts; c++ {
+		contract := common.BigToAddress(big.NewInt(int64(0xc0ffee + c)))
+		for i := int64(1); i <= n; i++ {
+			statedb.SetState(contract, common.BigToHash(big.NewInt(i)), common.BigToHash(big.NewInt(i)))
+		}
+	}
+	root, err := statedb.Commit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sdb.TrieDB().Commit(root, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestStorageRecovery(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	writeGenesisHeader(edb, writeContractState(t, edb, 1, 1000))
+	recovery := filepath.Join(t.TempDir(), "recover.csv")
+
+	// runs a snapshot, collecting the paths of the published storage nodes and failing after failAfter of them
+	runCase := func(t *testing.T, failAfter int) (map[string]struct{}, error) {
+		pub, tx := makeMocks(t)
+		pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		pub.EXPECT().BeginTx().Return(tx, nil).AnyTimes()
+		pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
+		pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		paths := map[string]struct{}{}
+		pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+			DoAndReturn(func(node *snapt.Node, _ string, _ []byte, _ snapt.Tx) error {
+				if len(paths) == failAfter {
+					return errors.New("failingPublishStorageNode")
+				}
+				paths[string(node.Path)] = struct{}{}
+				return nil
+			})
+		tx.EXPECT().Commit().AnyTimes()
+		tx.EXPECT().Rollback().AnyTimes()
+
+		service, err := NewSnapshotService(edb, pub, recovery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1})
+		return paths, err
+	}
+
+	all, err := runCase(t, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := runCase(t, len(all)/2)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	dump, err := os.ReadFile(recovery)
+	if err != nil {
+		t.Fatal("cannot read recovery file:", err)
+	}
+	if fields := bytes.Split(bytes.TrimSpace(dump), []byte(",")); len(fields) != 3 {
+		t.Fatalf("expected a recovery row with a storage path, got %q", dump)
+	}
+
+	after, err := runCase(t, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) >= len(all) {
+		t.Fatalf("expected storage to be resumed, but %d of %d nodes were published again", len(after), len(all))
+	}
+	for path := range after {
+		before[path] = struct{}{}
+	}
+	test.ExpectEqual(t, all, before)
+}
+
+func TestStorageCommit(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	writeGenesisHeader(edb, writeContractState(t, edb, 3, 10))
+
+	pub, tx := makeMocks(t)
+	pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any())
+	pub.EXPECT().BeginTx().Return(tx, nil)
+	pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Not(gomock.Eq(uint(0)))).Return(tx, nil).AnyTimes()
+	// a commit is forced after the storage of each contract
+	pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Eq(uint(0))).Return(tx, nil).Times(3)
+	pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	tx.EXPECT().Commit()
+
+	service, err := NewSnapshotService(edb, pub, filepath.Join(t.TempDir(), "recover.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1, CommitPerAccount: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRootPublishedOnce(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	writeGenesisHeader(edb, writeContractState(t, edb, 4, 50))
+
+	for _, workers := range []uint{1, 2, 4, 16} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			pub, tx := makeMocks(t)
+			pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any())
+			pub.EXPECT().BeginTx().Return(tx, nil).AnyTimes()
+			pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
+			var mu sync.Mutex
+			var roots int
+			pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+				DoAndReturn(func(node *snapt.Node, _ string, _ snapt.Tx) error {
+					if len(node.Path) == 0 {
+						mu.Lock()
+						roots++
+						mu.Unlock()
+					}
+					return nil
+				})
+			pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+			pub.EXPECT().PublishCode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+			tx.EXPECT().Commit().AnyTimes()
+
+			service, err := NewSnapshotService(edb, pub, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.NoError(t, service.CreateSnapshot(SnapshotParams{Height: 0, Workers: workers}))
+			test.ExpectEqual(t, 1, roots)
+		})
+	}
+}
+
+func TestEmptyRange(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	// 11 accounts can't fill 32 ranges
+	writeGenesisHeader(edb, writeContractState(t, edb, 1, 1))
+
+	runCase := func(t *testing.T, fail bool) error {
+		pub, nodes := collectNodes(t)
+		service, err := NewSnapshotService(edb, pub, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 32, FailOnEmptyRange: fail})
+		if fail && len(nodes) != 0 {
+			t.Errorf("expected no nodes to be published, got %d", len(nodes))
+		}
+		return err
+	}
+
+	t.Run("warn", func(t *testing.T) { test.NoError(t, runCase(t, false)) })
+	t.Run("fail", func(t *testing.T) {
+		err := runCase(t, true)
+		if !errors.Is(err, ErrEmptyRange) {
+			t.Fatalf("expected ErrEmptyRange, got %v", err)
+		}
+		if !IsFatal(err) {
+			t.Error("expected ErrEmptyRange to be fatal")
+		}
+	})
+}
+
+func TestDegenerateSplit(t *testing.T) {
+	// a trie of a single account, whose leaf is the root
+	single := rawdb.NewMemoryDatabase()
+	defer single.Close()
+	sdb := state.NewDatabase(single)
+	statedb, err := state.New(common.Hash{}, sdb, nil)
+	test.NoError(t, err)
+	statedb.SetBalance(common.Address{1}, big.NewInt(1))
+	root, err := statedb.Commit(false)
+	test.NoError(t, err)
+	test.NoError(t, sdb.TrieDB().Commit(root, false, nil))
+	writeGenesisHeader(single, root)
+
+	// 11 accounts, fewer than the workers
+	small := rawdb.NewMemoryDatabase()
+	defer small.Close()
+	writeGenesisHeader(small, writeContractState(t, small, 1, 1))
+
+	snapshot := func(t *testing.T, edb ethdb.Database, workers uint) publishedNodes {
+		pub, nodes := collectNodes(t)
+		service, err := NewSnapshotService(edb, pub, "")
+		test.NoError(t, err)
+		test.NoError(t, service.CreateSnapshot(SnapshotParams{Height: 0, Workers: workers}))
+		return nodes
+	}
+	// worker counts other than a power of two fall back to the power of two below them
+	for _, workers := range []uint{3, 6, 64} {
+		for fixture, edb := range map[string]ethdb.Database{"single": single, "small": small} {
+			t.Run(fmt.Sprintf("%d/%s", workers, fixture), func(t *testing.T) {
+				test.ExpectEqual(t, snapshot(t, edb, 1), snapshot(t, edb, workers))
+			})
+		}
+	}
+
+	// splits yielding fewer iterators than workers fall back to a single worker
+	splits := map[string]func(state.Trie, uint) []trie.NodeIterator{
+		"short": func(tree state.Trie, nbins uint) []trie.NodeIterator {
+			return iter.SubtrieIterators(tree, nbins)[:nbins/2]
+		},
+		"none": func(state.Trie, uint) []trie.NodeIterator { return nil },
+	}
+	defer func(f func(state.Trie, uint) []trie.NodeIterator) { subtrieIterators = f }(subtrieIterators)
+	for name, split := range splits {
+		for fixture, edb := range map[string]ethdb.Database{"single": single, "small": small} {
+			t.Run(name+"/"+fixture, func(t *testing.T) {
+				subtrieIterators = iter.SubtrieIterators
+				expected := snapshot(t, edb, 1)
+				subtrieIterators = split
+				test.ExpectEqual(t, expected, snapshot(t, edb, 64))
+			})
+		}
+	}
+}
+
+func TestPublishErrorContext(t *testing.T) {
+	errInjected := errors.New("injected fault")
+	runCase := func(t *testing.T, failState bool) error {
+		edb := rawdb.NewMemoryDatabase()
+		defer edb.Close()
+		writeGenesisHeader(edb, writeContractState(t, edb, 1, 10))
+
+		pub, tx := makeMocks(t)
+		pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		pub.EXPECT().BeginTx().Return(tx, nil)
+		pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
+		pub.EXPECT().PublishCode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		if failState {
+			pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).Return(errInjected)
+		} else {
+			pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+			pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(errInjected)
+		}
+		tx.EXPECT().Rollback().AnyTimes()
+
+		service, err := NewSnapshotService(edb, pub, filepath.Join(t.TempDir(), "recover.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1})
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("expected injected error, got %v", err)
+		}
+		header := rawdb.ReadCanonicalHash(edb, 0).Hex()
+		if !strings.Contains(err.Error(), "for header "+header) {
+			t.Errorf("expected error to name header %s, got %v", header, err)
+		}
+		return err
+	}
+
+	t.Run("state node", func(t *testing.T) {
+		err := runCase(t, true)
+		// the root branch, at the empty path, is published first
+		if !strings.Contains(err.Error(), "failed publishing branch state node at path  for header") {
+			t.Errorf("expected error to name the node, got %v", err)
+		}
+	})
+	t.Run("storage node", func(t *testing.T) {
+		err := runCase(t, false)
+		for _, expected := range []string{"storage node at path", "of account at path", "failed building storage snapshot for account"} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("expected error to contain %q, got %v", expected, err)
+			}
+		}
+	})
+}
+
+func TestMaxBatchAge(t *testing.T) {
+	runCase := func(t *testing.T, maxAge time.Duration) {
+		edb := rawdb.NewMemoryDatabase()
+		defer edb.Close()
+		writeGenesisHeader(edb, writeContractState(t, edb, 1, 10))
+
+		pub, tx := makeMocks(t)
+		pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		pub.EXPECT().BeginTx().Return(tx, nil)
+		pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Not(gomock.Eq(uint(0)))).Return(tx, nil).AnyTimes()
+		// the batch never fills, so any forced commit is made by the watchdog
+		if maxAge > 0 {
+			pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Eq(uint(0))).Return(tx, nil).MinTimes(2)
+		}
+		// publishing slower than the max age
+		slow := func() error {
+			time.Sleep(2 * maxAge)
+			return nil
+		}
+		pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+			DoAndReturn(func(*snapt.Node, string, snapt.Tx) error { return slow() })
+		pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+			DoAndReturn(func(*snapt.Node, string, []byte, snapt.Tx) error { return slow() })
+		pub.EXPECT().PublishCode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		tx.EXPECT().Commit()
+
+		service, err := NewSnapshotService(edb, pub, filepath.Join(t.TempDir(), "recover.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1, MaxBatchAge: maxAge})
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
+	t.Run("by age", func(t *testing.T) { runCase(t, time.Millisecond) })
+	t.Run("by size only", func(t *testing.T) { runCase(t, 0) })
+}
+
+func TestFaultInjection(t *testing.T) {
+	errInjected := errors.New("injected fault")
+	runCase := func(t *testing.T, workers int, inject func(*snapmock.FaultInjector)) {
+		pub, err := file.NewPublisher(t.TempDir(), test.DefaultNodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		faulty := snapmock.NewFaultInjector(pub)
+		inject(faulty)
+
+		config := testConfig(fixt.ChaindataPath, fixt.AncientdataPath)
+		edb, err := NewLevelDB(config.Eth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer edb.Close()
+
+		recovery := filepath.Join(t.TempDir(), "recover.csv")
+		service, err := NewSnapshotService(edb, faulty, recovery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = service.CreateSnapshot(SnapshotParams{Height: 1, Workers: uint(workers)})
+		if !errors.Is(err, errInjected) {
+			t.Fatalf("expected injected error, got %v", err)
+		}
+	}
+
+	for _, workers := range []int{1, 4} {
+		t.Run("state node", func(t *testing.T) {
+			runCase(t, workers, func(f *snapmock.FaultInjector) { f.FailStateNode(2, errInjected) })
+		})
+		t.Run("commit", func(t *testing.T) {
+			runCase(t, workers, func(f *snapmock.FaultInjector) { f.FailCommit(1, errInjected) })
+		})
+	}
+}
+
+func TestAutoRestart(t *testing.T) {
+	defer func(delay time.Duration) { autoRestartDelay = delay }(autoRestartDelay)
+	autoRestartDelay = 0
+
+	runCase := func(t *testing.T, restarts uint, inject func(*snapmock.FaultInjector)) error {
+		pub, err := file.NewPublisher(t.TempDir(), test.DefaultNodeInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		faulty := snapmock.NewFaultInjector(pub)
+		inject(faulty)
+
+		config := testConfig(fixt.ChaindataPath, fixt.AncientdataPath)
+		edb, err := NewLevelDB(config.Eth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer edb.Close()
+
+		recovery := filepath.Join(t.TempDir(), "recover.csv")
+		service, err := NewSnapshotService(edb, faulty, recovery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a single worker, so the faults are hit in a fixed order
+		return service.CreateSnapshot(SnapshotParams{Height: 1, Workers: 1, AutoRestart: restarts})
+	}
+
+	errTransient := errors.New("transient fault")
+	errFatal := fmt.Errorf("%w: injected", ErrMissingTrieNode)
+	t.Run("transient", func(t *testing.T) {
+		err := runCase(t, 2, func(f *snapmock.FaultInjector) {
+			f.FailStateNode(2, errTransient)
+			f.FailCommit(1, errTransient)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("too many failures", func(t *testing.T) {
+		err := runCase(t, 1, func(f *snapmock.FaultInjector) {
+			f.FailStateNode(2, errTransient)
+			f.FailCommit(1, errTransient)
+		})
+		if !errors.Is(err, errTransient) {
+			t.Fatalf("expected transient error, got %v", err)
+		}
+	})
+	t.Run("fatal", func(t *testing.T) {
+		err := runCase(t, 2, func(f *snapmock.FaultInjector) { f.FailStateNode(2, errFatal) })
+		if !errors.Is(err, ErrMissingTrieNode) {
+			t.Fatalf("expected fatal error, got %v", err)
+		}
+	})
+}
+
+func TestTimeBudget(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	writeGenesisHeader(edb, writeContractState(t, edb, 1, 1000))
+	recovery := filepath.Join(t.TempDir(), "recover.csv")
+
+	// runs a snapshot, collecting the paths of the published storage nodes and expiring the budget after
+	// expireAfter of them. No rollback is expected: a stopped worker commits its batch.
+	runCase := func(t *testing.T, expireAfter int) (map[string]struct{}, error) {
+		pub, tx := makeMocks(t)
+		service, err := NewSnapshotService(edb, pub, recovery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		pub.EXPECT().BeginTx().Return(tx, nil).AnyTimes()
+		pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
+		pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		paths := map[string]struct{}{}
+		pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+			DoAndReturn(func(node *snapt.Node, _ string, _ []byte, _ snapt.Tx) error {
+				paths[string(node.Path)] = struct{}{}
+				if len(paths) == expireAfter {
+					service.budget.expire()
+				}
+				return nil
+			})
+		tx.EXPECT().Commit().MinTimes(1)
+
+		err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1, TimeBudget: time.Hour, AutoRestart: 1})
+		return paths, err
+	}
+
+	all, err := runCase(t, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := runCase(t, len(all)/2)
+	if !errors.Is(err, ErrTimeBudgetReached) {
+		t.Fatalf("expected time budget error, got %v", err)
+	}
+	test.ExpectEqual(t, len(all)/2, len(before))
+	dump, err := os.ReadFile(recovery)
+	if err != nil {
+		t.Fatal("cannot read recovery file:", err)
+	}
+	if fields := bytes.Split(bytes.TrimSpace(dump), []byte(",")); len(fields) != 3 {
+		t.Fatalf("expected a recovery row with a storage path, got %q", dump)
+	}
+
+	after, err := runCase(t, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path := range after {
+		before[path] = struct{}{}
+	}
+	test.ExpectEqual(t, all, before)
+}
+
+// writeStorageTrie writes a storage trie with slots 1 to n set to their own values, returning its root
+func writeStorageTrie(t *testing.T, sdb state.Database, n int64) common.Hash {
+	tree, err := sdb.OpenStorageTrie(common.Hash{}, common.Hash{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= n; i++ {
+		value, err := rlp.EncodeToBytes(big.NewInt(i).Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tree.TryUpdate(common.BigToHash(big.NewInt(i)).Bytes(), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, _, err := tree.Commit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sdb.TrieDB().Commit(root, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestChangedIterator(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	sdb := state.NewDatabase(edb)
+	root := writeStorageTrie(t, sdb, 1000)
+	tree, err := sdb.OpenTrie(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the nodes visited should be exactly those in the proofs of the changed keys,
+	// including that of a key not in the trie
+	proofs := memorydb.New()
+	var keys []common.Hash
+	for _, i := range []int64{7, 300, 301, 999, 5000} {
+		slot := common.BigToHash(big.NewInt(i))
+		keys = append(keys, crypto.Keccak256Hash(slot.Bytes()))
+		if err = tree.Prove(slot.Bytes(), 0, proofs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	visited := map[common.Hash]struct{}{}
+	paths, anomalies := changedPaths(keys)
+	test.ExpectEqual(t, 0, len(anomalies))
+	it := newChangedIterator(tree.NodeIterator(nil), paths)
+	for it.Next(true) {
+		if !snapt.IsNullHash(it.Hash()) {
+			visited[it.Hash()] = struct{}{}
+		}
+	}
+	if it.Error() != nil {
+		t.Fatal(it.Error())
+	}
+	test.ExpectEqual(t, proofs.Len(), len(visited))
+	pit := proofs.NewIterator(nil, nil)
+	defer pit.Release()
+	for pit.Next() {
+		if _, ok := visited[common.BytesToHash(pit.Key())]; !ok {
+			t.Fatalf("node %x on the path to a changed key was not visited", pit.Key())
+		}
+	}
+}
+
+func TestChangedPaths(t *testing.T) {
+	addr := common.HexToAddress("0xc0ffee")
+	key := crypto.Keccak256Hash(addr.Bytes())
+	other := common.HexToHash("0x01")
+	// the same account listed by address and by hash
+	paths, anomalies := changedPaths([]common.Hash{key, other, key})
+	test.ExpectEqual(t, [][]byte{keyToNibbles(other.Bytes()), keyToNibbles(key.Bytes())}, paths)
+	test.ExpectEqual(t, 1, len(anomalies))
+	if !strings.Contains(anomalies[0], key.Hex()) {
+		t.Errorf("expected anomaly to name account %s, got %q", key.Hex(), anomalies[0])
+	}
+
+	// entries of other lengths are rejected when the list is read
+	for _, entry := range []string{"0x01", addr.Hex() + "00", key.Hex() + "00"} {
+		if _, err := ParseAccountKey(entry); err == nil {
+			t.Errorf("expected %s to be rejected", entry)
+		}
+	}
+}
+
+func TestProve(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	root := writeContractState(t, edb, 1, 100)
+	writeGenesisHeader(edb, root)
+	service, err := NewSnapshotService(edb, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// verifies a proof's nodes against a root, returning the proven value
+	verify := func(t *testing.T, root common.Hash, key []byte, nodes []hexutil.Bytes) []byte {
+		proofs := memorydb.New()
+		for _, node := range nodes {
+			proofs.Put(crypto.Keccak256(node), node)
+		}
+		value, err := trie.VerifyProof(root, crypto.Keccak256(key), proofs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	contract := common.BigToAddress(big.NewInt(0xc0ffee))
+	slots := []common.Hash{common.BigToHash(big.NewInt(7)), common.BigToHash(big.NewInt(1000))}
+	proof, err := service.Prove(0, contract, slots)
+	test.NoError(t, err)
+	test.ExpectEqual(t, root, proof.StateRoot)
+	if verify(t, root, contract.Bytes(), proof.AccountProof) == nil {
+		t.Fatal("expected the account to be proven present")
+	}
+	test.ExpectEqual(t, 2, len(proof.StorageProof))
+	value := verify(t, proof.StorageHash, slots[0].Bytes(), proof.StorageProof[0].Proof)
+	test.ExpectEqual(t, []byte{0x07}, value)
+	test.ExpectEqual(t, int64(7), proof.StorageProof[0].Value.ToInt().Int64())
+	// slot 1000 is unset, so is proven absent
+	if verify(t, proof.StorageHash, slots[1].Bytes(), proof.StorageProof[1].Proof) != nil {
+		t.Fatal("expected slot 1000 to be proven absent")
+	}
+
+	// an absent account is proven absent, with no storage
+	absent := common.HexToAddress("0xdead")
+	proof, err = service.Prove(0, absent, slots[:1])
+	test.NoError(t, err)
+	if verify(t, root, absent.Bytes(), proof.AccountProof) != nil {
+		t.Fatal("expected the account to be proven absent")
+	}
+	test.ExpectEqual(t, 0, len(proof.StorageProof[0].Proof))
+
+	// the RLP encoding round-trips
+	var buf bytes.Buffer
+	test.NoError(t, WriteProof(&buf, proof, ProofRLP))
+	var decoded rlpProof
+	test.NoError(t, rlp.DecodeBytes(buf.Bytes(), &decoded))
+	reencoded, err := rlp.EncodeToBytes(decoded)
+	test.NoError(t, err)
+	test.ExpectEqual(t, buf.Bytes(), reencoded)
+	test.ExpectEqual(t, proof.AccountProof[0], hexutil.Bytes(decoded.AccountProof[0]))
+}
+
+// stateProofs serves the accounts of a state as eth_getProof results, without the proofs
+type stateProofs struct {
+	statedb *state.StateDB
+}
+
+func (p stateProofs) GetProof(_ context.Context, addr common.Address, _ []string, _ *big.Int) (*gethclient.AccountResult, error) {
+	return &gethclient.AccountResult{
+		Address:     addr,
+		Balance:     p.statedb.GetBalance(addr),
+		CodeHash:    p.statedb.GetCodeHash(addr),
+		Nonce:       p.statedb.GetNonce(addr),
+		StorageHash: p.statedb.StorageTrie(addr).Hash(),
+	}, nil
+}
+
+func TestCrossCheck(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	root := writeContractState(t, edb, 1, 10)
+	sdb := state.NewDatabase(edb)
+	statedb, err := state.New(root, sdb, nil)
+	test.NoError(t, err)
+
+	// the published leaves of the state, with the addresses of all but the contract known
+	contract := common.BigToAddress(big.NewInt(0xc0ffee))
+	preimages := map[common.Hash][]byte{}
+	for i := int64(1); i <= 10; i++ {
+		addr := common.BigToAddress(big.NewInt(i))
+		preimages[crypto.Keccak256Hash(addr.Bytes())] = addr.Bytes()
+	}
+	preimage := func(key common.Hash) []byte { return preimages[key] }
+	tree, err := sdb.OpenTrie(root)
+	test.NoError(t, err)
+	var leaves []pg.StateLeaf
+	blocks := mapBlockSource{}
+	for it := tree.NodeIterator(nil); it.Next(true); {
+		res, err := resolveNode(it, sdb.TrieDB())
+		test.NoError(t, err)
+		if res == nil || res.node.NodeType != snapt.Leaf {
+			continue
+		}
+		c, err := ipld.RawdataToCid(ipld.MEthStateTrie, res.node.Value, multihash.KECCAK_256)
+		test.NoError(t, err)
+		blocks[c.String()] = append([]byte{}, res.node.Value...)
+		leaves = append(leaves, pg.StateLeaf{LeafKey: res.leafKey().Hex(), CID: c.String(), Path: res.node.Path})
+	}
+	test.ExpectEqual(t, 11, len(leaves))
+
+	report := &CrossCheckReport{StateRoot: root}
+	rootCID, err := StateRootCID(root)
+	test.NoError(t, err)
+	test.NoError(t, report.CheckRoot(rootCID))
+	report.CheckStateRoot(root)
+	test.NoError(t, report.CheckAccounts(context.Background(), leaves, blocks, stateProofs{statedb}, preimage))
+	test.ExpectEqual(t, 10, report.Checked)
+	test.ExpectEqual(t, 1, report.Skipped)
+	test.ExpectEqual(t, 0, len(report.Mismatches))
+
+	// a live state differing in one account, and a missing root node, are reported
+	preimages[crypto.Keccak256Hash(contract.Bytes())] = contract.Bytes()
+	statedb.SetNonce(common.BigToAddress(big.NewInt(3)), 5)
+	report = &CrossCheckReport{StateRoot: root}
+	test.NoError(t, report.CheckRoot(""))
+	test.NoError(t, report.CheckAccounts(context.Background(), leaves, blocks, stateProofs{statedb}, preimage))
+	test.ExpectEqual(t, 11, report.Checked)
+	test.ExpectEqual(t, 2, len(report.Mismatches))
+	test.ExpectEqual(t, "root node CID", report.Mismatches[0].Field)
+	test.ExpectEqual(t, "nonce", report.Mismatches[1].Field)
+	test.ExpectEqual(t, crypto.Keccak256Hash(common.BigToAddress(big.NewInt(3)).Bytes()), report.Mismatches[1].Account)
+}
+
+func TestPreimageLookup(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	addr := common.HexToAddress("0xc0ffee")
+	key := crypto.Keccak256Hash(addr.Bytes())
+	rawdb.WritePreimages(edb, map[common.Hash][]byte{key: addr.Bytes()})
+
+	preimages := newPreimageLookup(true, edb)
+	test.ExpectEqual(t, addr.Bytes(), preimages.lookup(key))
+	if preimages.lookup(common.HexToHash("0x01")) != nil {
+		t.Fatal("expected no preimage")
+	}
+	test.ExpectEqual(t, uint64(1), preimages.found)
+	test.ExpectEqual(t, uint64(1), preimages.missing)
+
+	// disabled lookups return nothing
+	if newPreimageLookup(false, edb).lookup(key) != nil {
+		t.Fatal("expected no preimage")
+	}
+}
+
+func TestDuplicateDetector(t *testing.T) {
+	detector := newDuplicateDetector(true)
+	statePath := []byte{0x1, 0x2}
+	test.ExpectEqual(t, true, detector.check("0xa", nil, statePath))
+	test.ExpectEqual(t, false, detector.check("0xa", nil, statePath))
+	// the same path in a storage trie, or under another header, is distinct
+	test.ExpectEqual(t, true, detector.check("0xa", statePath, statePath))
+	test.ExpectEqual(t, true, detector.check("0xb", nil, statePath))
+	// a storage path isn't confused with the state path it extends
+	test.ExpectEqual(t, true, detector.check("0xa", []byte{0x1}, []byte{0x2}))
+	test.ExpectEqual(t, false, detector.check("0xa", statePath, statePath))
+	test.ExpectEqual(t, uint64(2), detector.count)
+
+	// a disabled detector reports nothing
+	disabled := newDuplicateDetector(false)
+	test.ExpectEqual(t, true, disabled.check("0xa", nil, statePath))
+	test.ExpectEqual(t, true, disabled.check("0xa", nil, statePath))
+}
+
+func TestStorageSubtrieSplit(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	sdb := state.NewDatabase(edb)
+	root := writeStorageTrie(t, sdb, 5000)
+
+	// collects the published storage nodes by path, as nodes at the subtrie boundaries may be repeated
+	runCase := func(t *testing.T, split storageSplitter) map[string][]byte {
+		pub, tx := makeMocks(t)
+		var mu sync.Mutex
+		nodes := map[string][]byte{}
+		pub.EXPECT().BeginTx().Return(tx, nil).AnyTimes()
+		pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
+		pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+			DoAndReturn(func(node *snapt.Node, _ string, statePath []byte, _ snapt.Tx) error {
+				if !bytes.Equal([]byte{1}, statePath) {
+					t.Errorf("unexpected state path %x", statePath)
+				}
+				if node.StateKey != (common.Hash{1}) {
+					t.Errorf("unexpected state key %s", node.StateKey.Hex())
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				nodes[string(node.Path)] = append([]byte{}, node.Value...)
+				return nil
+			})
+		tx.EXPECT().Commit().AnyTimes()
+
+		service, err := NewSnapshotService(edb, pub, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.storageSplit = split
+		if _, err = service.storageSnapshot(root, "header", []byte{1}, common.Hash{1}, tx, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		return nodes
+	}
+
+	split := storageSplitter{workers: 4, threshold: 100}
+	sTrie, err := sdb.OpenTrie(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := split.isLarge(sTrie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !large {
+		t.Fatal("expected storage trie to be split")
+	}
+
+	serial := runCase(t, storageSplitter{})
+	concurrent := runCase(t, split)
+	test.ExpectEqual(t, serial, concurrent)
+
+	// a split the trie can't be divided into is rejected before anything is published
+	pub, _ := makeMocks(t)
+	service, err := NewSnapshotService(edb, pub, "")
+	test.NoError(t, err)
+	if err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1, StorageSubtrieSplit: 3}); err == nil {
+		t.Fatal("expected a storage subtrie split of 3 to be rejected")
+	}
+}
+
+func TestStorageRootCache(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	sdb := state.NewDatabase(edb)
+	root := writeStorageTrie(t, sdb, 100)
+
+	// publishes the same storage trie for two accounts, collecting the published nodes of each by path
+	runCase := func(t *testing.T, cache uint) ([2]map[string][]byte, *storageRootCache) {
+		pub, tx := makeMocks(t)
+		nodes := [2]map[string][]byte{{}, {}}
+		pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
+		pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+			DoAndReturn(func(node *snapt.Node, _ string, statePath []byte, _ snapt.Tx) error {
+				account := int(statePath[0])
+				if node.StateKey != (common.Hash{byte(account)}) {
+					t.Errorf("unexpected state key %s for account at path %x", node.StateKey.Hex(), statePath)
+				}
+				nodes[account][string(node.Path)] = append([]byte{}, node.Value...)
+				return nil
+			})
+
+		service, err := NewSnapshotService(edb, pub, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		service.storageRoots = newStorageRootCache(cache)
+		for account := byte(0); account < 2; account++ {
+			if _, err = service.storageSnapshot(root, "header", []byte{account}, common.Hash{account}, tx, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nodes, service.storageRoots
+	}
+
+	uncached, _ := runCase(t, 0)
+	test.ExpectEqual(t, uncached[0], uncached[1])
+
+	nodes, cache := runCase(t, 1000)
+	test.ExpectEqual(t, uncached, nodes)
+	test.ExpectEqual(t, uint64(1), cache.hits)
+	test.ExpectEqual(t, uint64(len(uncached[0])), cache.reused)
+
+	// a trie which doesn't fit in the cache is walked again
+	nodes, cache = runCase(t, uint(len(uncached[0])-1))
+	test.ExpectEqual(t, uncached, nodes)
+	test.ExpectEqual(t, uint64(0), cache.hits)
+	test.ExpectEqual(t, 0, len(cache.roots))
+}
+
+func TestDumpCode(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	sdb := state.NewDatabase(edb)
+	statedb, err := state.New(common.Hash{}, sdb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two clones of one contract, another contract and an account without code
+	shared, other := []byte{0x60, 0x00, 0x60, 0x00, 0xf3}, []byte{0x60, 0x01}
+	statedb.SetCode(common.BigToAddress(big.NewInt(1)), shared)
+	statedb.SetCode(common.BigToAddress(big.NewInt(2)), shared)
+	statedb.SetCode(common.BigToAddress(big.NewInt(3)), other)
+	statedb.SetBalance(common.BigToAddress(big.NewInt(4)), big.NewInt(4))
+	root, err := statedb.Commit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sdb.TrieDB().Commit(root, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	writeGenesisHeader(edb, root)
+
+	service, err := NewSnapshotService(edb, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := func(addresses []common.Address) map[common.Hash][]byte {
+		codes := map[common.Hash][]byte{}
+		err := service.DumpCode(0, addresses, func(code ContractCode) error {
+			if _, ok := codes[code.Hash]; ok {
+				t.Errorf("code %s dumped twice", code.Hash.Hex())
+			}
+			codes[code.Hash] = code.Code
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return codes
+	}
+
+	sharedHash, otherHash := crypto.Keccak256Hash(shared), crypto.Keccak256Hash(other)
+	test.ExpectEqual(t, map[common.Hash][]byte{sharedHash: shared, otherHash: other}, dump(nil))
+	test.ExpectEqual(t, map[common.Hash][]byte{sharedHash: shared},
+		dump([]common.Address{common.BigToAddress(big.NewInt(2)), common.BigToAddress(big.NewInt(4))}))
+
+	var out bytes.Buffer
+	dir := t.TempDir()
+	w, err := NewCodeDumpWriter(&out, ExportCSV, true, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Write(ContractCode{Hash: otherHash, Code: other}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	test.ExpectEqual(t, "code_hash,size,code\n"+otherHash.Hex()+",2,0x6001\n", out.String())
+	written, err := os.ReadFile(CodeFile(dir, otherHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.ExpectEqual(t, other, written)
+}
+
+func TestStorageRootCacheRecovery(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	// two contracts with the same storage, the second published from the cache
+	writeGenesisHeader(edb, writeContractState(t, edb, 2, 100))
+	recovery := filepath.Join(t.TempDir(), "recover.csv")
+
+	// runs a snapshot, collecting the published storage nodes by state and storage path, and expiring the
+	// budget after expireAfter of them
+	runCase := func(t *testing.T, expireAfter int) (map[string]struct{}, *Service, error) {
+		pub, tx := makeMocks(t)
+		service, err := NewSnapshotService(edb, pub, recovery)
+		test.NoError(t, err)
+		pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		pub.EXPECT().BeginTx().Return(tx, nil).AnyTimes()
+		pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
+		pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		pub.EXPECT().PublishCode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+		nodes := map[string]struct{}{}
+		pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+			DoAndReturn(func(node *snapt.Node, _ string, statePath []byte, _ snapt.Tx) error {
+				nodes[fmt.Sprintf("%x/%x", statePath, node.Path)] = struct{}{}
+				if len(nodes) == expireAfter {
+					service.budget.expire()
+				}
+				return nil
+			})
+		tx.EXPECT().Commit().AnyTimes()
+
+		err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1, TimeBudget: time.Hour, StorageRootCache: 1000})
+		return nodes, service, err
+	}
+
+	all, _, err := runCase(t, -1)
+	test.NoError(t, err)
+	// stop halfway through the second contract's storage
+	before, service, err := runCase(t, len(all)*3/4)
+	if !errors.Is(err, ErrTimeBudgetReached) {
+		t.Fatalf("expected time budget error, got %v", err)
+	}
+	test.ExpectEqual(t, uint64(1), service.storageRoots.hits)
+	dump, err := os.ReadFile(recovery)
+	test.NoError(t, err)
+	if fields := bytes.Split(bytes.TrimSpace(dump), []byte(",")); len(fields) != 3 {
+		t.Fatalf("expected a recovery row with a storage path, got %q", dump)
+	}
+
+	// the resumed run publishes the rest of the storage, and none of it again
+	after, _, err := runCase(t, -1)
+	test.NoError(t, err)
+	for key := range after {
+		if _, ok := before[key]; ok {
+			t.Errorf("storage node %s published again", key)
+		}
+		before[key] = struct{}{}
+	}
+	test.ExpectEqual(t, all, before)
+}
+
+func TestStorageShard(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	writeGenesisHeader(edb, writeContractState(t, edb, 1, 500))
+	account := crypto.Keccak256Hash(common.BigToAddress(big.NewInt(0xc0ffee)).Bytes())
+
+	fullPub, full := collectNodes(t)
+	service, err := NewSnapshotService(edb, fullPub, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the state run skips the account's storage, which two shards split between them
+	statePub, union := collectNodes(t)
+	service, err = NewSnapshotService(edb, statePub, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1, ShardedStorage: []common.Hash{account}}); err != nil {
+		t.Fatal(err)
+	}
+	for key := range union {
+		if strings.HasPrefix(key, "storage/") {
+			t.Errorf("state run published storage node %s", key)
+		}
+	}
+	for _, shard := range [][]string{{"0", "1", "2", "3", "4", "5", "6", "7"}, {"8", "9", "a", "b", "c", "d", "e", "f"}} {
+		var prefixes [][]byte
+		for _, s := range shard {
+			prefix, err := ParseStoragePrefix(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		shardPub, nodes := collectNodes(t)
+		service, err = NewSnapshotService(edb, shardPub, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = service.CreateStorageShard(0, account, prefixes); err != nil {
+			t.Fatal(err)
+		}
+		for key, c := range nodes {
+			union[key] = c
+		}
+	}
+	test.ExpectEqual(t, full, union)
+
+	if _, err := ParseStoragePrefix("0xg"); err == nil {
+		t.Error("expected an invalid prefix to fail")
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	writeGenesisHeader(edb, writeContractState(t, edb, 1, 10))
+
+	var mu sync.Mutex
+	var received []WebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		received = append(received, payload)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	all, err := ParseWebhookEvents(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := collectNodes(t)
+	service, err := NewSnapshotService(edb, pub, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := SnapshotParams{Height: 0, Workers: 1, WebhookURL: server.URL, WebhookEvents: all}
+	if err = service.CreateSnapshot(params); err != nil {
+		t.Fatal(err)
+	}
+	test.ExpectEqual(t, 2, len(received))
+	test.ExpectEqual(t, WebhookStart, received[0].Event)
+	test.ExpectEqual(t, WebhookComplete, received[1].Event)
+
+	// only the selected events are posted, here the failure of a snapshot at a missing height
+	received = nil
+	failures, err := ParseWebhookEvents([]string{"failure"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failPub, _ := makeMocks(t)
+	service, err = NewSnapshotService(edb, failPub, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params = SnapshotParams{Height: 5, Workers: 1, WebhookURL: server.URL, WebhookEvents: failures}
+	if err = service.CreateSnapshot(params); err == nil {
+		t.Fatal("expected snapshot to fail")
+	}
+	test.ExpectEqual(t, 1, len(received))
+	test.ExpectEqual(t, WebhookFailure, received[0].Event)
+	test.ExpectEqual(t, uint64(5), received[0].Height)
+	test.ExpectEqual(t, err.Error(), received[0].Error)
+
+	// failures to deliver don't fail the snapshot
+	server.Close()
+	pub, _ = collectNodes(t)
+	service, err = NewSnapshotService(edb, pub, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params = SnapshotParams{Height: 0, Workers: 1, WebhookURL: server.URL, WebhookEvents: all}
+	if err = service.CreateSnapshot(params); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseWebhookEvents([]string{"height"}); err == nil {
+		t.Error("expected an invalid event to fail")
+	}
+}
+
+// mapBlockSource serves blocks by CID
+type mapBlockSource map[string][]byte
+
+func (src mapBlockSource) GetBlock(_ context.Context, c cid.Cid, _ string) ([]byte, error) {
+	return src[c.String()], nil
+}
+
+func TestReplayManifest(t *testing.T) {
+	edb := rawdb.NewMemoryDatabase()
+	defer edb.Close()
+	writeGenesisHeader(edb, writeContractState(t, edb, 2, 10))
+
+	// snapshot through a publisher recording the manifest entries and blocks
+	var entries []snapt.ManifestEntry
+	blocks := mapBlockSource{}
+	var mu sync.Mutex
+	record := func(kind string, codec uint64, node *snapt.Node, statePath []byte) error {
+		c, err := ipld.RawdataToCid(codec, node.Value, multihash.KECCAK_256)
+		if err != nil {
+			return err
+		}
+		e := snapt.ManifestEntry{Kind: kind, CID: c.String(), StatePath: statePath, Path: node.Path, NodeType: node.NodeType}
+		if node.NodeType == snapt.Leaf {
+			e.LeafKey = node.Key.Hex()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		entries = append(entries, e)
+		blocks[c.String()] = node.Value
+		return nil
+	}
+	pub, tx := makeMocks(t)
+	pub.EXPECT().PublishHeader(gomock.Any(), gomock.Any(), gomock.Any())
+	pub.EXPECT().BeginTx().Return(tx, nil)
+	pub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(tx, nil).AnyTimes()
+	pub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+		DoAndReturn(func(node *snapt.Node, _ string, _ snapt.Tx) error {
+			return record(snapt.StateManifestKind, ipld.MEthStateTrie, node, nil)
+		})
+	pub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().
+		DoAndReturn(func(node *snapt.Node, _ string, statePath []byte, _ snapt.Tx) error {
+			return record(snapt.StorageManifestKind, ipld.MEthStorageTrie, node, statePath)
+		})
+	pub.EXPECT().PublishCode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	tx.EXPECT().Commit()
+	service, err := NewSnapshotService(edb, pub, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.NoError(t, service.CreateSnapshot(SnapshotParams{Height: 0, Workers: 1}))
+
+	manifest := filepath.Join(t.TempDir(), "manifest.csv")
+	mw, err := snapt.NewManifestWriter(manifest)
+	test.NoError(t, err)
+	test.NoError(t, mw.Write(entries))
+	test.NoError(t, mw.Close())
+
+	// replaying republishes every node with the same path and CID
+	replayPub, replayed := collectNodes(t)
+	// as the replay command would, publish the header first
+	test.NoError(t, replayPub.PublishHeader(&types.Header{}, nil, nil))
+	stats, err := ReplayManifest(context.Background(), manifest, blocks, replayPub, "0x01")
+	test.NoError(t, err)
+	test.ExpectEqual(t, uint64(len(entries)), stats.StateNodes+stats.StorageNodes)
+	test.ExpectEqual(t, len(entries), len(replayed))
+	for _, e := range entries {
+		key := fmt.Sprintf("%s/%x/%x", e.Kind, e.StatePath, e.Path)
+		test.ExpectEqual(t, e.CID, replayed[key])
+	}
+
+	// a block which doesn't hash to its CID is rejected
+	corrupt := mapBlockSource{}
+	for c, data := range blocks {
+		corrupt[c] = data
+	}
+	corrupt[entries[len(entries)-1].CID] = []byte{0xc0}
+	failPub, failTx := makeMocks(t)
+	failPub.EXPECT().BeginTx().Return(failTx, nil)
+	failPub.EXPECT().PrepareTxForBatch(gomock.Any(), gomock.Any()).Return(failTx, nil).AnyTimes()
+	failPub.EXPECT().PublishStateNode(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	failPub.EXPECT().PublishStorageNode(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes()
+	failTx.EXPECT().Rollback().AnyTimes()
+	_, err = ReplayManifest(context.Background(), manifest, corrupt, failPub, "0x01")
+	if !errors.Is(err, ErrBlockMismatch) {
+		t.Fatalf("expected ErrBlockMismatch, got %v", err)
+	}
+}
+
+func TestFlushWorkerStartup(t *testing.T) {
+	pub, tx := makeMocks(t)
+	pub.EXPECT().BeginTx().Return(tx, nil).AnyTimes()
+	tx.EXPECT().Commit().AnyTimes()
+	service := &Service{ipfsPublisher: pub}
+
+	first := service.flusher.register()
+	flushed := make(chan error, 1)
+	go func() { flushed <- service.Flush(context.Background()) }()
+	for atomic.LoadInt32(&service.flusher.requested) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// a worker started during the flush isn't waited on, so its checkpoint doesn't pause it
+	late := service.flusher.register()
+	next, err := service.checkpoint(late, tx)
+	test.NoError(t, err)
+	test.ExpectEqual(t, tx, next)
+	service.flusher.unregister(late)
+
+	_, err = service.checkpoint(first, tx)
+	test.NoError(t, err)
+	test.NoError(t, <-flushed)
+	service.flusher.unregister(first)
+
+	// a worker splitting a storage trie hands its place in a pending flush to the walkers
+	parent := service.flusher.register()
+	go func() { flushed <- service.Flush(context.Background()) }()
+	for atomic.LoadInt32(&service.flusher.requested) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	walkers := service.flusher.handOff(parent, 2)
+	walked := make(chan error, 1)
+	go func() {
+		_, err := service.checkpoint(walkers[0], tx)
+		walked <- err
+	}()
+	service.flusher.unregister(walkers[1])
+	test.NoError(t, <-flushed)
+	test.NoError(t, <-walked)
+	service.flusher.unregister(walkers[0])
+	service.flusher.takeBack(parent)
+	service.flusher.unregister(parent)
+
+	// workers starting and stopping while flushes are requested
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m := service.flusher.register()
+				if _, err := service.checkpoint(m, tx); err != nil {
+					t.Error(err)
+				}
+				service.flusher.unregister(m)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			test.NoError(t, service.Flush(context.Background()))
+		}
+	}
 }
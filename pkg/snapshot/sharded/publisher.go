@@ -0,0 +1,267 @@
+// Copyright © 2022 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sharded
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+
+	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+var _ snapt.Publisher = (*publisher)(nil)
+var _ snapt.StateNodeCounter = (*publisher)(nil)
+var _ snapt.BatchTxBeginner = (*publisher)(nil)
+var _ snapt.StatsReporter = (*publisher)(nil)
+
+const logInterval = 1 * time.Minute
+
+// ShardFunc specifies how nodes are assigned to shards
+type ShardFunc string
+
+const (
+	// ShardByPrefix assigns each shard a contiguous range of the first path nibble, so that each
+	// shard holds whole subtries
+	ShardByPrefix ShardFunc = "prefix"
+	// ShardByHash assigns nodes by a hash of their path, spreading load evenly regardless of the
+	// shape of the trie
+	ShardByHash ShardFunc = "hash"
+)
+
+// HeaderPlacement specifies which shards the header is written to
+type HeaderPlacement string
+
+const (
+	// HeadersToAll replicates the header to every shard
+	HeadersToAll HeaderPlacement = "all"
+	// HeadersToMeta writes the header only to the first (metadata) shard
+	HeadersToMeta HeaderPlacement = "meta"
+)
+
+func ParseShardFunc(s string) (ShardFunc, error) {
+	switch f := ShardFunc(s); f {
+	case ShardByPrefix, ShardByHash:
+		return f, nil
+	case "":
+		return ShardByPrefix, nil
+	}
+	return "", fmt.Errorf("invalid shard function: %s", s)
+}
+
+func ParseHeaderPlacement(s string) (HeaderPlacement, error) {
+	switch p := HeaderPlacement(s); p {
+	case HeadersToAll, HeadersToMeta:
+		return p, nil
+	case "":
+		return HeadersToAll, nil
+	}
+	return "", fmt.Errorf("invalid header placement: %s", s)
+}
+
+// publisher routes nodes to one of several publishers by their path.
+// State nodes are routed by their own path, and storage nodes by the path of the account which
+// owns them, so that an account's storage trie is held by the same shard as its leaf.
+type publisher struct {
+	shards    []snapt.Publisher
+	shardFunc ShardFunc
+	headers   HeaderPlacement
+	statsFile string
+}
+
+type shardedTx []snapt.Tx
+
+func (tx shardedTx) Commit() error {
+	for i, t := range tx {
+		if err := t.Commit(); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (tx shardedTx) Rollback() error {
+	var ret error
+	for i, t := range tx {
+		if err := t.Rollback(); err != nil && ret == nil {
+			ret = fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return ret
+}
+
+// NewPublisher creates a publisher which distributes its output across the given shard publishers
+func NewPublisher(shards []snapt.Publisher, shardFunc ShardFunc, headers HeaderPlacement) (*publisher, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards configured")
+	}
+	return &publisher{
+		shards:    shards,
+		shardFunc: shardFunc,
+		headers:   headers,
+	}, nil
+}
+
+// SetStatsFile sets a file to which the stats summed across all shards are periodically written
+func (p *publisher) SetStatsFile(path string) {
+	p.statsFile = path
+	if path != "" {
+		go p.writeStats()
+	}
+}
+
+// shard returns the index of the shard for a path
+func (p *publisher) shard(path []byte) int {
+	n := len(p.shards)
+	if p.shardFunc == ShardByHash {
+		h := fnv.New32a()
+		h.Write(path)
+		return int(h.Sum32() % uint32(n))
+	}
+	// the root node has an empty path, and is held by the first shard
+	if len(path) == 0 {
+		return 0
+	}
+	return int(path[0]&0xf) * n / 16
+}
+
+func (p *publisher) PublishHeader(header *types.Header, td, reward *big.Int) error {
+	shards := p.shards
+	if p.headers == HeadersToMeta {
+		shards = shards[:1]
+	}
+	for i, shard := range shards {
+		if err := shard.PublishHeader(header, td, reward); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (p *publisher) PublishStateNode(node *snapt.Node, headerID string, tx snapt.Tx) error {
+	i := p.shard(node.Path)
+	return p.shards[i].PublishStateNode(node, headerID, tx.(shardedTx)[i])
+}
+
+func (p *publisher) PublishStorageNode(node *snapt.Node, headerID string, statePath []byte, tx snapt.Tx) error {
+	i := p.shard(statePath)
+	return p.shards[i].PublishStorageNode(node, headerID, statePath, tx.(shardedTx)[i])
+}
+
+// PublishCode writes the code to the shard selected by its hash, as it has no path
+func (p *publisher) PublishCode(codeHash common.Hash, codeBytes []byte, tx snapt.Tx) error {
+	key := codeHash.Bytes()
+	if p.shardFunc == ShardByPrefix {
+		// use the first nibble, as for paths
+		key = []byte{codeHash[0] >> 4}
+	}
+	i := p.shard(key)
+	return p.shards[i].PublishCode(codeHash, codeBytes, tx.(shardedTx)[i])
+}
+
+func (p *publisher) BeginTx() (snapt.Tx, error) {
+	tx := make(shardedTx, 0, len(p.shards))
+	for i, shard := range p.shards {
+		t, err := shard.BeginTx()
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		tx = append(tx, t)
+	}
+	return tx, nil
+}
+
+// BeginBatchTx begins a transaction on each shard, without the per-worker setup of the shards which support it
+func (p *publisher) BeginBatchTx() (snapt.Tx, error) {
+	tx := make(shardedTx, 0, len(p.shards))
+	for i, shard := range p.shards {
+		t, err := snapt.BeginBatchTx(shard)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		tx = append(tx, t)
+	}
+	return tx, nil
+}
+
+func (p *publisher) PrepareTxForBatch(tx snapt.Tx, maxBatchSize uint) (snapt.Tx, error) {
+	prev := tx.(shardedTx)
+	next := make(shardedTx, len(prev))
+	for i, shard := range p.shards {
+		t, err := shard.PrepareTxForBatch(prev[i], maxBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		next[i] = t
+	}
+	return next, nil
+}
+
+// CountStateNodes returns the number of state nodes indexed for the header across all shards
+func (p *publisher) CountStateNodes(headerID string) (int64, error) {
+	var total int64
+	for i, shard := range p.shards {
+		counter, ok := shard.(snapt.StateNodeCounter)
+		if !ok {
+			return 0, fmt.Errorf("shard %d cannot count state nodes", i)
+		}
+		count, err := counter.CountStateNodes(headerID)
+		if err != nil {
+			return 0, fmt.Errorf("shard %d: %w", i, err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// Stats returns the node counts summed across all shards
+func (p *publisher) Stats() snapt.Stats {
+	var ret snapt.Stats
+	for _, shard := range p.shards {
+		reporter, ok := shard.(snapt.StatsReporter)
+		if !ok {
+			continue
+		}
+		stats := reporter.Stats()
+		if ret.StartTime.IsZero() || stats.StartTime.Before(ret.StartTime) {
+			ret.StartTime = stats.StartTime
+		}
+		ret.StateNodes += stats.StateNodes
+		ret.StorageNodes += stats.StorageNodes
+		ret.CodeNodes += stats.CodeNodes
+		ret.SkippedBlocks += stats.SkippedBlocks
+	}
+	ret.UpdatedAt = time.Now()
+	ret.Runtime = ret.UpdatedAt.Sub(ret.StartTime).String()
+	return ret
+}
+
+// writeStats periodically writes the summed stats to the stats file
+func (p *publisher) writeStats() {
+	t := time.NewTicker(logInterval)
+	for range t.C {
+		if err := snapt.WriteStatsFile(p.statsFile, p.Stats()); err != nil {
+			log.Errorf("failed to write stats file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+)
+
+// ErrInsufficientSpace is returned by the pre-flight space check if the database lacks room for the snapshot
+var ErrInsufficientSpace = errors.New("insufficient database space")
+
+// DefaultSpaceMargin is the headroom required over the estimated snapshot size, as a fraction of it
+const DefaultSpaceMargin = 0.2
+
+// EstimateSpace estimates the space a snapshot takes from the space used by the database, or from the
+// expected size if it is set, and checks it fits in the free space within maxSize (0 if unknown) with
+// the margin. It returns the estimate, zero if there is no basis for one, with the rationale.
+func EstimateSpace(usage *pg.SpaceUsage, expected, maxSize uint64, margin float64) (uint64, string, error) {
+	estimate := expected
+	reason := fmt.Sprintf("expected snapshot size %s", formatBytes(expected))
+	if estimate == 0 {
+		if usage.Headers == 0 || usage.NodesSize == 0 {
+			return 0, "no snapshot in the database to estimate from, and no expected size set", nil
+		}
+		// the average over the headers in the database, which may overestimate if some have no snapshot
+		// and underestimate if the state has grown since
+		estimate = usage.NodesSize / usage.Headers
+		reason = fmt.Sprintf("estimated snapshot size %s, the average over %d headers in the database",
+			formatBytes(estimate), usage.Headers)
+	}
+	if maxSize == 0 {
+		return estimate, reason + ", free space unknown as no maximum database size is set", nil
+	}
+	required := estimate + uint64(float64(estimate)*margin)
+	var free uint64
+	if usage.DatabaseSize < maxSize {
+		free = maxSize - usage.DatabaseSize
+	}
+	reason += fmt.Sprintf(", %s required with a %.0f%% margin, %s free of %s", formatBytes(required), margin*100,
+		formatBytes(free), formatBytes(maxSize))
+	if required > free {
+		return estimate, reason, fmt.Errorf("%w: %s", ErrInsufficientSpace, reason)
+	}
+	return estimate, reason, nil
+}
+
+// CheckSpace estimates the space a snapshot takes in postgres mode, and compares it to the free space of
+// the database. A lack of space is logged as a warning, or returned as an error if it is required.
+func CheckSpace(mode SnapshotMode, config *Config) error {
+	if mode != PgSnapshot {
+		return nil
+	}
+	if len(config.DB.Shards) > 0 {
+		log.Info("skipping the database space check, which isn't supported with sharded output")
+		return nil
+	}
+	ctx := context.Background()
+	driver, err := postgres.NewPGXDriver(ctx, config.DB.ConnConfig, config.Eth.NodeInfo)
+	if err != nil {
+		return err
+	}
+	db := postgres.NewPostgresDB(driver)
+	defer db.Close()
+	usage, err := pg.QuerySpaceUsage(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to query database space usage: %w", err)
+	}
+	log.Infof("database size is %s, of which the snapshot tables take %s",
+		formatBytes(usage.DatabaseSize), formatBytes(usage.NodesSize))
+
+	_, reason, err := EstimateSpace(usage, config.DB.ExpectedSize, config.DB.MaxSize, config.DB.SpaceMargin)
+	if err != nil {
+		if config.DB.RequireSpace {
+			return err
+		}
+		log.Warn(err)
+		return nil
+	}
+	log.Infof("database space check: %s", reason)
+	return nil
+}
+
+// formatBytes formats a size in bytes in MB, the unit of the size settings
+func formatBytes(n uint64) string {
+	return fmt.Sprintf("%d MB", n/(1024*1024))
+}
@@ -0,0 +1,106 @@
+package snapshot
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/trie"
+	log "github.com/sirupsen/logrus"
+
+	iter "github.com/vulcanize/go-eth-state-node-iterator"
+)
+
+// subtrieIterators divides a trie into ranges for concurrent iteration; a variable so tests can replace it
+// with a split yielding fewer iterators than ranges. The number of ranges must be a power of two, or it panics.
+var subtrieIterators = iter.SubtrieIterators
+
+// isPowerOfTwo reports whether n is a power of two, and so a number of ranges a trie can be split into
+func isPowerOfTwo(n uint) bool {
+	return n != 0 && n&(n-1) == 0
+}
+
+// floorPowerOfTwo returns the largest power of two not greater than n, or 1 if n is 0
+func floorPowerOfTwo(n uint) uint {
+	p := uint(1)
+	for p*2 <= n {
+		p *= 2
+	}
+	return p
+}
+
+// CheckSplitCount returns an error if a trie can't be split between n walkers, that is if n is over 1 and
+// not a power of two. name describes the setting n is read from.
+func CheckSplitCount(name string, n uint) error {
+	if n > 1 && !isPowerOfTwo(n) {
+		return fmt.Errorf("%s must be a power of two, got %d", name, n)
+	}
+	return nil
+}
+
+// splitTrie returns an iterator for each of the workers a trie is divided between. A trie can only be split
+// between a power of two workers, so other counts fall back to the largest power of two below them, with a
+// warning, and fewer iterators than workers are returned. If the split doesn't yield one iterator per range,
+// its ranges can't be relied on to cover the trie, so a single iterator over the whole trie is returned instead.
+func splitTrie(tree state.Trie, workers uint, failOnEmptyRange bool) ([]trie.NodeIterator, error) {
+	if !isPowerOfTwo(workers) {
+		split := floorPowerOfTwo(workers)
+		log.Warnf("the state trie can only be split between a power of two workers, using %d of the %d workers",
+			split, workers)
+		workers = split
+	}
+	if workers == 1 {
+		return []trie.NodeIterator{tree.NodeIterator(nil)}, nil
+	}
+	iters := subtrieIterators(tree, workers)
+	if uint(len(iters)) != workers {
+		log.Warnf("splitting the state trie between %d workers yielded %d iterators, falling back to a single worker",
+			workers, len(iters))
+		return []trie.NodeIterator{tree.NodeIterator(nil)}, nil
+	}
+	empty, err := emptyRanges(tree, workers)
+	if err != nil {
+		return nil, err
+	}
+	if len(empty) > 0 {
+		if failOnEmptyRange {
+			return nil, fmt.Errorf("%w: %d of %d workers' ranges hold no nodes", ErrEmptyRange, len(empty), workers)
+		}
+		log.Warnf("%d of %d workers' ranges hold no nodes, the split is unbalanced", len(empty), workers)
+	}
+	return iters, nil
+}
+
+// subtrieRanges returns the start and end paths of the ranges iter.SubtrieIterators divides a trie into
+func subtrieRanges(nbins uint) (starts, ends [][]byte) {
+	prefixes := iter.MakePaths(nil, nbins)
+	prefixes = append(prefixes, nil)
+	// the first range includes the root, and the last runs to the end of the trie
+	prefixes[0] = nil
+	for i := 0; i < len(prefixes)-1; i++ {
+		start := prefixes[i]
+		if len(start)%2 != 0 {
+			start = append(start, 0)
+		}
+		starts = append(starts, start)
+		ends = append(ends, prefixes[i+1])
+	}
+	return starts, ends
+}
+
+// emptyRanges returns the indexes of the ranges of a split of a trie between nbins workers which hold no nodes
+func emptyRanges(tree state.Trie, nbins uint) ([]int, error) {
+	starts, ends := subtrieRanges(nbins)
+	var empty []int
+	for i := range starts {
+		it := iter.NewPrefixBoundIterator(tree.NodeIterator(iter.HexToKeyBytes(starts[i])), ends[i])
+		if it.Next(true) {
+			continue
+		}
+		if err := it.Error(); err != nil {
+			return nil, wrapTrieError(err)
+		}
+		log.Debugf("range %d of %d, from path %x to %x, is empty", i, nbins, starts[i], ends[i])
+		empty = append(empty, i)
+	}
+	return empty, nil
+}
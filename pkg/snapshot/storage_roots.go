@@ -0,0 +1,131 @@
+package snapshot
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// storageRootCache holds the nodes of the storage tries already published, by root, so that the storage of
+// another account with the same root is published from the cache rather than walked again. Storage rows are
+// keyed by the path of the owning account, so the cached nodes are still published once per account; only
+// the trie walk, and the database reads it makes, are saved. The cache is bounded by a total number of nodes,
+// and tries which don't fit in what is left of it aren't cached.
+// A nil *storageRootCache caches nothing.
+type storageRootCache struct {
+	mu    sync.Mutex
+	roots map[common.Hash][]cachedStorageNode
+	// number of nodes which can still be cached
+	free int
+
+	hits, reused uint64
+}
+
+// cachedStorageNode is a copy of a published storage node, and the RLP encoded slot value of a leaf
+type cachedStorageNode struct {
+	node Node
+	slot []byte
+}
+
+func newStorageRootCache(maxNodes uint) *storageRootCache {
+	if maxNodes == 0 {
+		return nil
+	}
+	return &storageRootCache{roots: make(map[common.Hash][]cachedStorageNode), free: int(maxNodes)}
+}
+
+// lookup returns the cached nodes of the storage trie with the given root, if it was published in full
+func (c *storageRootCache) lookup(root common.Hash) ([]cachedStorageNode, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	nodes, ok := c.roots[root]
+	c.mu.Unlock()
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+		atomic.AddUint64(&c.reused, uint64(len(nodes)))
+	}
+	return nodes, ok
+}
+
+// recorder returns a recording of the nodes of the storage trie with the given root, to be added to the
+// cache once the whole trie is published, or nil if the cache is full
+func (c *storageRootCache) recorder(root common.Hash) *storageRecording {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.free == 0 {
+		return nil
+	}
+	return &storageRecording{root: root, limit: c.free}
+}
+
+// store adds a complete recording to the cache, if it still fits
+func (c *storageRootCache) store(rec *storageRecording) {
+	if c == nil || rec == nil || rec.overflow {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.roots[rec.root]; ok || len(rec.nodes) > c.free {
+		return
+	}
+	c.roots[rec.root] = rec.nodes
+	c.free -= len(rec.nodes)
+}
+
+func (c *storageRootCache) logSummary() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	roots := len(c.roots)
+	c.mu.Unlock()
+	log.WithFields(log.Fields{
+		"roots":  roots,
+		"hits":   atomic.LoadUint64(&c.hits),
+		"reused": atomic.LoadUint64(&c.reused),
+	}).Info("storage root cache")
+}
+
+// cachedPosition is the position reached in publishing the cached nodes of a storage trie, the path of the
+// next node to publish. The nodes are cached in iteration order, so a walk of the trie resumed from this path
+// publishes the rest of them.
+type cachedPosition struct {
+	path []byte
+}
+
+func (p *cachedPosition) Path() []byte {
+	return p.path
+}
+
+// storageRecording collects copies of the nodes of a storage trie as they are published. A recording
+// which exceeds its limit is dropped. A nil *storageRecording records nothing.
+type storageRecording struct {
+	root     common.Hash
+	limit    int
+	nodes    []cachedStorageNode
+	overflow bool
+}
+
+// add records a node, copying the buffers which are recycled once the node is published
+func (r *storageRecording) add(node *Node, slot []byte) {
+	if r == nil || r.overflow {
+		return
+	}
+	if len(r.nodes) == r.limit {
+		r.overflow, r.nodes = true, nil
+		return
+	}
+	cached := cachedStorageNode{node: *node, slot: common.CopyBytes(slot)}
+	cached.node.Path = common.CopyBytes(node.Path)
+	cached.node.Value = common.CopyBytes(node.Value)
+	r.nodes = append(r.nodes, cached)
+}
@@ -0,0 +1,145 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// ParseStoragePrefix parses a storage trie path prefix written as hex nibbles, e.g. "3a" for the
+// nibbles 3, a. The empty prefix covers the whole trie.
+func ParseStoragePrefix(s string) ([]byte, error) {
+	s = strings.TrimPrefix(s, "0x")
+	prefix := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case '0' <= c && c <= '9':
+			prefix[i] = c - '0'
+		case 'a' <= c && c <= 'f':
+			prefix[i] = c - 'a' + 10
+		case 'A' <= c && c <= 'F':
+			prefix[i] = c - 'A' + 10
+		default:
+			return nil, fmt.Errorf("invalid storage prefix %q: %q is not a hex nibble", s, c)
+		}
+	}
+	return prefix, nil
+}
+
+// prefixIterator visits only the nodes under a set of path prefixes, and the nodes above them on the
+// paths from the root
+type prefixIterator struct {
+	trie.NodeIterator
+	prefixes [][]byte
+}
+
+func newPrefixIterator(it trie.NodeIterator, prefixes [][]byte) *prefixIterator {
+	return &prefixIterator{it, prefixes}
+}
+
+func (it *prefixIterator) Next(bool) bool {
+	for it.NodeIterator.Next(it.inRange(it.Path())) {
+		if it.inRange(it.Path()) {
+			return true
+		}
+	}
+	return false
+}
+
+// inRange reports whether a node path is under one of the prefixes, or on the path to one
+func (it *prefixIterator) inRange(path []byte) bool {
+	for _, prefix := range it.prefixes {
+		if bytes.HasPrefix(path, prefix) || bytes.HasPrefix(prefix, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateStorageShard publishes the part of an account's storage trie under the given path prefixes,
+// so that the storage of a single large contract can be split between hosts. The header and the
+// state nodes on the path to the account are also published, as the storage rows reference them.
+// Storage nodes above the prefixes are published by every shard, which the conflict handling of the
+// output absorbs.
+func (s *Service) CreateStorageShard(height uint64, account common.Hash, prefixes [][]byte) (err error) {
+	header, err := s.readHeader(height)
+	if err != nil {
+		return err
+	}
+	if err = s.publishHeader(header); err != nil {
+		return err
+	}
+	headerID := header.Hash().String()
+	tree, err := s.stateDB.OpenTrie(header.Root)
+	if err != nil {
+		return wrapTrieError(err)
+	}
+
+	tx, err := s.ipfsPublisher.BeginTx()
+	if err != nil {
+		return err
+	}
+	defer func() { err = CommitOrRollback(tx, err) }()
+
+	paths, _ := changedPaths([]common.Hash{account})
+	it := newChangedIterator(tree.NodeIterator(nil), paths)
+	var leaf *nodeResult
+	for it.Next(true) {
+		res, err := resolveNode(it, s.stateDB.TrieDB())
+		if err != nil {
+			return err
+		}
+		if res == nil {
+			continue
+		}
+		if res.node.NodeType == Leaf {
+			res.node.Key = res.leafKey()
+			if res.node.Key == account {
+				leaf = res
+			}
+		}
+		err = s.ipfsPublisher.PublishStateNode(&res.node, headerID, tx)
+		putNodeBuffer(res.node.Value)
+		if err != nil {
+			return wrapStateError(err, &res.node, headerID)
+		}
+	}
+	if err = wrapTrieError(it.Error()); err != nil {
+		return err
+	}
+	if leaf == nil {
+		return fmt.Errorf("account %s does not exist at height %d", account.Hex(), height)
+	}
+
+	var acct types.StateAccount
+	if err := rlp.DecodeBytes(leaf.elements[1].([]byte), &acct); err != nil {
+		return fmt.Errorf("error decoding account %s: %w", account.Hex(), err)
+	}
+	if acct.Root == s.emptyRoot {
+		log.Warnf("account %s has no storage at height %d", account.Hex(), height)
+		return nil
+	}
+	sTrie, err := s.stateDB.OpenTrie(acct.Root)
+	if err != nil {
+		return wrapTrieError(err)
+	}
+	log.Infof("publishing storage of account %s under %d prefixes", account.Hex(), len(prefixes))
+	sit := newPrefixIterator(sTrie.NodeIterator(nil), prefixes)
+	next, err := s.publishStorageNodes(sit, headerID, leaf.node.Path, account, tx, nil, nil)
+	if next != nil {
+		tx = next
+	}
+	if err != nil {
+		return fmt.Errorf("failed building storage shard for account %s (storage root %s): %w",
+			account.Hex(), acct.Root.Hex(), err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package snapshot
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/trie"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+const (
+	// depth of the levels of a storage trie counted to estimate its size
+	storageProbeDepth = 3
+	// default number of nodes in the probed levels at which a storage walk is split
+	DefaultStorageSplitThreshold = 1024
+)
+
+// storageSplitter decides which storage tries are large enough to walk concurrently
+type storageSplitter struct {
+	workers   uint
+	threshold uint
+}
+
+func (sp storageSplitter) enabled() bool {
+	return sp.workers > 1
+}
+
+// isLarge estimates the size of a storage trie by counting the nodes in its top levels, which
+// are only filled out in tries with many leaves
+func (sp storageSplitter) isLarge(tree state.Trie) (bool, error) {
+	threshold := sp.threshold
+	if threshold == 0 {
+		threshold = DefaultStorageSplitThreshold
+	}
+	var count uint
+	it := tree.NodeIterator(nil)
+	for it.Next(len(it.Path()) < storageProbeDepth) {
+		if it.Leaf() || IsNullHash(it.Hash()) {
+			continue
+		}
+		if count++; count >= threshold {
+			return true, nil
+		}
+	}
+	return false, wrapTrieError(it.Error())
+}
+
+// storageSnapshotAsync publishes a storage trie split between concurrent walkers, each
+// publishing in its own transactions
+func (s *Service) storageSnapshotAsync(tree state.Trie, headerID string, statePath []byte, stateKey common.Hash, tx Tx, m *flushMember) (Tx, error) {
+	// commit the state leaf, so its storage isn't committed before it, and nothing of this worker is left
+	// uncommitted while a flush waits on the walkers in its place
+	tx, err := s.commitTx(tx)
+	if err != nil {
+		return tx, err
+	}
+	log.Debugf("splitting storage trie of account at path %x between %d walkers", statePath, s.storageSplit.workers)
+
+	iters := subtrieIterators(tree, s.storageSplit.workers)
+	walkers := s.flusher.handOff(m, len(iters))
+	defer s.flusher.takeBack(m)
+	errs := make(chan error, len(iters))
+	var wg sync.WaitGroup
+	for i, it := range iters {
+		wg.Add(1)
+		go func(it trie.NodeIterator, w *flushMember) {
+			defer wg.Done()
+			errs <- s.walkStorageSubtrie(it, headerID, statePath, stateKey, w)
+		}(it, walkers[i])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return tx, fmt.Errorf("failed walking storage subtrie: %w", err)
+		}
+	}
+	return tx, nil
+}
+
+// walkStorageSubtrie publishes a storage subtrie as the flush member m, which it unregisters when done
+func (s *Service) walkStorageSubtrie(it trie.NodeIterator, headerID string, statePath []byte, stateKey common.Hash, m *flushMember) (err error) {
+	defer s.flusher.unregister(m)
+	// the walkers of each large trie are short-lived, so they don't start the progress reporting of a worker
+	tx, err := BeginBatchTx(s.ipfsPublisher)
+	if err != nil {
+		return err
+	}
+	defer func() { err = commitOrStop(tx, err) }()
+	next, err := s.publishStorageNodes(it, headerID, statePath, stateKey, tx, m, nil)
+	if next != nil {
+		tx = next
+	}
+	return err
+}
@@ -1,10 +1,15 @@
 package snapshot
 
 import (
+	"bytes"
 	"encoding/csv"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/ethereum/go-ethereum/core/state"
@@ -17,6 +22,46 @@ import (
 type trackedIter struct {
 	trie.NodeIterator
 	tracker *iteratorTracker
+	// index of the worker's recovery file, if written per worker
+	worker int
+
+	// position in the storage trie of the account at the current path, while it is being published
+	storage storagePosition
+	// storage path restored for the account at resumePath
+	resumePath, resumeStorage []byte
+}
+
+// asTracked returns the tracked iterator underlying an iterator, if any
+func asTracked(it trie.NodeIterator) *trackedIter {
+	if changed, ok := it.(*changedIterator); ok {
+		it = changed.NodeIterator
+	}
+	tracked, _ := it.(*trackedIter)
+	return tracked
+}
+
+// storagePosition is the position reached in a storage trie, either its iterator or the position in the cached nodes
+// of the trie
+type storagePosition interface {
+	Path() []byte
+}
+
+// setStorage sets the position in the storage trie being published for the current account
+func (it *trackedIter) setStorage(storage storagePosition) {
+	if it != nil {
+		it.storage = storage
+	}
+}
+
+// storageResumeKey returns the key to resume the storage trie of the account at statePath from, if a
+// storage position was restored for it, or nil to start from the beginning
+func (it *trackedIter) storageResumeKey(statePath []byte) []byte {
+	if it == nil || it.resumePath == nil || !bytes.Equal(statePath, it.resumePath) {
+		return nil
+	}
+	key := seekKey(it.resumeStorage)
+	it.resumePath, it.resumeStorage = nil, nil
+	return key
 }
 
 func (it *trackedIter) Next(descend bool) bool {
@@ -33,6 +78,9 @@ func (it *trackedIter) Next(descend bool) bool {
 
 type iteratorTracker struct {
 	recoveryFile string
+	// whether each iterator is dumped to its own file, suffixed with the worker index
+	perWorker  bool
+	numTracked int
 
 	startChan chan *trackedIter
 	stopChan  chan *trackedIter
@@ -51,40 +99,88 @@ func newTracker(file string, buf int) iteratorTracker {
 	}
 }
 
-func (tr *iteratorTracker) captureSignal() {
+// captureSignal dumps the tracker state and exits on SIGINT or SIGTERM, until the returned func is called
+func (tr *iteratorTracker) captureSignal() (stop func()) {
 	sigChan := make(chan os.Signal, 1)
+	done := make(chan struct{})
 
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		sig := <-sigChan
-		log.Errorf("Signal received (%v), stopping", sig)
-		tr.haltAndDump()
-		os.Exit(1)
+		select {
+		case sig := <-sigChan:
+			log.Errorf("Signal received (%v), stopping", sig)
+			tr.haltAndDump()
+			os.Exit(1)
+		case <-done:
+		}
 	}()
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
 }
 
 // Wraps an iterator in a trackedIter. This should not be called once halts are possible.
 func (tr *iteratorTracker) tracked(it trie.NodeIterator) (ret *trackedIter) {
-	ret = &trackedIter{it, tr}
+	ret = &trackedIter{NodeIterator: it, tracker: tr, worker: tr.numTracked}
+	tr.numTracked++
 	tr.startChan <- ret
 	return
 }
 
-// dumps iterator path and bounds to a text file so it can be restored later
+// dumps iterator path and bounds to a text file so it can be restored later.
+// Each row holds the path and end path of a state iterator, and, if the iterator is at an account
+// whose storage is being published, the path of the storage iterator.
 func (tr *iteratorTracker) dump() error {
+	if tr.perWorker {
+		return tr.dumpPerWorker()
+	}
 	log.Debug("Dumping recovery state to: ", tr.recoveryFile)
 	var rows [][]string
-	for it, _ := range tr.started {
-		var endPath []byte
-		if impl, ok := it.NodeIterator.(*iter.PrefixBoundIterator); ok {
-			endPath = impl.EndPath
+	for it := range tr.started {
+		rows = append(rows, it.recoveryRow())
+	}
+	if err := writeRecoveryFile(tr.recoveryFile, rows); err != nil {
+		return err
+	}
+	return tr.removeWorkerFiles(nil)
+}
+
+// dumpPerWorker writes the row of each iterator to the worker's own file, and removes the files of
+// finished workers and any single recovery file
+func (tr *iteratorTracker) dumpPerWorker() error {
+	log.Debug("Dumping per-worker recovery state to: ", tr.recoveryFile)
+	written := map[string]struct{}{}
+	for it := range tr.started {
+		file := workerRecoveryFile(tr.recoveryFile, it.worker)
+		if err := writeRecoveryFile(file, [][]string{it.recoveryRow()}); err != nil {
+			return err
 		}
-		rows = append(rows, []string{
-			fmt.Sprintf("%x", it.Path()),
-			fmt.Sprintf("%x", endPath),
-		})
+		written[file] = struct{}{}
+	}
+	if err := tr.removeWorkerFiles(written); err != nil {
+		return err
 	}
-	file, err := os.Create(tr.recoveryFile)
+	return removeFile(tr.recoveryFile)
+}
+
+func (it *trackedIter) recoveryRow() []string {
+	var endPath []byte
+	if impl, ok := it.NodeIterator.(*iter.PrefixBoundIterator); ok {
+		endPath = impl.EndPath
+	}
+	row := []string{
+		fmt.Sprintf("%x", it.Path()),
+		fmt.Sprintf("%x", endPath),
+	}
+	if it.storage != nil {
+		row = append(row, fmt.Sprintf("%x", it.storage.Path()))
+	}
+	return row
+}
+
+func writeRecoveryFile(path string, rows [][]string) error {
+	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
@@ -93,28 +189,84 @@ func (tr *iteratorTracker) dump() error {
 	return out.WriteAll(rows)
 }
 
-// attempts to read iterator state from file
-// if file doesn't exist, returns an empty slice with no error
-func (tr *iteratorTracker) restore(tree state.Trie) ([]trie.NodeIterator, error) {
-	file, err := os.Open(tr.recoveryFile)
+// workerRecoveryFile returns the recovery file of a worker, <base>.w<n>
+func workerRecoveryFile(base string, worker int) string {
+	return fmt.Sprintf("%s.w%d", base, worker)
+}
+
+// workerRecoveryFiles returns the existing per-worker recovery files for a base file, in worker order
+func workerRecoveryFiles(base string) ([]string, error) {
+	matches, err := filepath.Glob(base + ".w*")
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
 		return nil, err
 	}
-	log.Debug("Restoring recovery state from: ", tr.recoveryFile)
-	defer file.Close()
-	in := csv.NewReader(file)
-	in.FieldsPerRecord = 2
-	rows, err := in.ReadAll()
+	workers := map[int]string{}
+	var indexes []int
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(match, base+".w"))
+		if err != nil || n < 0 {
+			continue
+		}
+		workers[n] = match
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+	files := make([]string, len(indexes))
+	for i, n := range indexes {
+		files[i] = workers[n]
+	}
+	return files, nil
+}
+
+// removeWorkerFiles removes the per-worker recovery files not in keep
+func (tr *iteratorTracker) removeWorkerFiles(keep map[string]struct{}) error {
+	files, err := workerRecoveryFiles(tr.recoveryFile)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, ok := keep[file]; ok {
+			continue
+		}
+		if err := removeFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFile removes a file, if it exists
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// attempts to read iterator state from the recovery file and any per-worker files
+// if no file exists, returns an empty slice with no error
+func (tr *iteratorTracker) restore(tree state.Trie) ([]trie.NodeIterator, error) {
+	files, err := workerRecoveryFiles(tr.recoveryFile)
 	if err != nil {
 		return nil, err
 	}
+	files = append([]string{tr.recoveryFile}, files...)
+	var rows [][]string
+	for _, file := range files {
+		fileRows, err := readRecoveryFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recovery file %s: %w", file, err)
+		}
+		rows = append(rows, fileRows...)
+	}
 	var ret []trie.NodeIterator
 	for _, row := range rows {
+		if len(row) != 2 && len(row) != 3 {
+			return nil, fmt.Errorf("invalid recovery row: %v", row)
+		}
 		// pick up where each interval left off
-		var paths [2][]byte
+		var paths [3][]byte
 		for i, val := range row {
 			if len(val) != 0 {
 				if _, err = fmt.Sscanf(val, "%x", &paths[i]); err != nil {
@@ -123,17 +275,74 @@ func (tr *iteratorTracker) restore(tree state.Trie) ([]trie.NodeIterator, error)
 			}
 		}
 
-		// Force the lower bound path to an even length
-		if len(paths[0])&0b1 == 1 {
-			decrementPath(paths[0]) // decrement first to avoid skipped nodes
-			paths[0] = append(paths[0], 0)
+		it := iter.NewPrefixBoundIterator(tree.NodeIterator(seekKey(paths[0])), paths[1])
+		tracked := tr.tracked(it)
+		if len(row) == 3 {
+			log.Infof("Restoring iterator from path %x to %x, with storage from path %x", paths[0], paths[1], paths[2])
+			// the paths may be empty, but must be non-nil
+			tracked.resumePath = append([]byte{}, paths[0]...)
+			tracked.resumeStorage = append([]byte{}, paths[2]...)
+		} else {
+			log.Infof("Restoring iterator from path %x to %x", paths[0], paths[1])
 		}
-		it := iter.NewPrefixBoundIterator(tree.NodeIterator(iter.HexToKeyBytes(paths[0])), paths[1])
-		ret = append(ret, tr.tracked(it))
+		ret = append(ret, tracked)
 	}
 	return ret, nil
 }
 
+// readRecoveryFile reads the rows of a recovery file, returning none if it doesn't exist
+func readRecoveryFile(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	log.Debug("Restoring recovery state from: ", path)
+	defer file.Close()
+	in := csv.NewReader(file)
+	// the storage path is optional
+	in.FieldsPerRecord = -1
+	return in.ReadAll()
+}
+
+// seekKey returns the key at which to start an iterator so that it resumes from a path without skipping nodes
+func seekKey(path []byte) []byte {
+	// Force the path to an even length
+	if len(path)&0b1 == 1 {
+		path = append([]byte{}, path...)
+		decrementPath(path) // decrement first to avoid skipped nodes
+		path = append(path, 0)
+	}
+	return iter.HexToKeyBytes(path)
+}
+
+// checkpoint dumps the current iterator state without halting the tracker.
+// The tracked iterators must not be advanced while it runs.
+func (tr *iteratorTracker) checkpoint() error {
+	if !tr.running {
+		return nil
+	}
+	for drained := false; !drained; {
+		select {
+		case start := <-tr.startChan:
+			tr.started[start] = struct{}{}
+		case stop := <-tr.stopChan:
+			tr.stopped = append(tr.stopped, stop)
+		default:
+			drained = true
+		}
+	}
+	for _, stop := range tr.stopped {
+		delete(tr.started, stop)
+	}
+	if len(tr.started) == 0 {
+		return nil
+	}
+	return tr.dump()
+}
+
 func (tr *iteratorTracker) haltAndDump() error {
 	tr.running = false
 
@@ -152,12 +361,11 @@ func (tr *iteratorTracker) haltAndDump() error {
 	}
 
 	if len(tr.started) == 0 {
-		// if the tracker state is empty, erase any existing recovery file
-		err := os.Remove(tr.recoveryFile)
-		if os.IsNotExist(err) {
-			err = nil
+		// if the tracker state is empty, erase any existing recovery files
+		if err := removeFile(tr.recoveryFile); err != nil {
+			return err
 		}
-		return err
+		return tr.removeWorkerFiles(nil)
 	}
 	return tr.dump()
 }
@@ -5,16 +5,30 @@ import (
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/statediff/indexer/database/sql/postgres"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/prom"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/clickhouse"
 	file "github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/file"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/kv"
 	pg "github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/pg"
+	"github.com/vulcanize/ipld-eth-state-snapshot/pkg/snapshot/sharded"
 	snapt "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
 )
 
 func NewPublisher(mode SnapshotMode, config *Config) (snapt.Publisher, error) {
+	if err := checkSinceSnapshot(mode, config); err != nil {
+		return nil, err
+	}
+	prior, manifest, err := openManifests(config.Manifest)
+	if err != nil {
+		return nil, err
+	}
 	switch mode {
 	case PgSnapshot:
+		if len(config.DB.Shards) > 0 {
+			return newShardedPublisher(config, prior, manifest)
+		}
 		driver, err := postgres.NewPGXDriver(context.Background(), config.DB.ConnConfig, config.Eth.NodeInfo)
 		if err != nil {
 			return nil, err
@@ -22,13 +36,132 @@ func NewPublisher(mode SnapshotMode, config *Config) (snapt.Publisher, error) {
 
 		prom.RegisterDBCollector(config.DB.ConnConfig.DatabaseName, driver)
 
-		return pg.NewPublisher(postgres.NewPostgresDB(driver)), nil
+		db := postgres.NewPostgresDB(driver)
+		pub := pg.NewPublisher(db)
+		if config.Manifest.SinceSnapshot >= 0 {
+			ids, err := baseSnapshotIDs(db, uint64(config.Manifest.SinceSnapshot))
+			if err != nil {
+				return nil, err
+			}
+			if err = pub.SetBaseSnapshot(ids); err != nil {
+				return nil, err
+			}
+		}
+		pub.SetConflictMode(config.DB.ConflictMode)
+		pub.SetManifests(prior, manifest)
+		pub.SetStorageStateKeys(config.Schema.StorageStateKeys)
+		pub.SetNodeTypeNames(config.Schema.NodeTypeNames)
+		pub.SetBlockCompression(config.DB.BlockCompression)
+		pub.SetStatsFile(config.Stats.OutputFile)
+		return pub, nil
 	case FileSnapshot:
-		return file.NewPublisher(config.File.OutputDir, config.Eth.NodeInfo)
+		pub, err := file.NewPublisher(config.File.OutputDir, config.Eth.NodeInfo)
+		if err != nil {
+			return nil, err
+		}
+		pub.SetManifests(prior, manifest)
+		pub.SetStorageStateKeys(config.Schema.StorageStateKeys)
+		pub.SetNodeTypeNames(config.Schema.NodeTypeNames)
+		pub.SetStatsFile(config.Stats.OutputFile)
+		return pub, nil
+	case ClickHouseSnapshot:
+		pub, err := clickhouse.NewPublisher(clickhouse.Config{
+			OutputDir: config.ClickHouse.OutputDir,
+			URL:       config.ClickHouse.URL,
+			Database:  config.ClickHouse.Database,
+			User:      config.ClickHouse.User,
+			Password:  config.ClickHouse.Password,
+			BatchRows: config.ClickHouse.BatchRows,
+		}, config.Eth.NodeInfo)
+		if err != nil {
+			return nil, err
+		}
+		pub.SetManifests(prior, manifest)
+		pub.SetStatsFile(config.Stats.OutputFile)
+		return pub, nil
+	case KVSnapshot:
+		pub, err := kv.NewLevelDBPublisher(config.KV.OutputDir, config.Eth.NodeInfo)
+		if err != nil {
+			return nil, err
+		}
+		pub.SetManifests(prior, manifest)
+		pub.SetStatsFile(config.Stats.OutputFile)
+		return pub, nil
 	}
 	return nil, fmt.Errorf("invalid snapshot mode: %s", mode)
 }
 
+// checkSinceSnapshot checks that a base snapshot is only set for a single postgres database
+func checkSinceSnapshot(mode SnapshotMode, config *Config) error {
+	if config.Manifest.SinceSnapshot < 0 {
+		return nil
+	}
+	if mode != PgSnapshot {
+		return fmt.Errorf("since-snapshot is only supported in postgres mode")
+	}
+	if len(config.DB.Shards) > 0 {
+		return fmt.Errorf("since-snapshot is not supported with database shards")
+	}
+	return nil
+}
+
+// baseSnapshotIDs returns the IDs of the headers indexed at a base height, whose blocks are not written again
+func baseSnapshotIDs(db *postgres.DB, height uint64) ([]string, error) {
+	ids, err := pg.HeaderIDsAt(context.Background(), db, height)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no base snapshot indexed at height %d", height)
+	}
+	log.Infof("sharing unchanged blocks with %d base snapshots at height %d", len(ids), height)
+	return ids, nil
+}
+
+// newShardedPublisher creates a publisher which distributes its output across the configured databases
+func newShardedPublisher(config *Config, prior snapt.CIDSet, manifest *snapt.ManifestWriter) (snapt.Publisher, error) {
+	var shards []snapt.Publisher
+	for i, conn := range config.DB.Shards {
+		log.Infof("connecting to database shard %d: %s:%d/%s", i, conn.Hostname, conn.Port, conn.DatabaseName)
+		driver, err := postgres.NewPGXDriver(context.Background(), conn, config.Eth.NodeInfo)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+
+		prom.RegisterDBCollector(fmt.Sprintf("%s_shard%d", conn.DatabaseName, i), driver)
+
+		pub := pg.NewPublisher(postgres.NewPostgresDB(driver))
+		pub.SetConflictMode(config.DB.ConflictMode)
+		pub.SetManifests(prior, manifest)
+		pub.SetStorageStateKeys(config.Schema.StorageStateKeys)
+		pub.SetNodeTypeNames(config.Schema.NodeTypeNames)
+		pub.SetBlockCompression(config.DB.BlockCompression)
+		shards = append(shards, pub)
+	}
+	pub, err := sharded.NewPublisher(shards, config.DB.ShardFunc, config.DB.ShardHeaders)
+	if err != nil {
+		return nil, err
+	}
+	pub.SetStatsFile(config.Stats.OutputFile)
+	return pub, nil
+}
+
+func openManifests(config *ManifestConfig) (prior snapt.CIDSet, manifest *snapt.ManifestWriter, err error) {
+	if config.PriorFile != "" {
+		log.Infof("loading prior manifest from %s", config.PriorFile)
+		if prior, err = snapt.LoadManifest(config.PriorFile); err != nil {
+			return nil, nil, fmt.Errorf("unable to load prior manifest: %w", err)
+		}
+		log.Infof("loaded %d known blocks from prior manifest", len(prior))
+	}
+	if config.OutputFile != "" {
+		if manifest, err = snapt.NewManifestWriter(config.OutputFile); err != nil {
+			return nil, nil, fmt.Errorf("unable to open manifest file: %w", err)
+		}
+	}
+	return
+}
+
 // Subtracts 1 from the last byte in a path slice, carrying if needed.
 // Does nothing, returning false, for all-zero inputs.
 func decrementPath(path []byte) bool {
@@ -0,0 +1,59 @@
+package snapshot
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ConfigErrors lists the problems found in a config
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// Validate checks the requirements of a snapshot in the given mode which Init leaves to the run,
+// returning a ConfigErrors listing all the problems found. It doesn't open the databases or files the
+// config refers to.
+func (c *Config) Validate(mode SnapshotMode) error {
+	var errs ConfigErrors
+	if c.Eth.LevelDBPath == "" {
+		errs = append(errs, fmt.Sprintf("no leveldb path set (%s)", LVL_DB_PATH_TOML))
+	}
+	if c.Manifest.OutputFile != "" && c.Manifest.OutputFile == c.Manifest.PriorFile {
+		errs = append(errs, fmt.Sprintf("%s and %s are the same file", SNAPSHOT_MANIFEST_FILE_TOML, SNAPSHOT_PRIOR_MANIFEST_TOML))
+	}
+	if err := checkSinceSnapshot(mode, c); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if mode == PgSnapshot {
+		// shards carry their own connection settings
+		if len(c.DB.Shards) == 0 {
+			if c.DB.ConnConfig.DatabaseName == "" {
+				errs = append(errs, fmt.Sprintf("no database name set (%s)", DATABASE_NAME_TOML))
+			}
+			if c.DB.ConnConfig.Hostname == "" {
+				errs = append(errs, fmt.Sprintf("no database hostname set (%s)", DATABASE_HOSTNAME_TOML))
+			}
+			if c.DB.ConnConfig.Port <= 0 {
+				errs = append(errs, fmt.Sprintf("invalid database port %d (%s)", c.DB.ConnConfig.Port, DATABASE_PORT_TOML))
+			}
+		}
+		if c.DB.SpaceMargin < 0 {
+			errs = append(errs, fmt.Sprintf("negative space margin %v (%s)", c.DB.SpaceMargin, DATABASE_SPACE_MARGIN_TOML))
+		}
+	}
+
+	if mode == ClickHouseSnapshot && c.ClickHouse.URL != "" {
+		if u, err := url.Parse(c.ClickHouse.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("invalid ClickHouse URL %q, expected an http:// or https:// URL (%s)", c.ClickHouse.URL, CLICKHOUSE_URL_TOML))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/vulcanize/ipld-eth-state-snapshot/pkg/types"
+)
+
+// WebhookEvent is a milestone of a snapshot which can be posted to a webhook
+type WebhookEvent string
+
+const (
+	// WebhookStart is posted when a snapshot starts
+	WebhookStart WebhookEvent = "start"
+	// WebhookComplete is posted when a snapshot completes
+	WebhookComplete WebhookEvent = "complete"
+	// WebhookFailure is posted when a snapshot fails, after any restarts
+	WebhookFailure WebhookEvent = "failure"
+)
+
+// webhookTimeout bounds each delivery, so that an unresponsive endpoint doesn't hold up the snapshot
+var webhookTimeout = 10 * time.Second
+
+// ParseWebhookEvents parses a list of webhook event names. An empty list selects every event.
+func ParseWebhookEvents(names []string) ([]WebhookEvent, error) {
+	if len(names) == 0 {
+		return []WebhookEvent{WebhookStart, WebhookComplete, WebhookFailure}, nil
+	}
+	events := make([]WebhookEvent, len(names))
+	for i, name := range names {
+		switch event := WebhookEvent(name); event {
+		case WebhookStart, WebhookComplete, WebhookFailure:
+			events[i] = event
+		default:
+			return nil, fmt.Errorf("invalid webhook event: %s", name)
+		}
+	}
+	return events, nil
+}
+
+// WebhookPayload is the JSON body posted to a webhook
+type WebhookPayload struct {
+	Event  WebhookEvent `json:"event"`
+	Height uint64       `json:"height"`
+	Time   time.Time    `json:"time"`
+	// the error the snapshot failed with, for failure events
+	Error string `json:"error,omitempty"`
+	// the publisher's progress, if it reports it
+	Stats *Stats `json:"stats,omitempty"`
+}
+
+// webhook posts the selected events to a URL. Failures to deliver are logged and otherwise ignored.
+// A nil *webhook posts nothing.
+type webhook struct {
+	url    string
+	events map[WebhookEvent]bool
+	client *http.Client
+}
+
+func newWebhook(url string, events []WebhookEvent) *webhook {
+	if url == "" {
+		return nil
+	}
+	w := &webhook{url: url, events: make(map[WebhookEvent]bool), client: &http.Client{Timeout: webhookTimeout}}
+	for _, event := range events {
+		w.events[event] = true
+	}
+	return w
+}
+
+// notify posts an event with the publisher's stats, if it is selected
+func (w *webhook) notify(event WebhookEvent, height uint64, pub Publisher, err error) {
+	if w == nil || !w.events[event] {
+		return
+	}
+	payload := WebhookPayload{Event: event, Height: height, Time: time.Now()}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	if reporter, ok := pub.(StatsReporter); ok {
+		stats := reporter.Stats()
+		payload.Stats = &stats
+	}
+	if err := w.post(&payload); err != nil {
+		log.Warnf("failed to deliver %s event to webhook: %v", event, err)
+	}
+}
+
+func (w *webhook) post(payload *WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+var machineLogs int32
+
+// SetMachineLogs sets whether LogEvent writes machine-readable lines of key=value pairs instead of logging
+func SetMachineLogs(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&machineLogs, v)
+}
+
+// LogField is a key and value of a logged event. Keys are snake_case; in human-readable
+// logs the underscores are replaced with spaces.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// LogEvent logs an event with its fields, or if machine-readable logs are enabled, writes them to the
+// log output as a single line, e.g. "event=progress state_nodes=123 storage_nodes=456"
+func LogEvent(msg string, fields ...LogField) {
+	if atomic.LoadInt32(&machineLogs) == 0 {
+		logFields := logrus.Fields{}
+		for _, f := range fields {
+			logFields[strings.ReplaceAll(f.Key, "_", " ")] = f.Value
+		}
+		logrus.WithFields(logFields).Info(msg)
+		return
+	}
+	var line strings.Builder
+	fmt.Fprintf(&line, "event=%s", strings.ReplaceAll(msg, " ", "_"))
+	for _, f := range fields {
+		fmt.Fprintf(&line, " %s=%v", f.Key, f.Value)
+	}
+	line.WriteByte('\n')
+	logger := logrus.StandardLogger()
+	logger.Lock()
+	defer logger.Unlock()
+	logger.Out.Write([]byte(line.String()))
+}
@@ -0,0 +1,179 @@
+package types
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	StateManifestKind   = "state"
+	StorageManifestKind = "storage"
+)
+
+// ManifestEntry describes a trie node published by a snapshot
+type ManifestEntry struct {
+	Kind      string
+	CID       string
+	MhKey     string
+	StatePath []byte
+	Path      []byte
+	NodeType  nodeType
+	LeafKey   string
+}
+
+func (e ManifestEntry) row() []string {
+	return []string{
+		e.Kind,
+		e.CID,
+		e.MhKey,
+		fmt.Sprintf("%x", e.StatePath),
+		fmt.Sprintf("%x", e.Path),
+		strconv.Itoa(int(e.NodeType)),
+		e.LeafKey,
+	}
+}
+
+// ManifestWriter appends manifest entries to a CSV file.
+// A nil *ManifestWriter discards all entries.
+type ManifestWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	out  *csv.Writer
+}
+
+// NewManifestWriter opens the manifest file for appending, so that a resumed run extends the
+// manifest of the interrupted one.
+func NewManifestWriter(path string) (*ManifestWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &ManifestWriter{file: file, out: csv.NewWriter(file)}, nil
+}
+
+// Write appends the entries and flushes them to the file
+func (m *ManifestWriter) Write(entries []ManifestEntry) error {
+	if m == nil || len(entries) == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		if err := m.out.Write(e.row()); err != nil {
+			return err
+		}
+	}
+	m.out.Flush()
+	return m.out.Error()
+}
+
+func (m *ManifestWriter) Close() error {
+	if m == nil {
+		return nil
+	}
+	return m.file.Close()
+}
+
+// NewBatch returns a batch which holds entries until the transaction they were published in
+// is committed. Returns nil if m is nil.
+func (m *ManifestWriter) NewBatch() *ManifestBatch {
+	if m == nil {
+		return nil
+	}
+	return &ManifestBatch{writer: m}
+}
+
+// ManifestBatch accumulates the entries of an uncommitted transaction.
+// A nil *ManifestBatch discards all entries.
+type ManifestBatch struct {
+	writer  *ManifestWriter
+	entries []ManifestEntry
+}
+
+func (b *ManifestBatch) Add(e ManifestEntry) {
+	if b != nil {
+		b.entries = append(b.entries, e)
+	}
+}
+
+// Flush writes out the accumulated entries, to be called once their transaction has committed
+func (b *ManifestBatch) Flush() error {
+	if b == nil {
+		return nil
+	}
+	err := b.writer.Write(b.entries)
+	b.entries = nil
+	return err
+}
+
+// CIDSet is a set of CID strings. A nil CIDSet is empty.
+type CIDSet map[string]struct{}
+
+func (s CIDSet) Has(c string) bool {
+	_, has := s[c]
+	return has
+}
+
+// parseManifestRow parses a row written by ManifestEntry.row
+func parseManifestRow(row []string) (ManifestEntry, error) {
+	e := ManifestEntry{Kind: row[0], CID: row[1], MhKey: row[2], LeafKey: row[6]}
+	var err error
+	if e.StatePath, err = hex.DecodeString(row[3]); err != nil {
+		return e, fmt.Errorf("invalid state path %q: %w", row[3], err)
+	}
+	if e.Path, err = hex.DecodeString(row[4]); err != nil {
+		return e, fmt.Errorf("invalid path %q: %w", row[4], err)
+	}
+	ty, err := strconv.Atoi(row[5])
+	if err != nil {
+		return e, fmt.Errorf("invalid node type %q: %w", row[5], err)
+	}
+	e.NodeType = nodeType(ty)
+	return e, nil
+}
+
+// ReadManifest calls fn with each entry of a manifest file, in order
+func ReadManifest(path string, fn func(ManifestEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	in := csv.NewReader(file)
+	in.FieldsPerRecord = len(ManifestEntry{}.row())
+
+	for line := 1; ; line++ {
+		row, err := in.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e, err := parseManifestRow(row)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// LoadManifest reads the set of CIDs recorded in a manifest file
+func LoadManifest(path string) (CIDSet, error) {
+	ret := CIDSet{}
+	err := ReadManifest(path, func(e ManifestEntry) error {
+		ret[e.CID] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -27,6 +27,12 @@ type Node struct {
 	Path     []byte
 	Key      common.Hash
 	Value    []byte
+	// Diff marks a node published as part of a diff, rather than a full snapshot
+	Diff bool
+	// Preimage of the Key of a leaf node, if it is known
+	Preimage []byte
+	// StateKey is the leaf key of the account owning a storage node
+	StateKey common.Hash
 }
 
 // nodeType for explicitly setting type of node
@@ -40,6 +46,21 @@ const (
 	Unknown
 )
 
+// String returns the name of the node type, as written to the node_type_name column
+func (t nodeType) String() string {
+	switch t {
+	case Branch:
+		return "branch"
+	case Extension:
+		return "extension"
+	case Leaf:
+		return "leaf"
+	case Removed:
+		return "removed"
+	}
+	return "unknown"
+}
+
 // CheckKeyType checks what type of key we have
 func CheckKeyType(elements []interface{}) (nodeType, error) {
 	if len(elements) > 2 {
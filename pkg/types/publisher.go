@@ -1,12 +1,16 @@
 package types
 
 import (
+	"math/big"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
+// Publisher publishes the header and trie nodes of a snapshot.
+// Node values may be reused by the caller once a publish call returns, so they must be copied if retained.
 type Publisher interface {
-	PublishHeader(header *types.Header) error
+	PublishHeader(header *types.Header, td, reward *big.Int) error
 	PublishStateNode(node *Node, headerID string, tx Tx) error
 	PublishStorageNode(node *Node, headerID string, statePath []byte, tx Tx) error
 	PublishCode(codeHash common.Hash, codeBytes []byte, tx Tx) error
@@ -18,3 +22,23 @@ type Tx interface {
 	Rollback() error
 	Commit() error
 }
+
+// StateNodeCounter is implemented by publishers which can count the state nodes already indexed for a header
+type StateNodeCounter interface {
+	CountStateNodes(headerID string) (int64, error)
+}
+
+// BatchTxBeginner is implemented by publishers whose BeginTx also starts the progress reporting of a worker,
+// and which can begin a transaction without it, for the short-lived writers within a worker
+type BatchTxBeginner interface {
+	BeginBatchTx() (Tx, error)
+}
+
+// BeginBatchTx begins a transaction for a short-lived writer, without the per-worker setup of BeginTx if
+// the publisher supports it
+func BeginBatchTx(p Publisher) (Tx, error) {
+	if beginner, ok := p.(BatchTxBeginner); ok {
+		return beginner.BeginBatchTx()
+	}
+	return p.BeginTx()
+}
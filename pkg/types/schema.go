@@ -9,6 +9,22 @@ var TableIPLDBlock = Table{
 	`ON CONFLICT (key) DO NOTHING`,
 }
 
+// TableIPLDBlockWithCodec is TableIPLDBlock with the codec the data is compressed with, null if uncompressed
+var TableIPLDBlockWithCodec = Table{
+	`public.blocks`,
+	append(append([]column{}, TableIPLDBlock.Columns...), column{"codec", text}),
+	`ON CONFLICT (key) DO NOTHING`,
+}
+
+var TableKeyPreimage = Table{
+	"eth.key_preimages",
+	[]column{
+		{"key", varchar},
+		{"preimage", bytea},
+	},
+	`ON CONFLICT (key) DO NOTHING`,
+}
+
 var TableNodeInfo = Table{
 	Name: `public.nodes`,
 	Columns: []column{
@@ -71,3 +87,17 @@ var TableStorageNode = Table{
 	},
 	"ON CONFLICT (header_id, state_path, storage_path) DO UPDATE SET (storage_leaf_key, cid, node_type, diff, mh_key) = (EXCLUDED.storage_leaf_key, EXCLUDED.cid, EXCLUDED.node_type, EXCLUDED.diff, EXCLUDED.mh_key)",
 }
+
+// TableStorageNodeWithStateKey is TableStorageNode with the leaf key of the owning account, for joining
+// storage to state by (header_id, state_leaf_key)
+var TableStorageNodeWithStateKey = Table{
+	"eth.storage_cids",
+	append(append([]column{}, TableStorageNode.Columns...), column{"state_leaf_key", varchar}),
+	"ON CONFLICT (header_id, state_path, storage_path) DO UPDATE SET (storage_leaf_key, cid, node_type, diff, mh_key, state_leaf_key) = (EXCLUDED.storage_leaf_key, EXCLUDED.cid, EXCLUDED.node_type, EXCLUDED.diff, EXCLUDED.mh_key, EXCLUDED.state_leaf_key)",
+}
+
+// WithNodeTypeName returns a node table which also records the name of each node's type (branch,
+// extension, leaf or removed) in a node_type_name column, for readability of the output
+func (tbl Table) WithNodeTypeName() Table {
+	return tbl.withColumn(column{"node_type_name", text})
+}
@@ -0,0 +1,67 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Stats is a point-in-time summary of a publisher's progress
+type Stats struct {
+	StartTime     time.Time `json:"start_time"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Runtime       string    `json:"runtime"`
+	StateNodes    uint64    `json:"state_nodes"`
+	StorageNodes  uint64    `json:"storage_nodes"`
+	CodeNodes     uint64    `json:"code_nodes"`
+	SkippedBlocks uint64    `json:"skipped_blocks"`
+}
+
+// LogFields returns the stats as fields of a logged event, with the overall rate of nodes published
+func (s Stats) LogFields() []LogField {
+	var rate float64
+	if elapsed := s.UpdatedAt.Sub(s.StartTime).Seconds(); elapsed > 0 {
+		rate = float64(s.StateNodes+s.StorageNodes+s.CodeNodes) / elapsed
+	}
+	return []LogField{
+		{"runtime", s.Runtime},
+		{"state_nodes", s.StateNodes},
+		{"storage_nodes", s.StorageNodes},
+		{"code_nodes", s.CodeNodes},
+		{"skipped_blocks", s.SkippedBlocks},
+		{"rate", fmt.Sprintf("%.0f/s", rate)},
+	}
+}
+
+// StatsReporter is implemented by publishers which report their progress
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// WriteStatsFile writes the stats as JSON to path, replacing any existing file.
+// The file is written to a temporary file and renamed into place, so readers never see a partial write.
+func WriteStatsFile(path string, stats Stats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
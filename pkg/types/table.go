@@ -27,6 +27,37 @@ type Table struct {
 	conflictClause string
 }
 
+// ConflictMode specifies how inserts handle rows which already exist
+type ConflictMode string
+
+const (
+	// ConflictUpsert updates the existing row
+	ConflictUpsert ConflictMode = "upsert"
+	// ConflictSkip keeps the existing row
+	ConflictSkip ConflictMode = "skip"
+	// ConflictStrict fails the insert
+	ConflictStrict ConflictMode = "strict"
+)
+
+func ParseConflictMode(str string) (ConflictMode, error) {
+	switch mode := ConflictMode(str); mode {
+	case ConflictUpsert, ConflictSkip, ConflictStrict:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid conflict mode: %s", str)
+}
+
+// withColumn returns a copy of the table with an extra last column, which upserts also update
+func (tbl Table) withColumn(col column) Table {
+	ret := Table{tbl.Name, append(append([]column{}, tbl.Columns...), col), tbl.conflictClause}
+	// extend the "DO UPDATE SET (...) = (EXCLUDED...)" lists, if there are any
+	if i := strings.Index(ret.conflictClause, ") = ("); i >= 0 && strings.HasSuffix(ret.conflictClause, ")") {
+		clause := ret.conflictClause
+		ret.conflictClause = clause[:i] + ", " + col.name + clause[i:len(clause)-1] + ", EXCLUDED." + col.name + ")"
+	}
+	return ret
+}
+
 func (tbl *Table) ToCsvRow(args ...interface{}) []string {
 	var row []string
 	for i, col := range tbl.Columns {
@@ -36,6 +67,21 @@ func (tbl *Table) ToCsvRow(args ...interface{}) []string {
 }
 
 func (tbl *Table) ToInsertStatement() string {
+	return tbl.insertStatement(tbl.conflictClause)
+}
+
+// ToInsertStatementWith returns an insert statement which handles conflicting rows according to mode
+func (tbl *Table) ToInsertStatementWith(mode ConflictMode) string {
+	switch mode {
+	case ConflictSkip:
+		return tbl.insertStatement("ON CONFLICT DO NOTHING")
+	case ConflictStrict:
+		return tbl.insertStatement("")
+	}
+	return tbl.ToInsertStatement()
+}
+
+func (tbl *Table) insertStatement(conflictClause string) string {
 	var colnames, placeholders []string
 	for i, col := range tbl.Columns {
 		colnames = append(colnames, col.name)
@@ -43,7 +89,7 @@ func (tbl *Table) ToInsertStatement() string {
 	}
 	return fmt.Sprintf(
 		"INSERT INTO %s (%s) VALUES (%s) %s",
-		tbl.Name, strings.Join(colnames, ", "), strings.Join(placeholders, ", "), tbl.conflictClause,
+		tbl.Name, strings.Join(colnames, ", "), strings.Join(placeholders, ", "), conflictClause,
 	)
 }
 